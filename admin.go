@@ -0,0 +1,456 @@
+package interruptible_websocket_proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PipeState State of a pipe as seen from outside
+type PipeState int
+
+const (
+	// PipeStreaming Both the client and the backend are attached
+	PipeStreaming PipeState = iota
+	// PipeAwaitingBackend Backend connection is being substituted, data from the client is held meanwhile
+	PipeAwaitingBackend
+	// PipeAwaitingClient Client went away and the pipe holds on for it to reconnect within the grace period
+	PipeAwaitingClient
+	// PipeClosed Pipe is not streaming anymore
+	PipeClosed
+)
+
+func (ps PipeState) String() string {
+	switch ps {
+	case PipeAwaitingBackend:
+		return "awaiting_backend"
+	case PipeAwaitingClient:
+		return "awaiting_client"
+	case PipeClosed:
+		return "closed"
+	}
+	return "streaming"
+}
+
+// PipeInfo Snapshot of a pipe
+type PipeInfo struct {
+	ClientID uuid.UUID
+	PipeID   uuid.UUID
+	// BackendUrl is empty while the backend is being substituted
+	BackendUrl string
+	// BufferedToBackendBytes and BufferedToClientBytes are held for the backend and the client respectively
+	BufferedToBackendBytes int
+	BufferedToClientBytes  int
+	State                  PipeState
+	CreatedAt              time.Time
+	Uptime                 time.Duration
+}
+
+// BackendInfo Snapshot of a registered backend url along with the entries the pool holds for it
+type BackendInfo struct {
+	Url      string
+	Capacity int
+	Weight   int
+	// InUse, Idle, Errored and Parked count the connections of the url in use by pipes, waiting on the idle list,
+	// held back after an error and held back while the backend is unhealthy respectively
+	InUse    int
+	Idle     int
+	Errored  int
+	Parked   int
+	Draining bool
+	Healthy  bool
+	Circuit  CircuitState
+	// ErrorsInWindow errors of the url within the error window of the circuit breaker
+	ErrorsInWindow int
+}
+
+// info Snapshot of the pipe
+func (pep *PersistentPipe) info() PipeInfo {
+	pep.streamMut.Lock()
+	stopped := pep.done == nil
+	awaitingBackend := pep.backendDetached || pep.BackendErr != nil
+	backendConn := pep.BackendConn
+	pep.streamMut.Unlock()
+	pep.clientMut.Lock()
+	awaitingClient := pep.ClientErr != nil
+	pep.clientMut.Unlock()
+
+	info := PipeInfo{
+		ClientID:               pep.ClientID,
+		PipeID:                 pep.ID,
+		BufferedToBackendBytes: pep.bufferedBytes(CopyToBackend),
+		BufferedToClientBytes:  pep.bufferedBytes(CopyFromBacked),
+		CreatedAt:              pep.createdAt,
+		Uptime:                 time.Since(pep.createdAt),
+	}
+	if bc, ok := backendConn.(*BackendConn); ok && !awaitingBackend {
+		info.BackendUrl = bc.connUrl
+	}
+	switch {
+	case stopped:
+		info.State = PipeClosed
+	case awaitingBackend:
+		info.State = PipeAwaitingBackend
+	case awaitingClient:
+		info.State = PipeAwaitingClient
+	}
+	return info
+}
+
+// Pipes Snapshot of every pipe, oldest first
+func (pm *WebsocketPipeManager) Pipes() []PipeInfo {
+	var pipes []PipeInfo
+	pm.clientPipesMap.Range(func(key, value any) bool {
+		pipes = append(pipes, value.(*PersistentPipe).info())
+		return true
+	})
+	sort.Slice(pipes, func(i, j int) bool {
+		return pipes[i].CreatedAt.Before(pipes[j].CreatedAt)
+	})
+	return pipes
+}
+
+// Pipe Snapshot of the pipe of the client, if it has one
+func (pm *WebsocketPipeManager) Pipe(clientId uuid.UUID) (PipeInfo, bool) {
+	value, ok := pm.clientPipesMap.Load(clientId)
+	if !ok {
+		return PipeInfo{}, false
+	}
+	return value.(*PersistentPipe).info(), true
+}
+
+// Backends Snapshot of every registered backend url, sorted by url. Draining urls are listed till they are de-registered
+func (bp *BackendWSConnPool) Backends() []BackendInfo {
+	var registrations []*backendRegistration
+	bp.registeredBackendUrls.Range(func(key, value any) bool {
+		registrations = append(registrations, value.(*backendRegistration))
+		return true
+	})
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].url < registrations[j].url
+	})
+
+	idle, parked, errored := map[*backendRegistration]int{}, map[*backendRegistration]int{}, map[*backendRegistration]int{}
+	bp.idleConnMutex.Lock()
+	for e := bp.idleConnections.Front(); e != nil; e = e.Next() {
+		idle[e.Value.(*BackendConn).registration]++
+	}
+	for e := bp.parkedConnections.Front(); e != nil; e = e.Next() {
+		parked[e.Value.(*BackendConn).registration]++
+	}
+	capacities, weights := make([]int, len(registrations)), make([]int, len(registrations))
+	for i, registration := range registrations {
+		capacities[i], weights[i] = registration.capacity, registration.weight
+	}
+	bp.idleConnMutex.Unlock()
+	bp.erroredConnMutex.Lock()
+	for e := bp.erroredConnections.Front(); e != nil; e = e.Next() {
+		errored[e.Value.(*BackendConn).registration]++
+	}
+	bp.erroredConnMutex.Unlock()
+
+	now := time.Now()
+	breakerConfig := bp.currentSettings().circuitBreakerConfig
+	backends := make([]BackendInfo, 0, len(registrations))
+	for i, registration := range registrations {
+		backends = append(backends, BackendInfo{
+			Url:            registration.url,
+			Capacity:       capacities[i],
+			Weight:         weights[i],
+			InUse:          registration.inUseCount(),
+			Idle:           idle[registration],
+			Errored:        errored[registration],
+			Parked:         parked[registration],
+			Draining:       registration.isDraining(),
+			Healthy:        registration.health.isHealthy(),
+			Circuit:        registration.breaker.currentState(),
+			ErrorsInWindow: registration.breaker.errorsWithin(now, breakerConfig),
+		})
+	}
+	return backends
+}
+
+// AdminHandler Serves JSON endpoints for inspecting and operating the pipes and backends of a running proxy. Paths are
+// relative to where it is mounted, use http.StripPrefix to serve it under a prefix:
+//
+//	GET    /pipes                        lists the pipes
+//	GET    /pipes/{clientId}             shows the pipe of the client
+//	DELETE /pipes/{clientId}             force-closes the pipe of the client
+//	POST   /pipes/{clientId}/migrate     force-migrates the pipe, to the backend url given by the backend query parameter if any,
+//	                                     with graceful=true the pipe is migrated through MigratePipe instead
+//	GET    /backends                     lists the backend urls
+//	POST   /backends?url=&capacity=&weight=  adds a backend url, capacity and weight are optional
+//	DELETE /backends?url=                removes a backend url right away
+//	POST   /backends/drain?url=          drains a backend url
+//	POST   /backends/migrate?url=        drains a backend url and migrates its pipes, see MigrateAllFrom
+//
+// Actions respond with 204 on success, apart from /backends/migrate which responds {"migrated": n}. Errors are
+// responded as {"error": "..."}. The handler does no authentication
+// of its own and is meant to be served on an internal address only
+type AdminHandler struct {
+	pipeManager *WebsocketPipeManager
+	pool        *BackendWSConnPool
+	logger      logger
+}
+
+// NewAdminHandler Creates an admin handler for the pipe manager and the backend pool it was created with
+func NewAdminHandler(pipeManager *WebsocketPipeManager, pool *BackendWSConnPool, logger logger) *AdminHandler {
+	return &AdminHandler{pipeManager: pipeManager, pool: pool, logger: logger}
+}
+
+// AdminHandler Creates an admin handler for the pipes and backends of the proxy, see AdminHandler
+func (h *InterruptibleWebsocketProxyHandler) AdminHandler() *AdminHandler {
+	return NewAdminHandler(h.WebsocketPipeManager, h.pool, h.logger)
+}
+
+type pipeView struct {
+	ClientID               string    `json:"client_id"`
+	PipeID                 string    `json:"pipe_id"`
+	BackendUrl             string    `json:"backend_url"`
+	BufferedToBackendBytes int       `json:"buffered_to_backend_bytes"`
+	BufferedToClientBytes  int       `json:"buffered_to_client_bytes"`
+	State                  string    `json:"state"`
+	CreatedAt              time.Time `json:"created_at"`
+	UptimeSeconds          float64   `json:"uptime_seconds"`
+}
+
+type backendView struct {
+	Url            string `json:"url"`
+	Capacity       int    `json:"capacity"`
+	Weight         int    `json:"weight"`
+	InUse          int    `json:"in_use"`
+	Idle           int    `json:"idle"`
+	Errored        int    `json:"errored"`
+	Parked         int    `json:"parked"`
+	Draining       bool   `json:"draining"`
+	Healthy        bool   `json:"healthy"`
+	Circuit        string `json:"circuit"`
+	ErrorsInWindow int    `json:"errors_in_window"`
+}
+
+func newPipeView(info PipeInfo) pipeView {
+	return pipeView{
+		ClientID:               info.ClientID.String(),
+		PipeID:                 info.PipeID.String(),
+		BackendUrl:             info.BackendUrl,
+		BufferedToBackendBytes: info.BufferedToBackendBytes,
+		BufferedToClientBytes:  info.BufferedToClientBytes,
+		State:                  info.State.String(),
+		CreatedAt:              info.CreatedAt,
+		UptimeSeconds:          info.Uptime.Seconds(),
+	}
+}
+
+func newBackendView(info BackendInfo) backendView {
+	return backendView{
+		Url:            info.Url,
+		Capacity:       info.Capacity,
+		Weight:         info.Weight,
+		InUse:          info.InUse,
+		Idle:           info.Idle,
+		Errored:        info.Errored,
+		Parked:         info.Parked,
+		Draining:       info.Draining,
+		Healthy:        info.Healthy,
+		Circuit:        info.Circuit.String(),
+		ErrorsInWindow: info.ErrorsInWindow,
+	}
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "pipes":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{http.MethodGet: ah.listPipes})
+	case strings.HasPrefix(path, "pipes/"):
+		ah.servePipe(w, r, strings.TrimPrefix(path, "pipes/"))
+	case path == "backends":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:    ah.listBackends,
+			http.MethodPost:   ah.addBackend,
+			http.MethodDelete: ah.removeBackend,
+		})
+	case path == "backends/drain":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{http.MethodPost: ah.drainBackend})
+	case path == "backends/migrate":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{http.MethodPost: ah.migrateFromBackend})
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no such admin endpoint: %s", r.URL.Path))
+	}
+}
+
+// servePipe Serves the endpoints of a single pipe, rest is the path following pipes/
+func (ah *AdminHandler) servePipe(w http.ResponseWriter, r *http.Request, rest string) {
+	clientIdString, action, _ := strings.Cut(rest, "/")
+	clientId, err := uuid.Parse(clientIdString)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid client id: %s", clientIdString))
+		return
+	}
+	switch action {
+	case "":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+				info, ok := ah.pipeManager.Pipe(clientId)
+				if !ok {
+					writeAdminError(w, http.StatusNotFound, ErrPipeNotFound)
+					return
+				}
+				writeAdminJSON(w, newPipeView(info))
+			},
+			http.MethodDelete: func(w http.ResponseWriter, r *http.Request) {
+				ah.respondAction(w, ah.pipeManager.ClosePipe(clientId))
+			},
+		})
+	case "migrate":
+		ah.serveMethod(w, r, map[string]http.HandlerFunc{
+			http.MethodPost: func(w http.ResponseWriter, r *http.Request) {
+				targetUrl := r.URL.Query().Get("backend")
+				if registration, ok := ah.pool.loadRegistration(targetUrl); targetUrl != "" && (!ok || !ah.pool.isActive(registration)) {
+					writeAdminError(w, http.StatusBadRequest, fmt.Errorf("backend url: %s is not registered", targetUrl))
+					return
+				}
+				if graceful, _ := strconv.ParseBool(r.URL.Query().Get("graceful")); graceful {
+					ah.respondAction(w, ah.pipeManager.MigratePipe(clientId, targetUrl))
+					return
+				}
+				ah.respondAction(w, ah.pipeManager.ForceMigratePipe(clientId, targetUrl))
+			},
+		})
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no such admin endpoint: %s", r.URL.Path))
+	}
+}
+
+func (ah *AdminHandler) listPipes(w http.ResponseWriter, _ *http.Request) {
+	views := []pipeView{}
+	for _, info := range ah.pipeManager.Pipes() {
+		views = append(views, newPipeView(info))
+	}
+	writeAdminJSON(w, views)
+}
+
+func (ah *AdminHandler) listBackends(w http.ResponseWriter, _ *http.Request) {
+	views := []backendView{}
+	for _, info := range ah.pool.Backends() {
+		views = append(views, newBackendView(info))
+	}
+	writeAdminJSON(w, views)
+}
+
+func (ah *AdminHandler) addBackend(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("url query parameter is required"))
+		return
+	}
+	var options BackendOptions
+	for name, option := range map[string]*int{"capacity": &options.Capacity, "weight": &options.Weight} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %s", name, value))
+			return
+		}
+		*option = parsed
+	}
+	if _, err := options.withDefaults(url); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := ah.pool.addReplacingDrain(url, options); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	ah.logger.Debug(fmt.Sprintf("admin added backend url: %s", url))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *AdminHandler) removeBackend(w http.ResponseWriter, r *http.Request) {
+	ah.actOnBackend(w, r, ah.pool.RemoveFromPool)
+}
+
+func (ah *AdminHandler) drainBackend(w http.ResponseWriter, r *http.Request) {
+	ah.actOnBackend(w, r, ah.pool.Drain)
+}
+
+// migrateFromBackend Responds the number of pipes migrated, along with the error for the ones which could not be
+func (ah *AdminHandler) migrateFromBackend(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if _, ok := ah.pool.loadRegistration(url); !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("backend url: %s is not registered", url))
+		return
+	}
+	migrated, err := ah.pipeManager.MigrateAllFrom(url)
+	response := map[string]any{"migrated": migrated}
+	status := http.StatusOK
+	if err != nil {
+		response["error"] = err.Error()
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// actOnBackend Applies the action to the registered backend url given by the url query parameter
+func (ah *AdminHandler) actOnBackend(w http.ResponseWriter, r *http.Request, action func(url string) error) {
+	url := r.URL.Query().Get("url")
+	if _, ok := ah.pool.loadRegistration(url); !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("backend url: %s is not registered", url))
+		return
+	}
+	if err := action(url); err != nil {
+		writeAdminError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondAction Responds the outcome of an action on a pipe
+func (ah *AdminHandler) respondAction(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrPipeNotFound):
+		writeAdminError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeAdminError(w, http.StatusConflict, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveMethod Serves the request with the handler of its method, 405 for any other method
+func (ah *AdminHandler) serveMethod(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	handler, ok := handlers[r.Method]
+	if !ok {
+		methods := make([]string, 0, len(handlers))
+		for method := range handlers {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	handler(w, r)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,170 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serveAdmin Serves the request on the admin handler, decodes the JSON response into v when given
+func serveAdmin(t *testing.T, handler http.Handler, method, target string, v any) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		assert.Nil(t, json.NewDecoder(recorder.Body).Decode(v))
+	}
+	return recorder.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	tl := &testLogger{}
+	newHandler := func() *InterruptibleWebsocketProxyHandler {
+		return NewInterruptibleWebsocketProxyHandler(websocket.Config{}, HandlerConfig{
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+		}, tl)
+	}
+
+	t.Run("ShouldListPipesAndBackends", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		handler := newHandler()
+		defer handler.Shutdown(context.Background())
+		admin := handler.AdminHandler()
+		assert.Nil(t, handler.AddConnectionToPoolWithCapacity(expUrl, 2))
+		clientId := uuid.New()
+		_, _ = startTestPipe(handler.WebsocketPipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return handler.pool.InUseCount(expUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		var pipes []map[string]any
+		assert.Equal(t, http.StatusOK, serveAdmin(t, admin, http.MethodGet, "/pipes", &pipes))
+		assert.Len(t, pipes, 1)
+		assert.Equal(t, clientId.String(), pipes[0]["client_id"])
+		assert.Equal(t, expUrl, pipes[0]["backend_url"])
+		assert.Equal(t, "streaming", pipes[0]["state"])
+
+		var pipe map[string]any
+		assert.Equal(t, http.StatusOK, serveAdmin(t, admin, http.MethodGet, "/pipes/"+clientId.String(), &pipe))
+		assert.Equal(t, pipes[0]["pipe_id"], pipe["pipe_id"])
+		assert.Equal(t, http.StatusNotFound, serveAdmin(t, admin, http.MethodGet, "/pipes/"+uuid.NewString(), nil))
+
+		var backends []map[string]any
+		assert.Equal(t, http.StatusOK, serveAdmin(t, admin, http.MethodGet, "/backends", &backends))
+		assert.Len(t, backends, 1)
+		assert.Equal(t, expUrl, backends[0]["url"])
+		assert.Equal(t, float64(2), backends[0]["capacity"])
+		assert.Equal(t, float64(1), backends[0]["in_use"])
+		assert.Equal(t, "closed", backends[0]["circuit"])
+	})
+
+	t.Run("ShouldAddDrainAndRemoveBackends", func(t *testing.T) {
+		handler := newHandler()
+		defer handler.Shutdown(context.Background())
+		admin := handler.AdminHandler()
+		query := url.Values{"url": {"ws://localhost:8081"}, "capacity": {"3"}}.Encode()
+
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodPost, "/backends?"+query, nil))
+		assert.Equal(t, http.StatusConflict, serveAdmin(t, admin, http.MethodPost, "/backends?"+query, nil))
+		backends := handler.pool.Backends()
+		assert.Len(t, backends, 1)
+		assert.Equal(t, 3, backends[0].Capacity)
+
+		// Nothing in use, the drain completes right away
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodPost, "/backends/drain?"+query, nil))
+		assert.Empty(t, handler.pool.Backends())
+		assert.Equal(t, http.StatusNotFound, serveAdmin(t, admin, http.MethodDelete, "/backends?"+query, nil))
+
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodPost, "/backends?"+query, nil))
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodDelete, "/backends?"+query, nil))
+		assert.Empty(t, handler.pool.Backends())
+
+		assert.Equal(t, http.StatusBadRequest, serveAdmin(t, admin, http.MethodPost, "/backends?url=ws://localhost:8081&capacity=-1", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, serveAdmin(t, admin, http.MethodPut, "/backends", nil))
+	})
+
+	t.Run("ShouldForceClosePipe", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		handler := newHandler()
+		defer handler.Shutdown(context.Background())
+		admin := handler.AdminHandler()
+		assert.Nil(t, handler.AddConnectionToPool(expUrl))
+		clientId := uuid.New()
+		_, pipeErr := startTestPipe(handler.WebsocketPipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return handler.pool.InUseCount(expUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodDelete, "/pipes/"+clientId.String(), nil))
+		assert.ErrorIs(t, <-pipeErr, ErrPipeClosed)
+		assert.Equal(t, 0, handler.pool.InUseCount(expUrl))
+		assert.Equal(t, http.StatusNotFound, serveAdmin(t, admin, http.MethodDelete, "/pipes/"+clientId.String(), nil))
+	})
+
+	t.Run("ShouldForceMigratePipeToTargetBackend", func(t *testing.T) {
+		firstUrl, secondUrl := newTestEchoBackend(t, 0), newTestEchoBackend(t, 0)
+		handler := newHandler()
+		defer handler.Shutdown(context.Background())
+		admin := handler.AdminHandler()
+		assert.Nil(t, handler.AddConnectionToPool(firstUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(handler.pool) == 1
+		}, time.Second*10, time.Millisecond*50)
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(handler.WebsocketPipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return handler.pool.InUseCount(firstUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+		assert.Nil(t, handler.AddConnectionToPool(secondUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(handler.pool) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		target := "/pipes/" + clientId.String() + "/migrate?" + url.Values{"backend": {secondUrl}}.Encode()
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodPost, target, nil))
+		assert.Eventually(t, func() bool {
+			info, ok := handler.Pipe(clientId)
+			return ok && info.State == PipeStreaming && info.BackendUrl == secondUrl
+		}, time.Second*10, time.Millisecond*50)
+		// Old backend is given back rather than marked errored
+		assert.Equal(t, 0, handler.pool.InUseCount(firstUrl))
+		for _, backend := range handler.pool.Backends() {
+			assert.Equal(t, 0, backend.ErrorsInWindow)
+		}
+
+		_, err := clientPeer.Write([]byte("after migration"))
+		assert.Nil(t, err)
+		buf := make([]byte, 64)
+		n, err := clientPeer.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "after migration", string(buf[:n]))
+
+		// Back to the first backend, gracefully this time
+		target = "/pipes/" + clientId.String() + "/migrate?" + url.Values{"backend": {firstUrl}, "graceful": {"true"}}.Encode()
+		assert.Equal(t, http.StatusNoContent, serveAdmin(t, admin, http.MethodPost, target, nil))
+		assert.Equal(t, 1, handler.pool.InUseCount(firstUrl))
+		_, err = clientPeer.Write([]byte("after graceful migration"))
+		assert.Nil(t, err)
+		n, err = clientPeer.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "after graceful migration", string(buf[:n]))
+
+		var response map[string]any
+		assert.Equal(t, http.StatusOK, serveAdmin(t, admin, http.MethodPost, "/backends/migrate?url="+firstUrl, &response))
+		assert.Equal(t, float64(1), response["migrated"])
+		assert.Equal(t, 1, handler.pool.InUseCount(secondUrl))
+
+		unknown := "/pipes/" + clientId.String() + "/migrate?backend=ws://localhost:1"
+		assert.Equal(t, http.StatusBadRequest, serveAdmin(t, admin, http.MethodPost, unknown, nil))
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+}
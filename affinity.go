@@ -0,0 +1,149 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// affinityEntry Backend url last used by a client, forgotten once expiresAt has passed
+type affinityEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+// backendAffinity Remembers the backend url each client last used, for a TTL counted from the last time the client
+// was on it. Expired entries are swept at most once per TTL when entries are added
+type backendAffinity struct {
+	// ttl is a time.Duration, accessed atomically so that it can be changed while in use
+	ttl       int64
+	entries   sync.Map
+	sweepMut  sync.Mutex
+	lastSweep time.Time
+}
+
+func newBackendAffinity(ttl time.Duration) *backendAffinity {
+	return &backendAffinity{ttl: int64(ttl), lastSweep: time.Now()}
+}
+
+// remember Records the url as the backend of the client
+func (ba *backendAffinity) remember(clientId uuid.UUID, url string) {
+	now := time.Now()
+	ttl := time.Duration(atomic.LoadInt64(&ba.ttl))
+	ba.entries.Store(clientId, affinityEntry{url: url, expiresAt: now.Add(ttl)})
+
+	ba.sweepMut.Lock()
+	defer ba.sweepMut.Unlock()
+	if now.Sub(ba.lastSweep) < ttl {
+		return
+	}
+	ba.lastSweep = now
+	ba.entries.Range(func(key, value any) bool {
+		if now.After(value.(affinityEntry).expiresAt) {
+			ba.entries.Delete(key)
+		}
+		return true
+	})
+}
+
+// lookup Backend url the client last used, if it has not expired
+func (ba *backendAffinity) lookup(clientId uuid.UUID) (string, bool) {
+	value, ok := ba.entries.Load(clientId)
+	if !ok {
+		return "", false
+	}
+	entry := value.(affinityEntry)
+	if time.Now().After(entry.expiresAt) {
+		ba.entries.Delete(clientId)
+		return "", false
+	}
+	return entry.url, true
+}
+
+// SetBackendAffinityTTL Remembers the backend url of every client for the given TTL after it last used it, a client
+// creating a pipe again with the same client ID within the TTL is handed the same backend when it is below its capacity
+// and healthy, and goes through the usual selection otherwise. Zero, the default, leaves affinity off and forgets the
+// remembered backends. Changing the TTL keeps them, the new TTL applies from the next time a backend is remembered
+func (pm *WebsocketPipeManager) SetBackendAffinityTTL(ttl time.Duration) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	switch {
+	case ttl <= 0:
+		pm.affinity = nil
+	case pm.affinity != nil:
+		atomic.StoreInt64(&pm.affinity.ttl, int64(ttl))
+	default:
+		pm.affinity = newBackendAffinity(ttl)
+	}
+}
+
+// BackendAffinity Backend url the client is sticky to, if affinity is on and the client used a backend within the TTL
+func (pm *WebsocketPipeManager) BackendAffinity(clientId uuid.UUID) (string, bool) {
+	affinity := pm.currentAffinity()
+	if affinity == nil {
+		return "", false
+	}
+	return affinity.lookup(clientId)
+}
+
+// rememberBackend Records the backend of the client when affinity is on
+func (pm *WebsocketPipeManager) rememberBackend(clientId uuid.UUID, conn *BackendConn) {
+	if affinity := pm.currentAffinity(); affinity != nil {
+		affinity.remember(clientId, conn.connUrl)
+	}
+}
+
+func (pm *WebsocketPipeManager) currentAffinity() *backendAffinity {
+	pm.settingsMut.RLock()
+	defer pm.settingsMut.RUnlock()
+	return pm.affinity
+}
+
+// withAffinity Adds the backend the client is sticky to, if any, to the context for obtaining a backend
+func (pm *WebsocketPipeManager) withAffinity(ctx context.Context, clientId uuid.UUID) context.Context {
+	if url, ok := pm.BackendAffinity(clientId); ok {
+		return WithPreferredBackend(ctx, url)
+	}
+	return ctx
+}
+
+type preferredBackendKey struct{}
+
+// WithPreferredBackend Asks GetConn to hand out the backend url when it is below its capacity, before applying the
+// balancer strategy
+func WithPreferredBackend(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, preferredBackendKey{}, url)
+}
+
+// PreferredBackendFromContext Backend url preferred for the connection being obtained, if any
+func PreferredBackendFromContext(ctx context.Context) (string, bool) {
+	url, ok := ctx.Value(preferredBackendKey{}).(string)
+	return url, ok && url != ""
+}
+
+// takePreferredIdleEntry Takes the oldest idle entry of the url off the idle list, as long as the url is still
+// registered and not draining. Unhealthy backends are never on the idle list. Without an idle entry one of the entries
+// of the url not yet made idle is taken instead. To be called with idleConnMutex held
+func (bp *BackendWSConnPool) takePreferredIdleEntry(url string) *BackendConn {
+	registration, ok := bp.loadRegistration(url)
+	if !ok || !bp.isActive(registration) {
+		return nil
+	}
+	for e := bp.idleConnections.Front(); e != nil; e = e.Next() {
+		if backendConn := e.Value.(*BackendConn); backendConn.registration == registration {
+			bp.idleConnections.Remove(e)
+			bp.logger.Debug(fmt.Sprintf("handing out preferred backend url: %s", url))
+			return backendConn
+		}
+	}
+	bp.availableUrlMutex.Lock()
+	defer bp.availableUrlMutex.Unlock()
+	if backendConn := bp.takeAvailableEntry(registration); backendConn != nil {
+		bp.logger.Debug(fmt.Sprintf("handing out preferred backend url: %s", url))
+		return backendConn
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// idleLen Number of entries on the idle list of the pool
+func idleLen(pool *BackendWSConnPool) int {
+	pool.idleConnMutex.Lock()
+	defer pool.idleConnMutex.Unlock()
+	return pool.idleConnections.Len()
+}
+
+// startTestPipe Creates a pipe for the client in the background, returns the peer of the client connection and the
+// channel receiving the result of CreatePipe
+func startTestPipe(pipeManager *WebsocketPipeManager, clientId uuid.UUID) (net.Conn, chan error) {
+	clientConn, clientPeer := net.Pipe()
+	pipeErr := make(chan error, 1)
+	go func() {
+		pipeErr <- pipeManager.CreatePipe(clientId, clientConn)
+	}()
+	return clientPeer, pipeErr
+}
+
+func TestBackendWSConnPool_GetConnWithPreferredBackend(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldHandOutPreferredBackendWhenIdleAndFallBackOtherwise", func(t *testing.T) {
+		firstUrl, secondUrl := newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.Nil(t, pool.AddToPool(firstUrl))
+		assert.Nil(t, pool.AddToPool(secondUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 2
+		}, time.Second*10, time.Millisecond*50)
+
+		ctx := WithPreferredBackend(context.Background(), secondUrl)
+		conn, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, secondUrl, conn.connUrl)
+		// Preferred backend is at capacity
+		conn, err = pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, firstUrl, conn.connUrl)
+	})
+
+	t.Run("ShouldHandOutPreferredBackendWithoutIdleEntry", func(t *testing.T) {
+		firstUrl, secondUrl := newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5)
+		pool := NewBackendConnPool(0, 100, tl)
+		defer pool.Close(context.Background())
+		assert.Nil(t, pool.AddToPoolWithCapacity(firstUrl, 3))
+		assert.Nil(t, pool.AddToPoolWithCapacity(secondUrl, 3))
+
+		// At most one entry is idle at a time, the preferred backend is taken from the entries not yet made idle
+		ctx := WithPreferredBackend(context.Background(), secondUrl)
+		for i := 0; i < 3; i++ {
+			conn, err := pool.GetConn(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, secondUrl, conn.connUrl)
+		}
+	})
+}
+
+func TestWebsocketPipeManager_SetBackendAffinityTTL(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldHandReconnectingClientItsPreviousBackend", func(t *testing.T) {
+		urls := []string{newTestBackend(t, time.Minute), newTestBackend(t, time.Minute), newTestBackend(t, time.Minute)}
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetBackendAffinityTTL(time.Minute)
+		for _, url := range urls {
+			assert.Nil(t, pipeManager.AddConnectionToPool(url))
+		}
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 3
+		}, time.Second*10, time.Millisecond*50)
+
+		clientId := uuid.New()
+		for i := 0; i < 3; i++ {
+			clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+			var used string
+			assert.Eventually(t, func() bool {
+				used, _ = pipeManager.BackendAffinity(clientId)
+				return used != "" && pool.InUseCount(used) == 1
+			}, time.Second*10, time.Millisecond*50)
+			if i > 0 {
+				assert.Equal(t, urls[0], used)
+			}
+			urls[0] = used
+			clientPeer.Close()
+			assert.Nil(t, <-pipeErr)
+			assert.Eventually(t, func() bool {
+				// Released entry is redialed from the back of the idle list
+				return idleLen(pool) == 3
+			}, time.Second*10, time.Millisecond*50)
+		}
+	})
+
+	t.Run("ShouldForgetBackendOnceTTLExpires", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetBackendAffinityTTL(time.Millisecond * 200)
+		assert.Nil(t, pipeManager.AddConnectionToPool(expUrl))
+
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return pool.InUseCount(expUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+
+		url, ok := pipeManager.BackendAffinity(clientId)
+		assert.True(t, ok)
+		assert.Equal(t, expUrl, url)
+		time.Sleep(time.Millisecond * 300)
+		_, ok = pipeManager.BackendAffinity(clientId)
+		assert.False(t, ok)
+	})
+
+	t.Run("ShouldBeOffByDefault", func(t *testing.T) {
+		pipeManager := NewWebsocketPipeManager(NewBackendConnPool(5, 100, tl), 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		_, ok := pipeManager.BackendAffinity(uuid.New())
+		assert.False(t, ok)
+	})
+}
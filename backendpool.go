@@ -2,16 +2,18 @@ package interruptible_websocket_proxy
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/net/websocket"
 	"math"
 	"net"
-	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrorInfo Errors of the backend as of the last error, errorCount only counts the errors within the error window
 type ErrorInfo struct {
 	lastCheckedTime *time.Time
 	errorCount      int64
@@ -19,33 +21,105 @@ type ErrorInfo struct {
 
 type BackendConn struct {
 	net.Conn
-	connUrl string
+	connUrl      string
+	registration *backendRegistration
+	// dialedAt and lastPingAt are tracked for warm connections, see EnableWarmConnections
+	dialedAt   time.Time
+	lastPingAt time.Time
+	// dialedWithHandshake is set when the socket was dialed with the handshake of a client, it carries the forwarded
+	// headers of that client and is never handed to another client
+	dialedWithHandshake bool
 	ErrorInfo
 }
 
+// backendRegistration Book keeping for a registered backend url. A BackendConn belongs to the pool only as long as
+// its registration is the one currently stored against its url, which lets stale entries be discarded lazily
+type backendRegistration struct {
+	url      string
+	draining int32
+	// capacity number of pipes the backend can serve at once, inUse number of its connections currently in use.
+	// capacity, weight and surplus are guarded by idleConnMutex once registered
+	capacity int
+	inUse    int64
+	weight   int
+	// surplus entries are left over from a lowered capacity, they are dropped instead of being made idle again
+	surplus int
+	health  healthState
+	breaker circuitBreaker
+}
+
+func (br *backendRegistration) isDraining() bool {
+	return atomic.LoadInt32(&br.draining) == 1
+}
+
+func (br *backendRegistration) inUseCount() int {
+	return int(atomic.LoadInt64(&br.inUse))
+}
+
+// ReleasePolicy Decides what happens to a backend connection handed back to the pool once its client is gone
+type ReleasePolicy int
+
+const (
+	// ReleaseRedial Closes the backend socket, the url is dialed afresh for the next client
+	ReleaseRedial ReleasePolicy = iota
+	// ReleaseReuse Keeps the backend socket open and hands it over to the next client as is, only suitable for
+	// backends which do not keep any per client state on a connection. A socket dialed with the handshake of a client
+	// is closed all the same, as it carries the forwarded headers of that client. The handler forwards the handshake
+	// on every dial and does not accept it, it applies to pipes created without a handshake only
+	ReleaseReuse
+)
+
+// ErrPoolClosed Returned once the pool is closed
+var ErrPoolClosed = errors.New("backend connection pool is closed")
+
+// ErrNoBackendAvailable Returned by GetConn when no backend connection could be obtained within the allowed wait
+var ErrNoBackendAvailable = errors.New("no backend connection available")
+
 // TODO: Can modify implementation to use channels
 
 // BackendWSConnPool This should give a new connection for client connection request
 // Should keep track of available backends at any point of time
 // In a way it feels like it is doing the job of load balancer,
-// but this additionally has to ensure there is at most one client connection per backend/pod
+// but this additionally has to ensure a backend/pod never serves more client connections than its capacity,
+// which is one unless registered with AddToPoolWithCapacity
 type BackendWSConnPool struct {
 	// When new backend is available, it's url is added to the list here
 	availableBackendUrls *list.List
+	availableUrlMutex    sync.Mutex
 
-	// Required to de-duplicate backendUrls
+	// Required to de-duplicate backendUrls, holds *backendRegistration against each url
 	registeredBackendUrls sync.Map
 
-	// When a new backend connection is created, a reference is maintained here
+	// When a new backend connection is created, a reference is maintained here against the *BackendConn itself
 	inUseMap sync.Map
 	// When a client closes its connection with/without an error
-	idleConnections      *list.List
-	idleConnCount        *int64
-	idleConnMutex        sync.Mutex
-	erroredConnections   *list.List
+	idleConnections    *list.List
+	idleConnCount      *int64
+	idleConnMutex      sync.Mutex
+	erroredConnections *list.List
+	erroredConnMutex   sync.Mutex
+	settings           poolSettings
+	settingsMut        sync.RWMutex
+	metrics            *Metrics
+	logger             logger
+	// closed is closed by Close to stop the background loops, loopsWg tracks them
+	closed    chan struct{}
+	closeOnce sync.Once
+	loopsWg   sync.WaitGroup
+	// Entries of backends found unhealthy by the health checker are parked here till they recover, guarded by idleConnMutex
+	parkedConnections *list.List
+}
+
+// poolSettings Settings of the pool which can be changed while it is running, guarded by settingsMut
+type poolSettings struct {
 	maxIdleConnections   int64
 	maxAllowedErrorCount int64
-	logger               logger
+	// circuitBreakerConfig as set, currentSettings applies the defaults
+	circuitBreakerConfig CircuitBreakerConfig
+	releasePolicy        ReleasePolicy
+	maxGetConnWait       time.Duration
+	dialer               BackendDialer
+	balancer             BalancerStrategy
 }
 
 func NewBackendConnPool(maxIdleConnCount, maxAllowedErrorCountPerConn int64, logger logger) *BackendWSConnPool {
@@ -58,11 +132,16 @@ func NewBackendConnPool(maxIdleConnCount, maxAllowedErrorCountPerConn int64, log
 		registeredBackendUrls: sync.Map{},
 		inUseMap:              sync.Map{},
 		idleConnections:       idleConnList,
+		parkedConnections:     list.New(),
 		erroredConnections:    erroredUrlList,
 		idleConnCount:         &idleConnCount,
-		maxIdleConnections:    maxIdleConnCount,
-		maxAllowedErrorCount:  maxAllowedErrorCountPerConn,
 		logger:                logger,
+		closed:                make(chan struct{}),
+		settings: poolSettings{
+			maxIdleConnections:   maxIdleConnCount,
+			maxAllowedErrorCount: maxAllowedErrorCountPerConn,
+			dialer:               NewWebsocketDialer(websocket.Config{}, 0),
+		},
 	}
 	pool.startIdleConnectionFiller()
 	pool.erroredConnectionRefresher()
@@ -71,123 +150,700 @@ func NewBackendConnPool(maxIdleConnCount, maxAllowedErrorCountPerConn int64, log
 
 // GetConn as soon as this is called, the connection will be immediately marked for use,
 // defer calling this till the moment you need it
-func (bp *BackendWSConnPool) GetConn() *BackendConn {
+// Waits for a connection till the context is done or the max wait of the pool has elapsed, after which an error
+// wrapping ErrNoBackendAvailable is returned. Returns ErrPoolClosed once the pool is closed
+func (bp *BackendWSConnPool) GetConn(ctx context.Context) (*BackendConn, error) {
+	startedAt := time.Now()
+	if maxWait := bp.currentSettings().maxGetConnWait; maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
 	i := 0
 	for {
-		conn := bp.tryAndFetchConnectionFromIdleList()
+		if bp.isClosed() {
+			return nil, ErrPoolClosed
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoBackendAvailable, ctx.Err())
+		}
+		conn := bp.tryAndFetchConnectionFromIdleList(ctx)
 		if conn == nil {
 			bp.logger.Debug("no idle connection is available, waiting for one to be available")
-			backOffWait(&i, 5)
+			backOffWait(ctx, &i, 5, bp.closed)
 			continue
 		}
+		// No longer idle, whether it is handed out or errors out
+		atomic.AddInt64(bp.idleConnCount, -1)
+		if _, ok := ClientHandshakeFromContext(ctx); ok && conn.Conn != nil && !conn.dialedWithHandshake {
+			// Dialed ahead of the client, the backend is to see the handshake of the client
+			closeBackendConn(conn)
+		}
 		if conn.Conn == nil {
-			netConn, err := newConn(conn.connUrl)
+			netConn, err := bp.currentSettings().dialer.Dial(ctx, conn.connUrl)
 			if err != nil {
+				if ctx.Err() != nil {
+					// Caller gave up on the dial, not held against the backend
+					bp.Release(conn)
+					continue
+				}
 				bp.MarkError(conn)
 				bp.logger.Error("obtained new connection but errored out while dialing", err)
 				continue
 			}
 			conn.Conn = netConn
+			conn.dialedAt, conn.lastPingAt = time.Now(), time.Now()
+			_, conn.dialedWithHandshake = ClientHandshakeFromContext(ctx)
+			conn.registration.breaker.recordSuccess()
 		}
-		atomic.AddInt64(bp.idleConnCount, -1)
-		bp.inUseMap.Store(conn.connUrl, conn)
-		return conn
+		bp.inUseMap.Store(conn, conn)
+		atomic.AddInt64(&conn.registration.inUse, 1)
+		bp.metrics.observeGetConnWait(startedAt)
+		return conn, nil
 	}
 }
 
-func backOffWait(i *int, maxBackOffExponent int) {
+// backOffWait waits exponentially longer on every call, returns early when the context is done or stop is closed
+func backOffWait(ctx context.Context, i *int, maxBackOffExponent int, stop chan struct{}) {
 	if *i >= maxBackOffExponent {
 		*i = maxBackOffExponent
 	}
 	backOffSeconds := math.Pow(2, float64(*i))
-	time.Sleep(time.Second * time.Duration(backOffSeconds))
+	timer := time.NewTimer(time.Second * time.Duration(backOffSeconds))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-stop:
+	}
 	*i += 1
 }
 
+// sleepUnlessClosed sleeps for the duration, returns false right away if stop is closed meanwhile
+func sleepUnlessClosed(duration time.Duration, stop chan struct{}) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Close Stops the background loops of the pool and closes every backend connection it knows of, including the ones
+// still in use. Meant to be called after the pipes are done with their backends, see WebsocketPipeManager.Shutdown.
+// Returns the context error if the background loops do not exit before the context is done
+func (bp *BackendWSConnPool) Close(ctx context.Context) error {
+	bp.closeOnce.Do(func() {
+		close(bp.closed)
+	})
+	loopsDone := make(chan struct{})
+	go func() {
+		bp.loopsWg.Wait()
+		close(loopsDone)
+	}()
+	var err error
+	select {
+	case <-loopsDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	bp.idleConnMutex.Lock()
+	for e := bp.idleConnections.Front(); e != nil; e = e.Next() {
+		closeBackendConn(e.Value.(*BackendConn))
+	}
+	bp.idleConnections.Init()
+	bp.parkedConnections.Init()
+	atomic.StoreInt64(bp.idleConnCount, 0)
+	bp.idleConnMutex.Unlock()
+
+	bp.inUseMap.Range(func(key, value any) bool {
+		bp.markNotInUse(value.(*BackendConn))
+		closeBackendConn(value.(*BackendConn))
+		return true
+	})
+	bp.logger.Debug("closed backend connection pool")
+	return err
+}
+
+func (bp *BackendWSConnPool) isClosed() bool {
+	return isStopped(bp.closed)
+}
+
+// closeBackendConn Closes the socket of the connection, a websocket close frame is sent to the backend
+func closeBackendConn(conn *BackendConn) {
+	if conn.Conn != nil {
+		conn.Conn.Close()
+		conn.Conn = nil
+	}
+}
+
 func (bp *BackendWSConnPool) AddToPool(url string) error {
-	if _, ok := bp.registeredBackendUrls.Load(url); ok {
+	return bp.AddToPoolWithCapacity(url, 1)
+}
+
+// AddToPoolWithCapacity Registers a backend url which can serve up to capacity pipes at once, each pipe gets its own
+// connection to the backend
+func (bp *BackendWSConnPool) AddToPoolWithCapacity(url string, capacity int) error {
+	if capacity < 1 {
+		return fmt.Errorf("invalid capacity %d for backend url: %s", capacity, url)
+	}
+	return bp.AddToPoolWithOptions(url, BackendOptions{Capacity: capacity})
+}
+
+// AddToPoolWithOptions Registers a backend url with the given capacity and weight, unset options take their defaults
+func (bp *BackendWSConnPool) AddToPoolWithOptions(url string, options BackendOptions) error {
+	options, err := options.withDefaults(url)
+	if err != nil {
+		return err
+	}
+	capacity := options.Capacity
+	registration := &backendRegistration{url: url, capacity: capacity, weight: options.Weight}
+	if _, loaded := bp.registeredBackendUrls.LoadOrStore(url, registration); loaded {
 		return fmt.Errorf("backend url: %s already registered, retry later", url)
 	}
-	bp.availableBackendUrls.PushBack(url)
-	bp.registeredBackendUrls.Store(url, true)
-	bp.logger.Debug(fmt.Sprintf("added new connection to backend pool: %s", url))
+	bp.availableUrlMutex.Lock()
+	bp.pushAvailable(registration, capacity)
+	bp.availableUrlMutex.Unlock()
+	bp.logger.Debug(fmt.Sprintf("added new connection to backend pool: %s, capacity: %d", url, capacity))
 	return nil
 }
 
+// pushAvailable Adds count entries of the registration to the available urls. Entries are kept interleaved across
+// registrations, in the order the registrations were first added, so that the idle connections are filled round-robin
+// instead of a backend with a large capacity taking all of them. To be called with availableUrlMutex held
+func (bp *BackendWSConnPool) pushAvailable(registration *backendRegistration, count int) {
+	var order []*backendRegistration
+	counts := map[*backendRegistration]int{}
+	for e := bp.availableBackendUrls.Front(); e != nil; e = e.Next() {
+		entryRegistration := e.Value.(*backendRegistration)
+		if counts[entryRegistration] == 0 {
+			order = append(order, entryRegistration)
+		}
+		counts[entryRegistration]++
+	}
+	if counts[registration] == 0 {
+		order = append(order, registration)
+	}
+	counts[registration] += count
+	remaining := bp.availableBackendUrls.Len() + count
+	bp.availableBackendUrls.Init()
+	for remaining > 0 {
+		for _, entryRegistration := range order {
+			if counts[entryRegistration] > 0 {
+				bp.availableBackendUrls.PushBack(entryRegistration)
+				counts[entryRegistration]--
+				remaining--
+			}
+		}
+	}
+}
+
+// addReplacingDrain Adds the url to the pool, a registration of the url which is still draining is replaced with a
+// fresh one so the url can serve new pipes right away
+func (bp *BackendWSConnPool) addReplacingDrain(url string, options BackendOptions) error {
+	if registration, ok := bp.loadRegistration(url); ok && registration.isDraining() {
+		bp.deregister(registration)
+	}
+	return bp.AddToPoolWithOptions(url, options)
+}
+
+// UpdateBackendOptions Changes the capacity and weight of a registered backend url. A raised capacity can be handed
+// out right away, a lowered one takes idle entries out first and the entries in use once they are given back
+func (bp *BackendWSConnPool) UpdateBackendOptions(url string, options BackendOptions) error {
+	options, err := options.withDefaults(url)
+	if err != nil {
+		return err
+	}
+	registration, ok := bp.loadRegistration(url)
+	if !ok || registration.isDraining() {
+		return fmt.Errorf("backend url: %s is not registered", url)
+	}
+	bp.idleConnMutex.Lock()
+	defer bp.idleConnMutex.Unlock()
+	registration.weight = options.Weight
+	delta := options.Capacity - registration.capacity
+	registration.capacity = options.Capacity
+	for ; delta > 0 && registration.surplus > 0; delta-- {
+		registration.surplus--
+	}
+	bp.availableUrlMutex.Lock()
+	if delta > 0 {
+		bp.pushAvailable(registration, delta)
+		delta = 0
+	}
+	for e := bp.availableBackendUrls.Front(); e != nil && delta < 0; {
+		next := e.Next()
+		if e.Value.(*backendRegistration) == registration {
+			bp.availableBackendUrls.Remove(e)
+			delta++
+		}
+		e = next
+	}
+	bp.availableUrlMutex.Unlock()
+	for e := bp.idleConnections.Front(); e != nil && delta < 0; {
+		next := e.Next()
+		if conn := e.Value.(*BackendConn); conn.registration == registration {
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			closeBackendConn(conn)
+			delta++
+		}
+		e = next
+	}
+	for e := bp.parkedConnections.Front(); e != nil && delta < 0; {
+		next := e.Next()
+		if e.Value.(*BackendConn).registration == registration {
+			bp.parkedConnections.Remove(e)
+			delta++
+		}
+		e = next
+	}
+	registration.surplus -= delta
+	bp.logger.Debug(fmt.Sprintf("updated backend url: %s, capacity: %d, weight: %d", url, options.Capacity, options.Weight))
+	return nil
+}
+
+// InUseCount Number of connections of the registered backend url currently in use by pipes
+func (bp *BackendWSConnPool) InUseCount(url string) int {
+	registration, ok := bp.loadRegistration(url)
+	if !ok {
+		return 0
+	}
+	return registration.inUseCount()
+}
+
+// RemoveFromPool De-registers the backend url right away. Idle entries of the url are discarded, a connection
+// currently in use stays with its pipe but is not handed out again once it is given back.
+// The same url can be added back again with AddToPool
+func (bp *BackendWSConnPool) RemoveFromPool(url string) error {
+	registration, ok := bp.loadRegistration(url)
+	if !ok {
+		return fmt.Errorf("backend url: %s is not registered", url)
+	}
+	bp.deregister(registration)
+	bp.discardIdleEntries(registration)
+	bp.logger.Debug(fmt.Sprintf("removed connection from backend pool: %s", url))
+	return nil
+}
+
+// Drain Stops handing out the backend url through GetConn, while a pipe already using it can carry on until it
+// finishes or moves to another backend. The url is de-registered once it is no longer in use
+func (bp *BackendWSConnPool) Drain(url string) error {
+	registration, ok := bp.loadRegistration(url)
+	if !ok {
+		return fmt.Errorf("backend url: %s is not registered", url)
+	}
+	if !atomic.CompareAndSwapInt32(&registration.draining, 0, 1) {
+		return fmt.Errorf("backend url: %s is already draining", url)
+	}
+	bp.discardIdleEntries(registration)
+	bp.logger.Debug(fmt.Sprintf("draining connection from backend pool: %s", url))
+	if registration.inUseCount() == 0 {
+		bp.completeDrain(registration)
+	}
+	return nil
+}
+
+// SetMetrics Exposes the state of the pool through the given metrics, to be called once right after creating the pool
+func (bp *BackendWSConnPool) SetMetrics(metrics *Metrics) {
+	bp.metrics = metrics
+	metrics.registerPool(bp)
+}
+
+// SetReleasePolicy Sets the policy applied to connections handed back through Release, defaults to ReleaseRedial
+func (bp *BackendWSConnPool) SetReleasePolicy(policy ReleasePolicy) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.releasePolicy = policy
+	})
+}
+
+// SetDialer Sets the dialer opening connections to backend urls, defaults to a WebsocketDialer with an empty config
+func (bp *BackendWSConnPool) SetDialer(dialer BackendDialer) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.dialer = dialer
+	})
+}
+
+// SetCircuitBreakerConfig Configures the circuit breaker of every backend. Unset fields take their defaults, the
+// error threshold defaults to the max allowed error count of the pool. A circuit already open keeps its cooldown
+func (bp *BackendWSConnPool) SetCircuitBreakerConfig(config CircuitBreakerConfig) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.circuitBreakerConfig = config
+	})
+}
+
+// SetBalancerStrategy Sets the strategy picking the backend GetConn hands out. Without one the backend idle the
+// longest is handed out first
+func (bp *BackendWSConnPool) SetBalancerStrategy(strategy BalancerStrategy) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.balancer = strategy
+	})
+}
+
+// SetMaxGetConnWait Bounds how long GetConn waits for a connection, zero (the default) waits as long as the context allows
+func (bp *BackendWSConnPool) SetMaxGetConnWait(maxWait time.Duration) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.maxGetConnWait = maxWait
+	})
+}
+
+// SetMaxIdleConnections Sets how many idle entries the pool fills up to, lowering it leaves the existing idle
+// entries in place
+func (bp *BackendWSConnPool) SetMaxIdleConnections(maxIdleConnCount int64) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.maxIdleConnections = maxIdleConnCount
+	})
+}
+
+// SetMaxAllowedErrorCount Sets the max allowed error count per connection, which is the error threshold of the
+// circuit breakers unless one is set through SetCircuitBreakerConfig
+func (bp *BackendWSConnPool) SetMaxAllowedErrorCount(maxAllowedErrorCountPerConn int64) {
+	bp.updateSettings(func(settings *poolSettings) {
+		settings.maxAllowedErrorCount = maxAllowedErrorCountPerConn
+	})
+}
+
+// currentSettings Copy of the settings with the defaults of the circuit breaker applied
+func (bp *BackendWSConnPool) currentSettings() poolSettings {
+	bp.settingsMut.RLock()
+	defer bp.settingsMut.RUnlock()
+	settings := bp.settings
+	settings.circuitBreakerConfig = settings.circuitBreakerConfig.withDefaults(settings.maxAllowedErrorCount)
+	return settings
+}
+
+func (bp *BackendWSConnPool) updateSettings(update func(settings *poolSettings)) {
+	bp.settingsMut.Lock()
+	defer bp.settingsMut.Unlock()
+	update(&bp.settings)
+}
+
+// Release Hands a connection back to the pool once its client is done with it, so that the url can serve another
+// client. Depending on the release policy the socket is either kept open for reuse or closed to be redialed later, a
+// socket dialed with the handshake of a client is always closed
+func (bp *BackendWSConnPool) Release(conn *BackendConn) {
+	bp.markNotInUse(conn)
+	if bp.isClosed() {
+		closeBackendConn(conn)
+		return
+	}
+	if !bp.isActive(conn.registration) {
+		bp.discardConn(conn)
+		return
+	}
+	if conn.Conn != nil && (conn.dialedWithHandshake || bp.currentSettings().releasePolicy != ReleaseReuse) {
+		conn.Conn.Close()
+		conn.Conn = nil
+	}
+	bp.idleConnMutex.Lock()
+	if bp.pushIdle(conn) {
+		atomic.AddInt64(bp.idleConnCount, 1)
+	}
+	bp.idleConnMutex.Unlock()
+	bp.logger.Debug(fmt.Sprintf("released connection back into idle connection list: %s", conn.connUrl))
+}
+
 func (bp *BackendWSConnPool) MarkError(conn *BackendConn) {
-	bp.inUseMap.Delete(conn.connUrl)
+	bp.markNotInUse(conn)
+	if bp.isClosed() {
+		closeBackendConn(conn)
+		return
+	}
+	if !bp.isActive(conn.registration) {
+		bp.discardConn(conn)
+		return
+	}
 	now := time.Now()
 	conn.lastCheckedTime = &now
-	conn.errorCount += 1
+	errorCount, state := conn.registration.breaker.recordFailure(now, bp.currentSettings().circuitBreakerConfig)
+	conn.errorCount = errorCount
+	if state == CircuitOpen {
+		bp.logger.Warn(fmt.Sprintf("circuit opened for backend url: %s, errors within window: %d", conn.connUrl, errorCount), nil)
+	}
+	bp.erroredConnMutex.Lock()
 	bp.erroredConnections.PushBack(conn)
+	bp.erroredConnMutex.Unlock()
+}
+
+// markNotInUse Forgets the connection as being in use, if it was
+func (bp *BackendWSConnPool) markNotInUse(conn *BackendConn) {
+	if _, loaded := bp.inUseMap.LoadAndDelete(conn); loaded {
+		atomic.AddInt64(&conn.registration.inUse, -1)
+	}
+}
+
+func (bp *BackendWSConnPool) loadRegistration(url string) (*backendRegistration, bool) {
+	value, ok := bp.registeredBackendUrls.Load(url)
+	if !ok {
+		return nil, false
+	}
+	return value.(*backendRegistration), true
+}
+
+// isActive Whether the registration is still the current one for its url and can be handed out to clients
+func (bp *BackendWSConnPool) isActive(registration *backendRegistration) bool {
+	current, ok := bp.loadRegistration(registration.url)
+	return ok && current == registration && !registration.isDraining()
+}
+
+func (bp *BackendWSConnPool) deregister(registration *backendRegistration) {
+	if current, ok := bp.loadRegistration(registration.url); ok && current == registration {
+		bp.registeredBackendUrls.Delete(registration.url)
+	}
+}
+
+func (bp *BackendWSConnPool) completeDrain(registration *backendRegistration) {
+	bp.deregister(registration)
+	bp.logger.Debug(fmt.Sprintf("backend url drained and de-registered: %s", registration.url))
+}
+
+// discardConn Drops a connection which no longer belongs to the pool, completing the drain of its url once none of
+// its connections are in use
+func (bp *BackendWSConnPool) discardConn(conn *BackendConn) {
+	closeBackendConn(conn)
+	if conn.registration.isDraining() && conn.registration.inUseCount() == 0 {
+		bp.completeDrain(conn.registration)
+	}
+}
+
+// discardIdleEntries Removes every entry of the registration from the available and idle lists
+func (bp *BackendWSConnPool) discardIdleEntries(registration *backendRegistration) {
+	bp.availableUrlMutex.Lock()
+	for e := bp.availableBackendUrls.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*backendRegistration) == registration {
+			bp.availableBackendUrls.Remove(e)
+		}
+		e = next
+	}
+	bp.availableUrlMutex.Unlock()
+
+	bp.idleConnMutex.Lock()
+	for e := bp.idleConnections.Front(); e != nil; {
+		next := e.Next()
+		if conn := e.Value.(*BackendConn); conn.registration == registration {
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			closeBackendConn(conn)
+		}
+		e = next
+	}
+	for e := bp.parkedConnections.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*BackendConn).registration == registration {
+			bp.parkedConnections.Remove(e)
+		}
+		e = next
+	}
+	bp.idleConnMutex.Unlock()
 }
 
-func (bp *BackendWSConnPool) tryAndFetchConnectionFromIdleList() *BackendConn {
+func (bp *BackendWSConnPool) tryAndFetchConnectionFromIdleList(ctx context.Context) *BackendConn {
 	bp.idleConnMutex.Lock()
 	defer bp.idleConnMutex.Unlock()
-	conn := bp.idleConnections.Front()
-	if conn != nil {
-		bp.idleConnections.Remove(conn)
-		return conn.Value.(*BackendConn)
+	excluded := excludedBackendFromContext(ctx)
+	if url, ok := PreferredBackendFromContext(ctx); ok && url != excluded {
+		if conn := bp.takePreferredIdleEntry(url); conn != nil {
+			return conn
+		}
+	}
+	if balancer := bp.currentSettings().balancer; balancer != nil {
+		return bp.pickFromIdleList(ctx, balancer)
+	}
+	for e := bp.idleConnections.Front(); e != nil; {
+		next := e.Next()
+		backendConn := e.Value.(*BackendConn)
+		switch {
+		case !bp.isActive(backendConn.registration):
+			// Url was removed or is draining while this entry was idle
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			bp.discardConn(backendConn)
+		case backendConn.connUrl != excluded:
+			bp.idleConnections.Remove(e)
+			return backendConn
+		}
+		e = next
+	}
+	return nil
+}
+
+// pickFromIdleList Lets the balancer strategy pick among the registered backend urls which can take another pipe, the
+// ones having an idle entry or an entry not yet made idle, other than a url excluded through the context. The oldest
+// idle entry of the picked url is handed out, or else one of its entries is taken off the available urls. To be called
+// with idleConnMutex held
+func (bp *BackendWSConnPool) pickFromIdleList(ctx context.Context, balancer BalancerStrategy) *BackendConn {
+	excluded := excludedBackendFromContext(ctx)
+	var candidates []BackendCandidate
+	var registrations []*backendRegistration
+	idleEntries := map[*backendRegistration]*list.Element{}
+	addCandidate := func(registration *backendRegistration) {
+		candidates = append(candidates, BackendCandidate{
+			Url:      registration.url,
+			InUse:    registration.inUseCount(),
+			Capacity: registration.capacity,
+			Weight:   registration.weight,
+		})
+		registrations = append(registrations, registration)
+	}
+	for e := bp.idleConnections.Front(); e != nil; {
+		next := e.Next()
+		backendConn := e.Value.(*BackendConn)
+		registration := backendConn.registration
+		switch {
+		case !bp.isActive(registration):
+			// Url was removed or is draining while this entry was idle
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			bp.discardConn(backendConn)
+		case registration.url == excluded:
+		case idleEntries[registration] == nil && registration.breaker.currentState() != CircuitOpen:
+			idleEntries[registration] = e
+			addCandidate(registration)
+		}
+		e = next
+	}
+	bp.availableUrlMutex.Lock()
+	defer bp.availableUrlMutex.Unlock()
+	seen := map[*backendRegistration]bool{}
+	for e := bp.availableBackendUrls.Front(); e != nil; e = e.Next() {
+		registration := e.Value.(*backendRegistration)
+		if idleEntries[registration] != nil || seen[registration] || registration.url == excluded {
+			continue
+		}
+		seen[registration] = true
+		if bp.isActive(registration) && registration.health.isHealthy() && registration.breaker.currentState() != CircuitOpen {
+			addCandidate(registration)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	picked := 0
+	if len(candidates) > 1 {
+		picked = balancer.Pick(ctx, candidates)
+		if picked < 0 || picked >= len(candidates) {
+			bp.logger.Warn(fmt.Sprintf("balancer strategy picked out of range candidate %d, handing out the first one", picked), nil)
+			picked = 0
+		}
+	}
+	if e := idleEntries[registrations[picked]]; e != nil {
+		bp.idleConnections.Remove(e)
+		return e.Value.(*BackendConn)
+	}
+	return bp.takeAvailableEntry(registrations[picked])
+}
+
+// takeAvailableEntry Takes an entry of the registration off the available urls ahead of the idle connection filler,
+// it is dialed once handed out. Returns nil if the registration has none or its backend is unhealthy. To be called
+// with idleConnMutex and availableUrlMutex held
+func (bp *BackendWSConnPool) takeAvailableEntry(registration *backendRegistration) *BackendConn {
+	if !registration.health.isHealthy() {
+		return nil
+	}
+	for e := bp.availableBackendUrls.Front(); e != nil; e = e.Next() {
+		if e.Value.(*backendRegistration) == registration {
+			bp.availableBackendUrls.Remove(e)
+			// Counted as idle, GetConn counts it out again as it hands it out
+			atomic.AddInt64(bp.idleConnCount, 1)
+			return &BackendConn{connUrl: registration.url, registration: registration}
+		}
 	}
 	return nil
 }
 
 func (bp *BackendWSConnPool) startIdleConnectionFiller() {
+	bp.loopsWg.Add(1)
 	go func() {
-		for {
-			if atomic.LoadInt64(bp.idleConnCount) > bp.maxIdleConnections {
-				time.Sleep(time.Second * 2)
+		defer bp.loopsWg.Done()
+		for !bp.isClosed() {
+			if atomic.LoadInt64(bp.idleConnCount) > bp.currentSettings().maxIdleConnections {
+				sleepUnlessClosed(time.Second*2, bp.closed)
 				continue
 			}
 
+			bp.availableUrlMutex.Lock()
 			front := bp.availableBackendUrls.Front()
 			if front == nil {
-				time.Sleep(time.Second * 2)
+				bp.availableUrlMutex.Unlock()
+				sleepUnlessClosed(time.Second*2, bp.closed)
 				continue
 			}
-
 			bp.availableBackendUrls.Remove(front)
-			atomic.AddInt64(bp.idleConnCount, 1)
-			bp.idleConnections.PushBack(&BackendConn{
-				Conn:      nil,
-				connUrl:   front.Value.(string),
-				ErrorInfo: ErrorInfo{},
-			})
-			bp.logger.Debug(fmt.Sprintf("added new available url into idle connection list: %s", front.Value.(string)))
+			bp.availableUrlMutex.Unlock()
+
+			registration := front.Value.(*backendRegistration)
+			if !bp.isActive(registration) {
+				continue
+			}
+			bp.idleConnMutex.Lock()
+			if bp.pushIdle(&BackendConn{
+				Conn:         nil,
+				connUrl:      registration.url,
+				registration: registration,
+				ErrorInfo:    ErrorInfo{},
+			}) {
+				atomic.AddInt64(bp.idleConnCount, 1)
+			}
+			bp.idleConnMutex.Unlock()
+			bp.logger.Debug(fmt.Sprintf("added new available url into idle connection list: %s", registration.url))
 		}
 	}()
 }
 
+// erroredConnectionRefresher Hands errored entries back to the idle connections as soon as the circuit breaker of
+// their backend allows, an open circuit holds its entry back till the cooldown since its last error elapses
 func (bp *BackendWSConnPool) erroredConnectionRefresher() {
+	bp.loopsWg.Add(1)
 	go func() {
-		for {
-			front := bp.erroredConnections.Front()
-			if front == nil {
-				time.Sleep(time.Second * 2)
+		defer bp.loopsWg.Done()
+		for !bp.isClosed() {
+			var readmitted []*BackendConn
+			now := time.Now()
+			breakerConfig := bp.currentSettings().circuitBreakerConfig
+			bp.erroredConnMutex.Lock()
+			for e := bp.erroredConnections.Front(); e != nil; {
+				next := e.Next()
+				backendConn := e.Value.(*BackendConn)
+				if !bp.isActive(backendConn.registration) ||
+					backendConn.registration.breaker.tryReadmit(*backendConn.lastCheckedTime, now, breakerConfig) {
+					bp.erroredConnections.Remove(e)
+					readmitted = append(readmitted, backendConn)
+				}
+				e = next
+			}
+			bp.erroredConnMutex.Unlock()
+
+			if len(readmitted) == 0 {
+				sleepUnlessClosed(bp.erroredRefreshInterval(), bp.closed)
 				continue
 			}
-			bp.erroredConnections.Remove(front)
-			backendConn := front.Value.(*BackendConn)
-			if backendConn.errorCount < bp.maxAllowedErrorCount {
-				backendConn.Conn = nil
-				bp.idleConnections.PushBack(backendConn)
-				bp.logger.Debug(fmt.Sprintf("errored connection added back to idle connection list, current error count: %d", backendConn.errorCount))
-			} else {
-				bp.logger.Warn(fmt.Sprintf("de-registering the url as it has reached max error count: %s", backendConn.connUrl), nil)
+			for _, backendConn := range readmitted {
+				if !bp.isActive(backendConn.registration) {
+					bp.discardConn(backendConn)
+					continue
+				}
+				closeBackendConn(backendConn)
+				// Logged ahead, the entry can be handed out and errored again as soon as it is idle
+				bp.logger.Debug(fmt.Sprintf("errored connection added back to idle connection list, circuit: %s, errors within window: %d",
+					backendConn.registration.breaker.currentState(), backendConn.errorCount))
+				bp.idleConnMutex.Lock()
+				if bp.pushIdle(backendConn) {
+					atomic.AddInt64(bp.idleConnCount, 1)
+				}
+				bp.idleConnMutex.Unlock()
 			}
 		}
 	}()
 }
 
-func newConn(wsUrl string) (net.Conn, error) {
-	parsedWSUrl, err := url.Parse(wsUrl)
-	if err != nil {
-		return nil, err
-	}
-	conn, err := websocket.Dial(wsUrl, "", parsedWSUrl.Host)
-	if err != nil {
-		return nil, err
+// erroredRefreshInterval How often errored entries are looked at, short enough to honour the cooldown
+func (bp *BackendWSConnPool) erroredRefreshInterval() time.Duration {
+	if cooldown := bp.currentSettings().circuitBreakerConfig.Cooldown; cooldown < time.Second*2 {
+		return cooldown
 	}
-	return conn, nil
+	return time.Second * 2
 }
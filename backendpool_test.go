@@ -1,10 +1,13 @@
 package interruptible_websocket_proxy
 
 import (
-	"fmt"
+	"container/list"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/websocket"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -18,6 +21,24 @@ func (testLogger) Error(msg string, nestedErr error) {}
 
 func (testLogger) Debug(msg string) {}
 
+// newTestBackend Starts a websocket backend on a random port which keeps each connection open for holdFor duration
+func newTestBackend(t *testing.T, holdFor time.Duration) string {
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(c *websocket.Conn) {
+			defer c.Close()
+			time.Sleep(holdFor)
+		},
+	})
+	t.Cleanup(server.Close)
+	return testBackendUrl(server)
+}
+
+// testBackendUrl Websocket url of the test server, dialer uses the host as the origin which only parses as a url for
+// a host name
+func testBackendUrl(server *httptest.Server) string {
+	return "ws://" + strings.Replace(strings.TrimPrefix(server.URL, "http://"), "127.0.0.1", "localhost", 1)
+}
+
 func TestNewBackendConnPool(t *testing.T) {
 	tl := &testLogger{}
 
@@ -46,14 +67,14 @@ func TestNewBackendConnPool(t *testing.T) {
 		err := pool.AddToPool(expUrl)
 		assert.Nil(t, err)
 
-		_, ok := pool.inUseMap.Load(expUrl)
+		ok := pool.InUseCount(expUrl) > 0
 		assert.False(t, ok)
 
-		conn := pool.GetConn()
+		conn, err := pool.GetConn(context.Background())
 		assert.Nil(t, err)
 		assert.Equal(t, expUrl, conn.connUrl)
 
-		_, ok = pool.inUseMap.Load(conn.connUrl)
+		ok = pool.InUseCount(conn.connUrl) > 0
 		assert.True(t, ok)
 	})
 
@@ -72,12 +93,13 @@ func TestNewBackendConnPool(t *testing.T) {
 		expUrl := "ws://localhost:8082"
 		err := pool.AddToPool(expUrl)
 		assert.Nil(t, err)
-		conn := pool.GetConn()
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
 		pool.MarkError(conn)
 		assert.Equal(t, int64(1), conn.errorCount)
 	})
 
-	t.Run("ShouldRemoveConnectionIfReachedMaxErrorCount", func(t *testing.T) {
+	t.Run("ShouldOpenCircuitIfReachedMaxErrorCountAndReadmitAfterCooldown", func(t *testing.T) {
 		go func() {
 			server := websocket.Server{
 				Handler: func(c *websocket.Conn) {
@@ -89,22 +111,353 @@ func TestNewBackendConnPool(t *testing.T) {
 			assert.Nil(t, err)
 		}()
 		pool := NewBackendConnPool(5, 2, tl)
+		pool.SetCircuitBreakerConfig(CircuitBreakerConfig{Cooldown: time.Second})
 		expUrl := "ws://localhost:8083"
 		err := pool.AddToPool(expUrl)
 		assert.Nil(t, err)
-		conn := pool.GetConn()
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
 		pool.MarkError(conn)
 
-		conn = pool.GetConn()
+		conn, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
 		pool.MarkError(conn)
+		assert.Equal(t, int64(2), conn.errorCount)
+
+		health, ok := pool.BackendHealth(expUrl)
+		assert.True(t, ok)
+		assert.Equal(t, CircuitOpen, health.Circuit)
+		pool.erroredConnMutex.Lock()
+		assert.Equal(t, 1, pool.erroredConnections.Len())
+		pool.erroredConnMutex.Unlock()
+
+		assert.Eventually(t, func() bool {
+			health, _ := pool.BackendHealth(expUrl)
+			return health.Circuit == CircuitHalfOpen
+		}, time.Second*4, time.Millisecond*100)
+		conn, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expUrl, conn.connUrl)
+		health, _ = pool.BackendHealth(expUrl)
+		assert.Equal(t, CircuitClosed, health.Circuit)
+	})
+
+	t.Run("ShouldCountReadmittedEntriesAsIdle", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetCircuitBreakerConfig(CircuitBreakerConfig{Cooldown: time.Millisecond * 100})
+		assert.Nil(t, pool.AddToPool(expUrl))
+		for i := 0; i < 5; i++ {
+			conn, err := pool.GetConn(context.Background())
+			assert.Nil(t, err)
+			pool.MarkError(conn)
+		}
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 1
+		}, time.Second*4, time.Millisecond*50)
+		assert.Equal(t, int64(1), atomic.LoadInt64(pool.idleConnCount))
+	})
+
+	t.Run("ShouldCountEntriesFailingToDialAsIdleOnceReadmitted", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		expUrl := testBackendUrl(server)
+		server.Close()
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetCircuitBreakerConfig(CircuitBreakerConfig{Cooldown: time.Millisecond * 100})
+		pool.SetMaxGetConnWait(time.Second)
+		assert.Nil(t, pool.AddToPool(expUrl))
+		_, err := pool.GetConn(context.Background())
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 1
+		}, time.Second*4, time.Millisecond*50)
+		assert.Equal(t, int64(1), atomic.LoadInt64(pool.idleConnCount))
+	})
+
+	t.Run("ShouldBeAbleToRemoveBackendUrlAndAddItBackAgain", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		expUrl := "ws://localhost:8084"
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+
+		err = pool.RemoveFromPool(expUrl)
+		assert.Nil(t, err)
+		err = pool.RemoveFromPool(expUrl)
+		assert.NotNil(t, err)
+
+		err = pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+	})
+
+	t.Run("ShouldDiscardIdleEntriesOfRemovedBackendUrl", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		expUrl := "ws://localhost:8085"
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(pool.idleConnCount) == 1
+		}, time.Second*4, time.Millisecond*100)
+
+		err = pool.RemoveFromPool(expUrl)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), atomic.LoadInt64(pool.idleConnCount))
+		assert.Equal(t, 0, pool.idleConnections.Len())
+	})
+
+	t.Run("ShouldDeregisterDrainingBackendOnceNoLongerInUse", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Second)
+		pool := NewBackendConnPool(5, 100, tl)
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+
+		err = pool.Drain(expUrl)
+		assert.Nil(t, err)
+		err = pool.Drain(expUrl)
+		assert.NotNil(t, err)
+		_, ok := pool.registeredBackendUrls.Load(expUrl)
+		assert.True(t, ok)
+
+		pool.MarkError(conn)
+		_, ok = pool.registeredBackendUrls.Load(expUrl)
+		assert.False(t, ok)
+		assert.Equal(t, 0, pool.erroredConnections.Len())
+
+		err = pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+	})
+
+	t.Run("ShouldDeregisterIdleBackendImmediatelyOnDrain", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		expUrl := "ws://localhost:8086"
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+
+		err = pool.Drain(expUrl)
+		assert.Nil(t, err)
+		_, ok := pool.registeredBackendUrls.Load(expUrl)
+		assert.False(t, ok)
+		assert.Equal(t, 0, pool.availableBackendUrls.Len())
+	})
+
+	t.Run("ShouldRedialReleasedConnectionByDefault", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Second)
+		pool := NewBackendConnPool(5, 100, tl)
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+
+		pool.Release(conn)
+		ok := pool.InUseCount(expUrl) > 0
+		assert.False(t, ok)
+		assert.Nil(t, conn.Conn)
+		assert.Equal(t, 1, pool.idleConnections.Len())
+
+		conn, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expUrl, conn.connUrl)
+		assert.NotNil(t, conn.Conn)
+	})
+
+	t.Run("ShouldReuseReleasedConnectionWhenConfigured", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Second)
+		pool := NewBackendConnPool(5, 100, tl)
+		pool.SetReleasePolicy(ReleaseReuse)
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		netConn := conn.Conn
+
+		pool.Release(conn)
+		conn, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, netConn, conn.Conn)
+	})
+
+	t.Run("ShouldNotReuseConnectionDialedWithClientHandshake", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Second)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetReleasePolicy(ReleaseReuse)
+		assert.Nil(t, pool.AddToPool(expUrl))
+		handshake := &ClientHandshake{Header: http.Header{"Authorization": []string{"Bearer client-a"}}}
+		conn, err := pool.GetConn(WithClientHandshake(context.Background(), handshake))
+		assert.Nil(t, err)
+		assert.NotNil(t, conn.Conn)
+
+		pool.Release(conn)
+		assert.Nil(t, conn.Conn)
+		conn, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.False(t, conn.dialedWithHandshake)
+	})
+}
+
+func TestBackendWSConnPool_GetConn(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldGiveUpAfterMaxWait", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		pool.SetMaxGetConnWait(time.Millisecond * 200)
+
+		startedAt := time.Now()
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, conn)
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+		assert.Less(t, time.Since(startedAt), time.Second)
+	})
+
+	t.Run("ShouldGiveUpWhenContextIsCancelled", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*200, cancel)
 
+		conn, err := pool.GetConn(ctx)
+		assert.Nil(t, conn)
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+		assert.ErrorContains(t, err, context.Canceled.Error())
+	})
+
+	t.Run("ShouldNotHoldDialGivenUpByCallerAgainstBackend", func(t *testing.T) {
+		stall := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-stall
+		}))
+		defer server.Close()
+		defer close(stall)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetMaxGetConnWait(time.Millisecond * 200)
+		expUrl := testBackendUrl(server)
+		assert.Nil(t, pool.AddToPool(expUrl))
 		assert.Eventually(t, func() bool {
-			_, ok := pool.inUseMap.Load(expUrl)
-			fmt.Println(ok)
-			fmt.Println(atomic.LoadInt64(pool.idleConnCount))
-			fmt.Println(pool.idleConnections.Len())
-			fmt.Println(pool.erroredConnections.Len())
-			return !ok && atomic.LoadInt64(pool.idleConnCount) == -1 && pool.idleConnections.Len() == 0 && pool.erroredConnections.Len() == 0
-		}, time.Second*4, time.Second)
+			return idleLen(pool) == 1
+		}, time.Second*4, time.Millisecond*50)
+
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, conn)
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+		assert.Equal(t, 0, pool.Backends()[0].ErrorsInWindow)
+		assert.Equal(t, 1, idleLen(pool))
+		assert.Equal(t, int64(1), atomic.LoadInt64(pool.idleConnCount))
+	})
+}
+
+func TestBackendWSConnPool_Close(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldStopWaitingForConnectionOnceClosed", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		getConnErr := make(chan error)
+		go func() {
+			_, err := pool.GetConn(context.Background())
+			getConnErr <- err
+		}()
+		time.Sleep(time.Millisecond * 100)
+
+		err := pool.Close(context.Background())
+		assert.Nil(t, err)
+		select {
+		case err = <-getConnErr:
+			assert.Equal(t, ErrPoolClosed, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("GetConn did not return after pool was closed")
+		}
+	})
+
+	t.Run("ShouldCloseInUseConnections", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.NotNil(t, conn)
+
+		err = pool.Close(context.Background())
+		assert.Nil(t, err)
+		assert.Nil(t, conn.Conn)
+		assert.Equal(t, 0, countSyncMap(&pool.inUseMap))
+		assert.Equal(t, 0, pool.idleConnections.Len())
+	})
+}
+
+func TestBackendWSConnPool_AddToPoolWithCapacity(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldServeUpToCapacityPipesPerBackend", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		err := pool.AddToPoolWithCapacity(expUrl, 2)
+		assert.Nil(t, err)
+
+		first, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		second, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expUrl, second.connUrl)
+		assert.NotEqual(t, first.Conn, second.Conn)
+		assert.Equal(t, 2, pool.InUseCount(expUrl))
+
+		pool.SetMaxGetConnWait(time.Millisecond * 500)
+		_, err = pool.GetConn(context.Background())
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+
+		pool.Release(first)
+		assert.Equal(t, 1, pool.InUseCount(expUrl))
+		pool.SetMaxGetConnWait(0)
+		third, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expUrl, third.connUrl)
+		assert.Equal(t, 2, pool.InUseCount(expUrl))
+	})
+
+	t.Run("ShouldDeregisterDrainingBackendOnceNoneOfItsConnectionsAreInUse", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		err := pool.AddToPoolWithCapacity(expUrl, 2)
+		assert.Nil(t, err)
+		first, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		second, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+
+		err = pool.Drain(expUrl)
+		assert.Nil(t, err)
+		pool.Release(first)
+		_, ok := pool.loadRegistration(expUrl)
+		assert.True(t, ok)
+		pool.Release(second)
+		_, ok = pool.loadRegistration(expUrl)
+		assert.False(t, ok)
+	})
+
+	t.Run("ShouldInterleaveAvailableEntriesAcrossBackends", func(t *testing.T) {
+		pool := &BackendWSConnPool{availableBackendUrls: list.New()}
+		first := &backendRegistration{url: "ws://localhost:8081"}
+		second := &backendRegistration{url: "ws://localhost:8082"}
+		pool.pushAvailable(first, 3)
+		pool.pushAvailable(second, 2)
+		pool.pushAvailable(first, 1)
+
+		var urls []string
+		for e := pool.availableBackendUrls.Front(); e != nil; e = e.Next() {
+			urls = append(urls, e.Value.(*backendRegistration).url)
+		}
+		assert.Equal(t, []string{"ws://localhost:8081", "ws://localhost:8082", "ws://localhost:8081", "ws://localhost:8082",
+			"ws://localhost:8081", "ws://localhost:8081"}, urls)
+	})
+
+	t.Run("ShouldRejectInvalidCapacity", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.NotNil(t, pool.AddToPoolWithCapacity("ws://localhost:8081", 0))
 	})
 }
@@ -0,0 +1,193 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// BackendCandidate A registered backend url which can take another pipe, along with its load
+type BackendCandidate struct {
+	Url string
+	// InUse connections of the url currently in use by pipes, out of Capacity
+	InUse    int
+	Capacity int
+	Weight   int
+}
+
+// BalancerStrategy Picks the backend GetConn hands out next. Pick is given every registered backend url below its
+// capacity, healthy and with its circuit not open, the ones with an idle connection first in the order their idle
+// connections were added, and returns the index of the chosen one. The context is the one
+// passed to GetConn, the client ID of the pipe asking for a backend can be read with ClientIDFromContext
+type BalancerStrategy interface {
+	Pick(ctx context.Context, candidates []BackendCandidate) int
+}
+
+// BackendOptions Registration options of a backend url
+type BackendOptions struct {
+	// Capacity pipes the backend can serve at once, defaults to 1
+	Capacity int
+	// Weight share of new pipes the backend gets under the weighted strategy, defaults to 1
+	Weight int
+}
+
+func (bo BackendOptions) withDefaults(url string) (BackendOptions, error) {
+	if bo.Capacity < 0 || bo.Weight < 0 {
+		return bo, fmt.Errorf("invalid options for backend url: %s, capacity: %d, weight: %d", url, bo.Capacity, bo.Weight)
+	}
+	if bo.Capacity == 0 {
+		bo.Capacity = 1
+	}
+	if bo.Weight == 0 {
+		bo.Weight = 1
+	}
+	return bo, nil
+}
+
+type roundRobinStrategy struct {
+	mut     sync.Mutex
+	lastUrl string
+}
+
+// NewRoundRobinStrategy Hands out the backend urls in turn, in the order of their urls
+func NewRoundRobinStrategy() BalancerStrategy {
+	return &roundRobinStrategy{}
+}
+
+func (rr *roundRobinStrategy) Pick(ctx context.Context, candidates []BackendCandidate) int {
+	rr.mut.Lock()
+	defer rr.mut.Unlock()
+	next, lowest := -1, 0
+	for i, candidate := range candidates {
+		if candidate.Url < candidates[lowest].Url {
+			lowest = i
+		}
+		if candidate.Url > rr.lastUrl && (next == -1 || candidate.Url < candidates[next].Url) {
+			next = i
+		}
+	}
+	if next == -1 {
+		// Went past the last url, start over
+		next = lowest
+	}
+	rr.lastUrl = candidates[next].Url
+	return next
+}
+
+type leastConnectionsStrategy struct{}
+
+// NewLeastConnectionsStrategy Hands out the backend url with the fewest connections in use, ties go to the url which
+// has been idle the longest
+func NewLeastConnectionsStrategy() BalancerStrategy {
+	return leastConnectionsStrategy{}
+}
+
+func (leastConnectionsStrategy) Pick(ctx context.Context, candidates []BackendCandidate) int {
+	least := 0
+	for i, candidate := range candidates {
+		if candidate.InUse < candidates[least].InUse {
+			least = i
+		}
+	}
+	return least
+}
+
+type randomTwoChoicesStrategy struct{}
+
+// NewRandomTwoChoicesStrategy Picks two backend urls at random and hands out the one with fewer connections in use,
+// which spreads the load close to least connections without every proxy instance piling onto the same backend
+func NewRandomTwoChoicesStrategy() BalancerStrategy {
+	return randomTwoChoicesStrategy{}
+}
+
+func (randomTwoChoicesStrategy) Pick(ctx context.Context, candidates []BackendCandidate) int {
+	if len(candidates) < 2 {
+		return 0
+	}
+	first := rand.Intn(len(candidates))
+	second := rand.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+	if candidates[second].InUse < candidates[first].InUse {
+		return second
+	}
+	return first
+}
+
+type weightedStrategy struct {
+	mut            sync.Mutex
+	currentWeights map[string]int
+}
+
+// NewWeightedStrategy Hands out the backend urls in proportion to their weights, see BackendOptions.Weight. Picks are
+// interleaved (smooth weighted round-robin) instead of handing a heavier backend several pipes in a row
+func NewWeightedStrategy() BalancerStrategy {
+	return &weightedStrategy{currentWeights: map[string]int{}}
+}
+
+func (ws *weightedStrategy) Pick(ctx context.Context, candidates []BackendCandidate) int {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	currentWeights := make(map[string]int, len(candidates))
+	total, best := 0, 0
+	for i, candidate := range candidates {
+		currentWeights[candidate.Url] = ws.currentWeights[candidate.Url] + candidate.Weight
+		total += candidate.Weight
+		if currentWeights[candidate.Url] > currentWeights[candidates[best].Url] {
+			best = i
+		}
+	}
+	currentWeights[candidates[best].Url] -= total
+	// Urls at capacity start over once they are back, which keeps the map to the registered urls
+	ws.currentWeights = currentWeights
+	return best
+}
+
+type consistentHashStrategy struct{}
+
+// NewConsistentHashStrategy Keeps a client on the same backend url by hashing its client ID against every url
+// (rendezvous hashing), so adding or removing a backend only moves the clients of that backend. When the backend of
+// a client is at capacity, the client goes to its next best url. Requests without a client ID are
+// handed the url which has been idle the longest
+func NewConsistentHashStrategy() BalancerStrategy {
+	return consistentHashStrategy{}
+}
+
+func (consistentHashStrategy) Pick(ctx context.Context, candidates []BackendCandidate) int {
+	clientId, ok := ClientIDFromContext(ctx)
+	if !ok {
+		return 0
+	}
+	best, bestScore := 0, uint64(0)
+	for i, candidate := range candidates {
+		hash := fnv.New64a()
+		hash.Write(clientId[:])
+		hash.Write([]byte(candidate.Url))
+		if score := hash.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+type clientIdKey struct{}
+
+// WithClientID Attaches the ID of the client a backend is obtained for to the context passed to GetConn
+func WithClientID(ctx context.Context, clientId uuid.UUID) context.Context {
+	return context.WithValue(ctx, clientIdKey{}, clientId)
+}
+
+// ClientIDFromContext ID of the client a backend is obtained for, taken from the client handshake when not set directly
+func ClientIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	if clientId, ok := ctx.Value(clientIdKey{}).(uuid.UUID); ok {
+		return clientId, true
+	}
+	if handshake, ok := ClientHandshakeFromContext(ctx); ok {
+		return handshake.ClientID, true
+	}
+	return uuid.Nil, false
+}
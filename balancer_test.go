@@ -0,0 +1,175 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testCandidates(urls ...string) []BackendCandidate {
+	candidates := make([]BackendCandidate, 0, len(urls))
+	for _, url := range urls {
+		candidates = append(candidates, BackendCandidate{Url: url, Capacity: 1, Weight: 1})
+	}
+	return candidates
+}
+
+func pickedUrls(strategy BalancerStrategy, ctx context.Context, candidates []BackendCandidate, picks int) []string {
+	var urls []string
+	for i := 0; i < picks; i++ {
+		urls = append(urls, candidates[strategy.Pick(ctx, candidates)].Url)
+	}
+	return urls
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("RoundRobinShouldHandOutUrlsInTurn", func(t *testing.T) {
+		candidates := testCandidates("ws://c", "ws://a", "ws://b")
+		urls := pickedUrls(NewRoundRobinStrategy(), ctx, candidates, 4)
+		assert.Equal(t, []string{"ws://a", "ws://b", "ws://c", "ws://a"}, urls)
+	})
+
+	t.Run("RoundRobinShouldCarryOnWhenCandidatesChange", func(t *testing.T) {
+		strategy := NewRoundRobinStrategy()
+		assert.Equal(t, 0, strategy.Pick(ctx, testCandidates("ws://a", "ws://c")))
+		// ws://b showed up after ws://a was handed out
+		assert.Equal(t, 1, strategy.Pick(ctx, testCandidates("ws://c", "ws://b")))
+	})
+
+	t.Run("LeastConnectionsShouldPickFewestInUseAndOldestOnTies", func(t *testing.T) {
+		candidates := testCandidates("ws://a", "ws://b", "ws://c")
+		candidates[0].InUse, candidates[1].InUse, candidates[2].InUse = 3, 1, 1
+		assert.Equal(t, 1, NewLeastConnectionsStrategy().Pick(ctx, candidates))
+	})
+
+	t.Run("RandomTwoChoicesShouldNeverPickTheBusiestOfThree", func(t *testing.T) {
+		candidates := testCandidates("ws://a", "ws://b", "ws://c")
+		candidates[0].InUse, candidates[1].InUse, candidates[2].InUse = 1, 9, 2
+		strategy := NewRandomTwoChoicesStrategy()
+		for i := 0; i < 100; i++ {
+			assert.NotEqual(t, 1, strategy.Pick(ctx, candidates))
+		}
+	})
+
+	t.Run("WeightedShouldInterleaveInProportionToWeights", func(t *testing.T) {
+		candidates := testCandidates("ws://a", "ws://b")
+		candidates[0].Weight = 3
+		urls := pickedUrls(NewWeightedStrategy(), ctx, candidates, 8)
+		assert.Equal(t, []string{"ws://a", "ws://a", "ws://b", "ws://a", "ws://a", "ws://a", "ws://b", "ws://a"}, urls)
+	})
+
+	t.Run("ConsistentHashShouldKeepClientOnItsUrlUnlessItGoesAway", func(t *testing.T) {
+		strategy := NewConsistentHashStrategy()
+		candidates := testCandidates("ws://a", "ws://b", "ws://c", "ws://d")
+		moved := 0
+		for i := 0; i < 100; i++ {
+			clientCtx := WithClientID(ctx, uuid.New())
+			picked := candidates[strategy.Pick(clientCtx, candidates)].Url
+			assert.Equal(t, picked, candidates[strategy.Pick(clientCtx, candidates)].Url)
+
+			// Taking out another url does not move the client
+			var remaining []BackendCandidate
+			for _, candidate := range candidates {
+				if candidate.Url != "ws://d" {
+					remaining = append(remaining, candidate)
+				}
+			}
+			if remainingPick := remaining[strategy.Pick(clientCtx, remaining)].Url; remainingPick != picked {
+				assert.Equal(t, "ws://d", picked)
+				moved++
+			}
+		}
+		assert.Greater(t, moved, 0)
+	})
+
+	t.Run("ConsistentHashShouldUseClientIdOfHandshake", func(t *testing.T) {
+		clientId := uuid.New()
+		candidates := testCandidates("ws://a", "ws://b", "ws://c")
+		strategy := NewConsistentHashStrategy()
+		assert.Equal(t, strategy.Pick(WithClientID(ctx, clientId), candidates),
+			strategy.Pick(WithClientHandshake(ctx, &ClientHandshake{ClientID: clientId}), candidates))
+	})
+}
+
+func TestBackendWSConnPool_SetBalancerStrategy(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldKeepClientOnSameBackendWithConsistentHash", func(t *testing.T) {
+		urls := []string{newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5)}
+		pool := NewBackendConnPool(10, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetBalancerStrategy(NewConsistentHashStrategy())
+		for _, url := range urls {
+			assert.Nil(t, pool.AddToPoolWithCapacity(url, 2))
+		}
+		assert.Eventually(t, func() bool {
+			pool.idleConnMutex.Lock()
+			defer pool.idleConnMutex.Unlock()
+			return pool.idleConnections.Len() == 6
+		}, time.Second*10, time.Millisecond*50)
+
+		ctx := WithClientID(context.Background(), uuid.New())
+		first, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		pool.Release(first)
+		second, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, first.connUrl, second.connUrl)
+		// Backend of the client is at capacity with two pipes, the client goes to another one
+		third, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, first.connUrl, third.connUrl)
+		fourth, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.NotEqual(t, first.connUrl, fourth.connUrl)
+	})
+
+	t.Run("ShouldHandOutBackendsByWeight", func(t *testing.T) {
+		heavyUrl, lightUrl := newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5)
+		pool := NewBackendConnPool(10, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetBalancerStrategy(NewWeightedStrategy())
+		assert.Nil(t, pool.AddToPoolWithOptions(heavyUrl, BackendOptions{Capacity: 4, Weight: 3}))
+		assert.Nil(t, pool.AddToPoolWithOptions(lightUrl, BackendOptions{Capacity: 4}))
+		assert.Eventually(t, func() bool {
+			pool.idleConnMutex.Lock()
+			defer pool.idleConnMutex.Unlock()
+			return pool.idleConnections.Len() == 8
+		}, time.Second*10, time.Millisecond*50)
+
+		for i := 0; i < 4; i++ {
+			_, err := pool.GetConn(context.Background())
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 3, pool.InUseCount(heavyUrl))
+		assert.Equal(t, 1, pool.InUseCount(lightUrl))
+	})
+
+	t.Run("ShouldPickAmongBackendsWithoutIdleEntries", func(t *testing.T) {
+		firstUrl, secondUrl := newTestBackend(t, time.Second*5), newTestBackend(t, time.Second*5)
+		pool := NewBackendConnPool(0, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetBalancerStrategy(NewRoundRobinStrategy())
+		assert.Nil(t, pool.AddToPoolWithCapacity(firstUrl, 3))
+		assert.Nil(t, pool.AddToPoolWithCapacity(secondUrl, 3))
+
+		// At most one entry is idle at a time, the strategy still gets to alternate
+		for i := 0; i < 4; i++ {
+			_, err := pool.GetConn(context.Background())
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 2, pool.InUseCount(firstUrl))
+		assert.Equal(t, 2, pool.InUseCount(secondUrl))
+	})
+
+	t.Run("ShouldRejectInvalidOptions", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.NotNil(t, pool.AddToPoolWithOptions("ws://localhost:8081", BackendOptions{Weight: -1}))
+		assert.Nil(t, pool.AddToPoolWithOptions("ws://localhost:8081", BackendOptions{}))
+	})
+}
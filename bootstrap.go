@@ -0,0 +1,98 @@
+package interruptible_websocket_proxy
+
+// defaultBootstrapMaxBytes Bound of the data recorded by a bootstrap log unless set otherwise
+const defaultBootstrapMaxBytes = 64 * 1024
+
+// BootstrapConfig Selects the client messages each pipe records in its bootstrap log, which is replayed to every
+// backend substituted for the pipe, or migrated to, ahead of the data held meanwhile. Meant for the messages a backend
+// needs to see first, like subscribing or authenticating. Messages are whole websocket messages with message framed
+// buffering, raw chunks of the byte stream otherwise, which line up with the messages of the client by chance only, so
+// it is meant to go along with message framed buffering. Replies of a backend to the replayed messages reach the client
+// like any other data
+type BootstrapConfig struct {
+	// FirstMessages the first n messages of the client are recorded
+	FirstMessages int
+	// Match records any other message it returns true for
+	Match func(data []byte) bool
+	// MaxBytes bounds the recorded data per pipe, messages beyond it are not recorded. Defaults to 64KiB
+	MaxBytes int
+}
+
+// bootstrapLog Client messages delivered to a backend which are to be replayed to a replacement backend, guarded by
+// the backendMut of its pipe
+type bootstrapLog struct {
+	config   BootstrapConfig
+	messages []wsMessage
+	seen     int
+	size     int
+	// lastSeq is the sequence number of the last message seen in reliable delivery mode, where messages are written
+	// again after a substitution and are not to be seen twice
+	lastSeq uint64
+}
+
+func newBootstrapLog(config BootstrapConfig) *bootstrapLog {
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultBootstrapMaxBytes
+	}
+	return &bootstrapLog{config: config}
+}
+
+// record Keeps a copy of the message delivered to the backend if the config selects it
+func (bl *bootstrapLog) record(msg wsMessage) {
+	if msg.seq != 0 {
+		if msg.seq <= bl.lastSeq {
+			return
+		}
+		bl.lastSeq = msg.seq
+	}
+	bl.seen++
+	if bl.seen > bl.config.FirstMessages && (bl.config.Match == nil || !bl.config.Match(msg.data)) {
+		return
+	}
+	if bl.size+len(msg.data) > bl.config.MaxBytes {
+		return
+	}
+	data := make([]byte, len(msg.data))
+	copy(data, msg.data)
+	bl.messages = append(bl.messages, wsMessage{payloadType: msg.payloadType, data: data, seq: msg.seq})
+	bl.size += len(data)
+}
+
+// SetBootstrap Makes pipes record a bootstrap log of client messages as selected by the config, see BootstrapConfig.
+// Nil, the default, records nothing. Applies to the pipes created afterwards
+func (pm *WebsocketPipeManager) SetBootstrap(config *BootstrapConfig) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.bootstrap = config
+}
+
+// recordDelivered Records the message written to the backend in the bootstrap log, to be called with backendMut held
+func (pep *PersistentPipe) recordDelivered(msg wsMessage) {
+	if pep.bootstrap != nil {
+		pep.bootstrap.record(msg)
+	}
+}
+
+// replayToSubstitute Writes the bootstrap log followed by the data held meanwhile to a backend substituted for the pipe
+func (pep *PersistentPipe) replayToSubstitute() error {
+	pep.backendMut.Lock()
+	defer pep.backendMut.Unlock()
+	if err := pep.replayBootstrapLocked(); err != nil {
+		return err
+	}
+	pep.resendAllUnacked()
+	return pep.flushBackendBufferLocked()
+}
+
+func (pep *PersistentPipe) replayBootstrapLocked() error {
+	if pep.bootstrap == nil {
+		return nil
+	}
+	backendConn := pep.currentBackend()
+	for _, msg := range pep.bootstrap.messages {
+		if err := pep.writeFrame(backendConn, envelope(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package interruptible_websocket_proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRecordingBackend Starts a websocket backend which reports every message it receives on the returned channel
+func newTestRecordingBackend(t *testing.T) (string, chan string) {
+	received := make(chan string, 16)
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(c *websocket.Conn) {
+			defer c.Close()
+			for {
+				var msg string
+				if err := websocket.Message.Receive(c, &msg); err != nil {
+					return
+				}
+				received <- msg
+			}
+		},
+	})
+	t.Cleanup(server.Close)
+	return testBackendUrl(server), received
+}
+
+func TestBootstrapLog(t *testing.T) {
+	t.Run("ShouldRecordFirstMessagesAndMatchingOnesWithinMaxBytes", func(t *testing.T) {
+		log := newBootstrapLog(BootstrapConfig{
+			FirstMessages: 2,
+			Match:         func(data []byte) bool { return bytes.HasPrefix(data, []byte("sub")) },
+			MaxBytes:      20,
+		})
+		for _, data := range []string{"auth", "hello", "data", "subscribe", "data", "subscribe-too-long"} {
+			log.record(wsMessage{data: []byte(data)})
+		}
+		var recorded []string
+		for _, msg := range log.messages {
+			recorded = append(recorded, string(msg.data))
+		}
+		assert.Equal(t, []string{"auth", "hello", "subscribe"}, recorded)
+	})
+}
+
+func TestWebsocketPipeManager_SetBootstrap(t *testing.T) {
+	tl := &testLogger{}
+
+	for name, migrate := range map[string]func(pm *WebsocketPipeManager, clientId uuid.UUID, url string) error{
+		"ShouldReplayBootstrapToSubstitutedBackend": func(pm *WebsocketPipeManager, clientId uuid.UUID, url string) error {
+			return pm.ForceMigratePipe(clientId, url)
+		},
+		"ShouldReplayBootstrapToMigratedBackend": func(pm *WebsocketPipeManager, clientId uuid.UUID, url string) error {
+			return pm.MigratePipe(clientId, url)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			firstUrl, firstReceived := newTestRecordingBackend(t)
+			secondUrl, secondReceived := newTestRecordingBackend(t)
+			pool := NewBackendConnPool(5, 100, tl)
+			pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+			defer pipeManager.Shutdown(context.Background())
+			pipeManager.SetBootstrap(&BootstrapConfig{FirstMessages: 1})
+			assert.Nil(t, pipeManager.AddConnectionToPool(firstUrl))
+			clientId := uuid.New()
+			clientPeer, _ := startTestPipe(pipeManager, clientId)
+			assert.Eventually(t, func() bool {
+				return pool.InUseCount(firstUrl) == 1
+			}, time.Second*10, time.Millisecond*50)
+			assert.Nil(t, pipeManager.AddConnectionToPool(secondUrl))
+			assert.Eventually(t, func() bool {
+				return idleLen(pool) == 1
+			}, time.Second*10, time.Millisecond*50)
+
+			for _, msg := range []string{"subscribe", "data"} {
+				_, err := clientPeer.Write([]byte(msg))
+				assert.Nil(t, err)
+				assert.Equal(t, msg, <-firstReceived)
+			}
+			assert.Nil(t, migrate(pipeManager, clientId, secondUrl))
+			assert.Eventually(t, func() bool {
+				return pool.InUseCount(secondUrl) == 1
+			}, time.Second*10, time.Millisecond*50)
+			_, err := clientPeer.Write([]byte("more data"))
+			assert.Nil(t, err)
+			assert.Equal(t, "subscribe", <-secondReceived)
+			assert.Equal(t, "more data", <-secondReceived)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,115 +25,183 @@ const (
 	CopyFromBacked
 )
 
-// copyBuffer is the actual implementation of Copy and CopyBuffer.
-// if buf is nil, one is allocated.
-// TODO: Should mutex writes to backend error
-func (pep *PersistentPipe) copyBuffer(cd CopyDirection, errChan chan error) {
-	var src func() io.Reader
-	var dst func() io.Writer
-	var written int64
-	var err error
+func (cd CopyDirection) String() string {
+	if cd == CopyToBackend {
+		return "to_backend"
+	}
+	return "from_backend"
+}
+
+// copyBuffer copies data in the given direction till the stream is stopped or the client can no longer be served.
+// Data from the client is held in the backend buffer while the backend is being substituted
+func (pep *PersistentPipe) copyBuffer(cd CopyDirection, errChan chan error, done chan struct{}) {
+	defer pep.copyWg.Done()
+	var src func() io.ReadWriteCloser
 
 	if cd == CopyToBackend {
-		src = func() io.Reader { return pep.ClientConn }
-		dst = func() io.Writer {
-			return pep.BackendConn
-		}
+		src = pep.clientSource
 	} else {
-		src = func() io.Reader {
-			return pep.BackendConn
-		}
-		dst = func() io.Writer {
-			return pep.ClientConn
-		}
+		src = pep.backendSource
 	}
 
-	size := 32 * 1024
-	if l, ok := src().(*io.LimitedReader); ok && int64(size) > l.N {
-		if l.N < 1 {
-			size = 1
-		} else {
-			size = int(l.N)
-		}
-	}
-	buf := make([]byte, size)
+	buf := make([]byte, 32*1024)
 	for {
-		if cd == CopyFromBacked && pep.BackendErr != nil {
-			if len(pep.backendBuffer) > pep.bufferByteLimit {
-				err = writeErr{error: fmt.Errorf("backend buffer reached max limit, exiting")}
-				log.Println(err)
-				break
-			}
+		if isStopped(done) {
+			break
+		}
+		if cd == CopyFromBacked && pep.backendErr() != nil {
 			time.Sleep(2 * time.Second)
 			continue
 		}
-		nr, srcReadErr := src().Read(buf)
-		if nr > 0 {
-			if cd == CopyToBackend && pep.BackendErr != nil {
-				if len(pep.backendBuffer)+len(buf[0:nr]) > pep.bufferByteLimit {
-					err = writeErr{error: fmt.Errorf("backend buffer reached max limit, exiting")}
-					log.Println(err)
-					break
-				}
-				pep.backendBuffer = append(pep.backendBuffer, buf[0:nr]...)
-				continue
-			} else if cd == CopyToBackend && pep.BackendErr == nil && len(pep.backendBuffer) > 0 {
-				// TODO: this one is quick hack, can implement to write chunks if writes are failing with large buffer size
-				buf = append(pep.backendBuffer, buf[0:nr]...)
-				nr = len(pep.backendBuffer)
-			}
-			nw, ew := dst().Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = fmt.Errorf("invalid write error")
-				}
-			}
-			written += int64(nw)
-			if ew != nil {
-				err = writeErr{error: ew, CopyDirection: cd}
-				if cd == CopyToBackend {
-					//pep.BackendErr = err
-					pep.backendBuffer = append(pep.backendBuffer, buf[0:nr]...)
-					//errChan <- err
-					continue
-				}
-				//errChan <- err
+		srcConn := src()
+		msg, srcReadErr := pep.readFrame(srcConn, buf)
+		if srcReadErr != nil && isStopped(done) {
+			break
+		}
+		if msg != nil {
+			pep.metrics.observeCopiedBytes(cd, len(msg.data))
+		}
+		if msg != nil && cd == CopyFromBacked && pep.acknowledge(*msg) {
+			msg = nil
+		}
+		if msg != nil && cd == CopyFromBacked {
+			if !pep.writeToClient(*msg, errChan, done) {
 				break
 			}
-			if nr != nw {
-				invalidWriteErr := fmt.Errorf("invalid write error: %s", io.ErrShortWrite)
-				err = writeErr{error: invalidWriteErr, CopyDirection: cd}
-				log.Println(err)
-				if cd == CopyToBackend {
-					//pep.BackendErr = err
-					pep.backendBuffer = append(pep.backendBuffer, buf[0:nr]...)
-					//errChan <- err
-					continue
-				}
-				//errChan <- err
+		} else if msg != nil {
+			if !pep.writeToBackend(*msg, errChan, done) {
 				break
-			} else if len(pep.backendBuffer) > 0 {
-				pep.backendBuffer = pep.backendBuffer[:0]
 			}
 		}
 		// In case of reading from client connection is an error, stop
 		if cd == CopyToBackend && srcReadErr != nil {
 			log.Printf("WARN: read from client connection failed with err: %s", srcReadErr)
-			if srcReadErr != io.EOF {
-				err = readErr{error: srcReadErr, CopyDirection: cd}
+			var err error = readErr{error: srcReadErr, CopyDirection: cd}
+			if srcReadErr == io.EOF {
+				err = srcReadErr
 			}
+			pep.sendClientErr(err, errChan, done)
 			break
 		} else if cd == CopyFromBacked && srcReadErr != nil {
+			if pep.retireBackend(srcConn) {
+				// Backend the pipe migrated away from closed, carry on with the current one
+				continue
+			}
 			log.Printf("WARN: backend connection failed with err: %s", srcReadErr)
-			if pep.BackendErr == nil {
-				pep.BackendErr = readErr{error: srcReadErr, CopyDirection: cd}
-				errChan <- pep.BackendErr
+			var err error = readErr{error: srcReadErr, CopyDirection: cd}
+			if pep.reportBackendErr(err) {
+				sendErr(err, errChan, done)
 			}
-			if len(pep.backendBuffer) > pep.bufferByteLimit {
-				err = writeErr{error: fmt.Errorf("backend buffer reached max limit, exiting")}
-				break
+		}
+	}
+}
+
+// writeToBackend Writes data from the client to the backend. While the backend is being substituted or the pipe is
+// migrating to another backend, data is held in the backend buffer and flushed ahead of newer data once a backend is
+// back. Returns false once the buffer outgrows its limit, in which case the client is dropped to keep the memory in check
+func (pep *PersistentPipe) writeToBackend(msg wsMessage, errChan chan error, done chan struct{}) bool {
+	pep.backendMut.Lock()
+	defer pep.backendMut.Unlock()
+	if pep.reliable != nil {
+		return pep.writeReliably(msg, errChan, done)
+	}
+	if pep.backendErr() == nil && !pep.backendPaused && pep.flushBackendBufferLocked() == nil {
+		err := pep.writeFrame(pep.currentBackend(), msg)
+		if err == nil {
+			pep.recordDelivered(msg)
+			return true
+		}
+		// Read side of the backend connection reports the failure, hold the data till then
+		log.Println(writeErr{error: err, CopyDirection: CopyToBackend})
+	}
+	bufferErr := pep.backendBuffer.Push(msg.payloadType, msg.data)
+	atomic.StoreInt64(&pep.backendBufferedBytes, int64(pep.backendBuffer.Size()))
+	if bufferErr != nil {
+		err := writeErr{error: fmt.Errorf("backend buffer reached max limit, exiting: %w", bufferErr), CopyDirection: CopyToBackend}
+		log.Println(err)
+		pep.sendClientErr(err, errChan, done)
+		return false
+	}
+	return true
+}
+
+func (pep *PersistentPipe) flushBackendBufferLocked() error {
+	backendConn := pep.currentBackend()
+	if pep.reliable != nil {
+		return pep.reliable.flush(func(msg wsMessage) error {
+			if err := pep.writeFrame(backendConn, envelope(msg)); err != nil {
+				return err
 			}
+			pep.recordDelivered(msg)
+			return nil
+		})
+	}
+	if pep.backendBuffer.Size() == 0 {
+		return nil
+	}
+	defer func() { atomic.StoreInt64(&pep.backendBufferedBytes, int64(pep.backendBuffer.Size())) }()
+	return pep.backendBuffer.Flush(func(payloadType byte, data []byte) error {
+		msg := wsMessage{payloadType: payloadType, data: data}
+		if err := pep.writeFrame(backendConn, msg); err != nil {
+			return err
 		}
+		pep.recordDelivered(msg)
+		return nil
+	})
+}
+
+// writeToClient Writes data from the backend to the client. When the pipe holds on for a client to come back, data is
+// kept in the client buffer while the client is away. Returns false once nothing more can be delivered to the client
+func (pep *PersistentPipe) writeToClient(msg wsMessage, errChan chan error, done chan struct{}) bool {
+	ok, clientErr := pep.writeOrBufferForClient(msg)
+	if clientErr != nil {
+		// Reported outside the client lock, the listener takes the same lock while handling it
+		sendErr(clientErr, errChan, done)
+	}
+	return ok
+}
+
+func (pep *PersistentPipe) writeOrBufferForClient(msg wsMessage) (bool, error) {
+	pep.clientMut.Lock()
+	defer pep.clientMut.Unlock()
+	if pep.clientQueue != nil {
+		return pep.queueForClient(msg)
+	}
+	var clientErr error
+	if pep.ClientErr == nil {
+		ew := pep.writeFrame(pep.ClientConn, msg)
+		if ew == nil {
+			return true, nil
+		}
+		pep.ClientErr = writeErr{error: ew, CopyDirection: CopyFromBacked}
+		clientErr = pep.ClientErr
+		if !pep.holdForClient {
+			return false, clientErr
+		}
+	}
+	bufferErr := pep.clientBuffer.Push(msg.payloadType, msg.data)
+	atomic.StoreInt64(&pep.clientBufferedBytes, int64(pep.clientBuffer.Size()))
+	if bufferErr != nil {
+		pep.clientBufferFull = true
+		err := writeErr{error: fmt.Errorf("client buffer reached max limit, exiting: %w", bufferErr), CopyDirection: CopyFromBacked}
+		log.Println(err)
+		return false, err
+	}
+	return true, clientErr
+}
+
+// sendClientErr Reports the error seen on the client connection to the listener, only the first one is reported
+func (pep *PersistentPipe) sendClientErr(err error, errChan chan error, done chan struct{}) {
+	if !pep.reportClientErr(err) {
+		return
+	}
+	sendErr(err, errChan, done)
+}
+
+// sendErr Hands the error over to the listener unless the stream is stopped meanwhile
+func sendErr(err error, errChan chan error, done chan struct{}) {
+	select {
+	case errChan <- err:
+	case <-done:
 	}
 }
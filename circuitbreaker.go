@@ -0,0 +1,157 @@
+package interruptible_websocket_proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState State of the circuit breaker of a backend
+type CircuitState int
+
+const (
+	// CircuitClosed Backend is handed out normally, errors are counted within the error window
+	CircuitClosed CircuitState = iota
+	// CircuitOpen Backend has seen too many errors within the window and is held back till its cooldown elapses
+	CircuitOpen
+	// CircuitHalfOpen Cooldown has elapsed and a single entry of the backend is handed out on trial, a success closes
+	// the circuit while an error opens it again with a doubled cooldown
+	CircuitHalfOpen
+)
+
+func (cs CircuitState) String() string {
+	switch cs {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// CircuitBreakerConfig Configuration of the circuit breaker kept for every backend
+type CircuitBreakerConfig struct {
+	// ErrorThreshold errors within the error window open the circuit, defaults to the max allowed error count of the pool
+	ErrorThreshold int64
+	// ErrorWindow errors older than this are forgotten, defaults to a minute
+	ErrorWindow time.Duration
+	// Cooldown a backend is held back for after its circuit opens, doubled every time a trial fails. Defaults to 2s
+	Cooldown time.Duration
+	// MaxCooldown caps the doubled cooldown, defaults to 5 minutes
+	MaxCooldown time.Duration
+}
+
+func (cc CircuitBreakerConfig) withDefaults(maxAllowedErrorCount int64) CircuitBreakerConfig {
+	if cc.ErrorThreshold <= 0 {
+		cc.ErrorThreshold = maxAllowedErrorCount
+	}
+	if cc.ErrorWindow <= 0 {
+		cc.ErrorWindow = time.Minute
+	}
+	if cc.Cooldown <= 0 {
+		cc.Cooldown = time.Second * 2
+	}
+	if cc.MaxCooldown <= 0 {
+		cc.MaxCooldown = time.Minute * 5
+	}
+	if cc.MaxCooldown < cc.Cooldown {
+		cc.MaxCooldown = cc.Cooldown
+	}
+	return cc
+}
+
+// circuitBreaker Error book keeping of a backend, errors are kept in a sliding window
+type circuitBreaker struct {
+	mut        sync.Mutex
+	state      CircuitState
+	errorTimes []time.Time
+	// trips consecutive times the circuit opened without a successful trial in between
+	trips int
+	// trialAt is when the entry on trial was readmitted while half open, the other errored entries are held back till
+	// the trial settles
+	trialAt time.Time
+}
+
+// recordFailure Counts an error at the given time, returns the errors within the window and the resulting state
+func (cb *circuitBreaker) recordFailure(at time.Time, config CircuitBreakerConfig) (int64, CircuitState) {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	cb.errorTimes = append(cb.pruneErrors(at, config), at)
+	switch {
+	case cb.state == CircuitHalfOpen:
+		cb.state = CircuitOpen
+		cb.trips++
+	case cb.state == CircuitClosed && int64(len(cb.errorTimes)) >= config.ErrorThreshold:
+		cb.state = CircuitOpen
+		cb.trips = 1
+	}
+	return int64(len(cb.errorTimes)), cb.state
+}
+
+// recordSuccess Closes the circuit after a successful trial
+func (cb *circuitBreaker) recordSuccess() {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	if cb.state == CircuitHalfOpen {
+		cb.state = CircuitClosed
+		cb.trips = 0
+		cb.errorTimes = nil
+	}
+}
+
+// tryReadmit Whether an errored entry of the backend can be handed out again, given the time of its last error.
+// An open circuit whose cooldown has elapsed turns half open and readmits the entry on trial, no other entry is
+// readmitted while half open unless the trial has not settled within another cooldown, as when the entry on trial was
+// discarded
+func (cb *circuitBreaker) tryReadmit(lastErrorAt time.Time, now time.Time, config CircuitBreakerConfig) bool {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(lastErrorAt) < cb.cooldown(config) {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		if now.Sub(cb.trialAt) < cb.cooldown(config) {
+			return false
+		}
+	default:
+		return true
+	}
+	cb.trialAt = now
+	return true
+}
+
+// cooldown Doubles with every consecutive trip, to be called with mut held
+func (cb *circuitBreaker) cooldown(config CircuitBreakerConfig) time.Duration {
+	cooldown := config.Cooldown
+	for i := 1; i < cb.trips && cooldown < config.MaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > config.MaxCooldown {
+		cooldown = config.MaxCooldown
+	}
+	return cooldown
+}
+
+// pruneErrors Drops errors which fell out of the window, to be called with mut held
+func (cb *circuitBreaker) pruneErrors(now time.Time, config CircuitBreakerConfig) []time.Time {
+	i := 0
+	for i < len(cb.errorTimes) && now.Sub(cb.errorTimes[i]) > config.ErrorWindow {
+		i++
+	}
+	return cb.errorTimes[i:]
+}
+
+// errorsWithin Number of errors within the window as of now
+func (cb *circuitBreaker) errorsWithin(now time.Time, config CircuitBreakerConfig) int {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	return len(cb.pruneErrors(now, config))
+}
+
+func (cb *circuitBreaker) currentState() CircuitState {
+	cb.mut.Lock()
+	defer cb.mut.Unlock()
+	return cb.state
+}
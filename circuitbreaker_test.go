@@ -0,0 +1,88 @@
+package interruptible_websocket_proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	config := CircuitBreakerConfig{ErrorThreshold: 2, ErrorWindow: time.Minute, Cooldown: time.Second}.withDefaults(0)
+	start := time.Now()
+
+	t.Run("ShouldForgetErrorsOutsideTheWindow", func(t *testing.T) {
+		cb := &circuitBreaker{}
+		count, state := cb.recordFailure(start, config)
+		assert.Equal(t, int64(1), count)
+		assert.Equal(t, CircuitClosed, state)
+
+		count, state = cb.recordFailure(start.Add(time.Minute*2), config)
+		assert.Equal(t, int64(1), count)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("ShouldOpenWhenThresholdIsReachedWithinTheWindow", func(t *testing.T) {
+		cb := &circuitBreaker{}
+		cb.recordFailure(start, config)
+		count, state := cb.recordFailure(start.Add(time.Second), config)
+		assert.Equal(t, int64(2), count)
+		assert.Equal(t, CircuitOpen, state)
+	})
+
+	t.Run("ShouldReadmitOnTrialAfterCooldownAndCloseOnSuccess", func(t *testing.T) {
+		cb := &circuitBreaker{}
+		cb.recordFailure(start, config)
+		lastErrorAt := start.Add(time.Second)
+		cb.recordFailure(lastErrorAt, config)
+
+		assert.False(t, cb.tryReadmit(lastErrorAt, lastErrorAt.Add(time.Millisecond*500), config))
+		assert.Equal(t, CircuitOpen, cb.currentState())
+		assert.True(t, cb.tryReadmit(lastErrorAt, lastErrorAt.Add(time.Second), config))
+		assert.Equal(t, CircuitHalfOpen, cb.currentState())
+
+		cb.recordSuccess()
+		assert.Equal(t, CircuitClosed, cb.currentState())
+		count, state := cb.recordFailure(lastErrorAt.Add(time.Second*2), config)
+		assert.Equal(t, int64(1), count)
+		assert.Equal(t, CircuitClosed, state)
+	})
+
+	t.Run("ShouldReadmitSingleEntryOnTrialWhileHalfOpen", func(t *testing.T) {
+		cb := &circuitBreaker{}
+		cb.recordFailure(start, config)
+		cb.recordFailure(start, config)
+
+		trialAt := start.Add(time.Second)
+		assert.True(t, cb.tryReadmit(start, trialAt, config))
+		assert.False(t, cb.tryReadmit(start, trialAt, config))
+		assert.False(t, cb.tryReadmit(start, trialAt.Add(time.Millisecond*500), config))
+		assert.Equal(t, CircuitHalfOpen, cb.currentState())
+
+		// Another entry goes on trial if the first one did not settle within a cooldown
+		assert.True(t, cb.tryReadmit(start, trialAt.Add(time.Second), config))
+
+		cb.recordSuccess()
+		assert.True(t, cb.tryReadmit(start, trialAt.Add(time.Second), config))
+	})
+
+	t.Run("ShouldDoubleCooldownEveryTimeTrialFails", func(t *testing.T) {
+		cb := &circuitBreaker{}
+		cb.recordFailure(start, config)
+		lastErrorAt := start
+		cb.recordFailure(lastErrorAt, config)
+
+		for _, cooldown := range []time.Duration{time.Second, time.Second * 2, time.Second * 4} {
+			assert.False(t, cb.tryReadmit(lastErrorAt, lastErrorAt.Add(cooldown-time.Millisecond), config))
+			assert.True(t, cb.tryReadmit(lastErrorAt, lastErrorAt.Add(cooldown), config))
+			lastErrorAt = lastErrorAt.Add(cooldown)
+			_, state := cb.recordFailure(lastErrorAt, config)
+			assert.Equal(t, CircuitOpen, state)
+		}
+	})
+
+	t.Run("ShouldCapCooldown", func(t *testing.T) {
+		capped := CircuitBreakerConfig{ErrorThreshold: 1, Cooldown: time.Second, MaxCooldown: time.Second * 3}.withDefaults(0)
+		cb := &circuitBreaker{state: CircuitOpen, trips: 10}
+		assert.Equal(t, time.Second*3, cb.cooldown(capped))
+	})
+}
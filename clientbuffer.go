@@ -0,0 +1,195 @@
+package interruptible_websocket_proxy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// OverflowPolicy Decides what happens to data from the backend which does not fit in the client buffer of a pipe
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect Closes the pipe, the client is disconnected
+	OverflowDisconnect OverflowPolicy = iota
+	// OverflowDropOldest Discards the oldest data held for the client to make room for the new data
+	OverflowDropOldest
+	// OverflowDropNewest Discards the new data, the data already held for the client is kept
+	OverflowDropNewest
+)
+
+// clientQueue Data from the backend waiting to be written to the client, by the writer routine of the pipe, guarded by
+// the clientMut of its pipe. writing is set while the oldest message is being written, it is not to be dropped then
+type clientQueue struct {
+	queue    messageQueue
+	limit    int
+	policy   OverflowPolicy
+	writing  bool
+	notEmpty chan struct{}
+}
+
+func newClientQueue(limit int, policy OverflowPolicy) *clientQueue {
+	return &clientQueue{limit: limit, policy: policy, notEmpty: make(chan struct{}, 1)}
+}
+
+// push Holds the message for the client, making room as the overflow policy says when it does not fit. Returns the
+// number of bytes dropped, or ErrPipeBufferFull when the policy is to disconnect
+func (cq *clientQueue) push(msg wsMessage) (int, error) {
+	dropped := 0
+	if cq.queue.size+len(msg.data) > cq.limit {
+		switch cq.policy {
+		case OverflowDropOldest:
+			keep, room := 0, cq.limit
+			if cq.writing {
+				keep, room = 1, cq.limit-len(cq.queue.messages[0].data)
+			}
+			if len(msg.data) > room {
+				// No room can be made for it
+				return len(msg.data), nil
+			}
+			for cq.queue.size+len(msg.data) > cq.limit {
+				dropped += len(cq.queue.messages[keep].data)
+				cq.queue.size -= len(cq.queue.messages[keep].data)
+				cq.queue.messages = append(cq.queue.messages[:keep], cq.queue.messages[keep+1:]...)
+			}
+		case OverflowDropNewest:
+			return len(msg.data), nil
+		default:
+			return 0, ErrPipeBufferFull
+		}
+	}
+	cq.queue.push(msg)
+	cq.wakeWriter()
+	return dropped, nil
+}
+
+// refuse Handles a message refused by the global memory limit as the overflow policy says, it is dropped unless the
+// policy is to disconnect
+func (cq *clientQueue) refuse(msg wsMessage) (int, error) {
+	if cq.policy == OverflowDisconnect {
+		return 0, ErrMemoryBudgetExceeded
+	}
+	return len(msg.data), nil
+}
+
+// wakeWriter Lets the writer routine know there may be something to write
+func (cq *clientQueue) wakeWriter() {
+	select {
+	case cq.notEmpty <- struct{}{}:
+	default:
+	}
+}
+
+// front Oldest message held, if any
+func (cq *clientQueue) front() (wsMessage, bool) {
+	if len(cq.queue.messages) == 0 {
+		return wsMessage{}, false
+	}
+	return cq.queue.messages[0], true
+}
+
+// pop Forgets the oldest message once it is written
+func (cq *clientQueue) pop() {
+	cq.queue.size -= len(cq.queue.messages[0].data)
+	cq.queue.messages[0] = wsMessage{}
+	cq.queue.messages = cq.queue.messages[1:]
+}
+
+// SetClientBuffering Makes pipes hold data from the backend for the client up to limitInBytes, and write it to the
+// client from a routine of their own. A slow client then no longer holds up reading from the backend, and the same
+// buffer holds data while the client is away during the reconnect grace period, in place of the interrupt buffer.
+// Data which does not fit is handled as the overflow policy says; dropping data only makes sense for message framed
+// pipes, see SetMessageFramedBuffering, as a dropped chunk of the raw byte stream corrupts it. Zero, the default,
+// writes to the client straight from the backend read loop. Applies to the pipes created afterwards
+func (pm *WebsocketPipeManager) SetClientBuffering(limitInBytes int, policy OverflowPolicy) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.clientBufferLimit = limitInBytes
+	pm.clientBufferOverflowPolicy = policy
+}
+
+// queueForClient Holds the message for the writer routine, returns false once nothing more can be delivered to the
+// client. To be called with clientMut held
+func (pep *PersistentPipe) queueForClient(msg wsMessage) (bool, error) {
+	if pep.ClientErr != nil && !pep.holdForClient {
+		return false, nil
+	}
+	var dropped int
+	var bufferErr error
+	if held := pep.clientQueue.queue.size; pep.reserveMemory(len(msg.data)) {
+		dropped, bufferErr = pep.clientQueue.push(msg)
+		pep.releaseMemory(len(msg.data) - (pep.clientQueue.queue.size - held))
+	} else {
+		dropped, bufferErr = pep.clientQueue.refuse(msg)
+	}
+	if dropped > 0 {
+		pep.metrics.observeDroppedBytes(CopyFromBacked, dropped)
+	}
+	atomic.StoreInt64(&pep.clientBufferedBytes, int64(pep.clientQueue.queue.size))
+	if bufferErr == nil {
+		return true, nil
+	}
+	pep.clientBufferFull = true
+	err := writeErr{error: fmt.Errorf("client buffer reached max limit, exiting: %w", bufferErr), CopyDirection: CopyFromBacked}
+	log.Println(err)
+	if pep.ClientErr == nil {
+		// Client is cut off while still attached
+		pep.ClientErr = err
+	}
+	return false, err
+}
+
+// writeQueuedToClient Writes the data held for the client as it comes, till the stream is stopped
+func (pep *PersistentPipe) writeQueuedToClient(errChan chan error, done chan struct{}) {
+	defer pep.copyWg.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-pep.clientQueue.notEmpty:
+		}
+		for !isStopped(done) && pep.writeOldestToClient(errChan, done) {
+		}
+	}
+}
+
+// writeOldestToClient Writes the oldest message held to the client, returns false if there is nothing to write or no
+// client to write to. The message is kept for a reconnecting client when the write fails
+func (pep *PersistentPipe) writeOldestToClient(errChan chan error, done chan struct{}) bool {
+	pep.clientMut.Lock()
+	msg, ok := pep.clientQueue.front()
+	if !ok || pep.ClientErr != nil {
+		pep.clientMut.Unlock()
+		return false
+	}
+	clientConn := pep.ClientConn
+	pep.clientQueue.writing = true
+	pep.clientMut.Unlock()
+
+	ew := pep.writeFrame(clientConn, msg)
+
+	pep.clientMut.Lock()
+	pep.clientQueue.writing = false
+	if ew == nil {
+		pep.releaseMemory(len(msg.data))
+		pep.clientQueue.pop()
+		atomic.StoreInt64(&pep.clientBufferedBytes, int64(pep.clientQueue.queue.size))
+		pep.clientMut.Unlock()
+		return true
+	}
+	if clientConn != pep.ClientConn {
+		// Written to a client which went away meanwhile, try again with the one attached since
+		pep.clientMut.Unlock()
+		return true
+	}
+	var clientErr error
+	if pep.ClientErr == nil {
+		pep.ClientErr = writeErr{error: ew, CopyDirection: CopyFromBacked}
+		clientErr = pep.ClientErr
+	}
+	pep.clientMut.Unlock()
+	if clientErr != nil {
+		sendErr(clientErr, errChan, done)
+	}
+	return false
+}
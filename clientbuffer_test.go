@@ -0,0 +1,125 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestClientQueue(t *testing.T) {
+	queued := func(cq *clientQueue) []string {
+		var data []string
+		for _, msg := range cq.queue.messages {
+			data = append(data, string(msg.data))
+		}
+		return data
+	}
+
+	t.Run("ShouldDisconnectOnOverflowByDefault", func(t *testing.T) {
+		cq := newClientQueue(8, OverflowDisconnect)
+		_, err := cq.push(wsMessage{data: []byte("first")})
+		assert.Nil(t, err)
+		_, err = cq.push(wsMessage{data: []byte("second")})
+		assert.Equal(t, ErrPipeBufferFull, err)
+		assert.Equal(t, []string{"first"}, queued(cq))
+	})
+
+	t.Run("ShouldDropNewestOnOverflow", func(t *testing.T) {
+		cq := newClientQueue(8, OverflowDropNewest)
+		_, _ = cq.push(wsMessage{data: []byte("first")})
+		dropped, err := cq.push(wsMessage{data: []byte("second")})
+		assert.Nil(t, err)
+		assert.Equal(t, len("second"), dropped)
+		assert.Equal(t, []string{"first"}, queued(cq))
+	})
+
+	t.Run("ShouldDropOldestOnOverflowExceptTheOneBeingWritten", func(t *testing.T) {
+		cq := newClientQueue(10, OverflowDropOldest)
+		for _, data := range []string{"aaa", "bbb", "ccc"} {
+			_, _ = cq.push(wsMessage{data: []byte(data)})
+		}
+		cq.writing = true
+		dropped, err := cq.push(wsMessage{data: []byte("dddd")})
+		assert.Nil(t, err)
+		assert.Equal(t, len("bbb"), dropped)
+		assert.Equal(t, []string{"aaa", "ccc", "dddd"}, queued(cq))
+		assert.Equal(t, 10, cq.queue.size)
+
+		// Nothing is dropped for a message which would not fit anyway
+		dropped, _ = cq.push(wsMessage{data: []byte("eeeeeeee")})
+		assert.Equal(t, len("eeeeeeee"), dropped)
+		assert.Equal(t, []string{"aaa", "ccc", "dddd"}, queued(cq))
+	})
+}
+
+func TestWebsocketPipeManager_SetClientBuffering(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldKeepReadingFromBackendWhileClientIsSlow", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetClientBuffering(10, OverflowDropOldest)
+		assert.Nil(t, pipeManager.AddConnectionToPool(expUrl))
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+
+		// Client reads nothing till the last reply is held, the first one is stuck being written meanwhile
+		_, err := clientPeer.Write([]byte("aaaa"))
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			value, ok := pipeManager.clientPipesMap.Load(clientId)
+			if !ok {
+				return false
+			}
+			persistentPipe := value.(*PersistentPipe)
+			persistentPipe.clientMut.Lock()
+			defer persistentPipe.clientMut.Unlock()
+			return persistentPipe.clientQueue.writing
+		}, time.Second*10, time.Millisecond*50)
+		for _, msg := range []string{"bbb", "cc", "dddddd"} {
+			_, err := clientPeer.Write([]byte(msg))
+			assert.Nil(t, err)
+		}
+		assert.Eventually(t, func() bool {
+			info, ok := pipeManager.Pipe(clientId)
+			return ok && info.BufferedToClientBytes == 10
+		}, time.Second*10, time.Millisecond*50)
+
+		buf := make([]byte, 64)
+		for _, expected := range []string{"aaaa", "dddddd"} {
+			n, err := clientPeer.Read(buf)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, string(buf[:n]))
+		}
+		assertEcho(t, clientPeer, "caught up")
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+
+	t.Run("ShouldClosePipeOnOverflowWhenPolicyIsToDisconnect", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetClientBuffering(10, OverflowDisconnect)
+		assert.Nil(t, pipeManager.AddConnectionToPool(expUrl))
+		clientPeer, pipeErr := startTestPipe(pipeManager, uuid.New())
+		defer clientPeer.Close()
+
+		for _, msg := range []string{"aaaa", "bbbb", "cccc"} {
+			_, err := clientPeer.Write([]byte(msg))
+			assert.Nil(t, err)
+		}
+		select {
+		case err := <-pipeErr:
+			assert.ErrorContains(t, err, "client buffer reached max limit")
+		case <-time.After(time.Second * 10):
+			t.Fatal("pipe was not closed on overflow")
+		}
+		assert.Equal(t, 0, pool.InUseCount(expUrl))
+	})
+}
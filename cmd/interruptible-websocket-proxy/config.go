@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	proxy "github.com/krishnakumar4a4/interruptible-websocket-proxy"
+	"golang.org/x/net/websocket"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Config Configuration of the proxy binary, read from a YAML file. JSON being a subset of YAML, a JSON file with the
+// same keys works as well. Durations are given as strings, e.g. "30s" or "5m"
+type Config struct {
+	ListenAddress string `yaml:"listen_address"`
+	// TLS serves the proxy over https/wss when both files are set
+	TLS      TLSConfig       `yaml:"tls"`
+	LogLevel string          `yaml:"log_level"`
+	Backends []BackendConfig `yaml:"backends"`
+	Handler  HandlerConfig   `yaml:"handler"`
+	Dialer   DialerConfig    `yaml:"dialer"`
+	Metrics  MetricsConfig   `yaml:"metrics"`
+	Admin    AdminConfig     `yaml:"admin"`
+	// ShutdownTimeout bounds how long pipes are waited for on SIGINT/SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type BackendConfig struct {
+	Url      string `yaml:"url"`
+	Capacity int    `yaml:"capacity"`
+	Weight   int    `yaml:"weight"`
+}
+
+// HandlerConfig Values of proxy.HandlerConfig which can be set from a file
+type HandlerConfig struct {
+	MaxIdleConnCount                   int64                `yaml:"max_idle_conn_count"`
+	MaxAllowedErrorCountPerConn        int64                `yaml:"max_allowed_error_count_per_conn"`
+	InterruptMemoryLimitPerConnInBytes int                  `yaml:"interrupt_memory_limit_per_conn_in_bytes"`
+	InterruptDiskLimitPerConnInBytes   int                  `yaml:"interrupt_disk_limit_per_conn_in_bytes"`
+	InterruptSpillDirectory            string               `yaml:"interrupt_spill_directory"`
+	ClientBufferLimitInBytes           int                  `yaml:"client_buffer_limit_in_bytes"`
+	ClientBufferOverflowPolicy         string               `yaml:"client_buffer_overflow_policy"`
+	GlobalMemoryLimitInBytes           int                  `yaml:"global_memory_limit_in_bytes"`
+	GlobalMemoryExhaustionPolicy       string               `yaml:"global_memory_exhaustion_policy"`
+	BackendReleasePolicy               string               `yaml:"backend_release_policy"`
+	ClientReconnectGracePeriod         time.Duration        `yaml:"client_reconnect_grace_period"`
+	BackendAffinityTTL                 time.Duration        `yaml:"backend_affinity_ttl"`
+	MaxBackendWaitTime                 time.Duration        `yaml:"max_backend_wait_time"`
+	MessageFramedBuffering             bool                 `yaml:"message_framed_buffering"`
+	ReliableDelivery                   bool                 `yaml:"reliable_delivery"`
+	ForwardedHeaders                   []string             `yaml:"forwarded_headers"`
+	ForwardClientPath                  bool                 `yaml:"forward_client_path"`
+	BalancerStrategy                   string               `yaml:"balancer_strategy"`
+	CircuitBreaker                     CircuitBreakerConfig `yaml:"circuit_breaker"`
+	HealthCheck                        *HealthCheckConfig   `yaml:"health_check"`
+	Bootstrap                          *BootstrapConfig     `yaml:"bootstrap"`
+	// WarmConnections is not supported, the proxy forwards the client handshake on every dial. It is only read to
+	// reject a config setting it
+	WarmConnections any `yaml:"warm_connections"`
+}
+
+type CircuitBreakerConfig struct {
+	ErrorThreshold int64         `yaml:"error_threshold"`
+	ErrorWindow    time.Duration `yaml:"error_window"`
+	Cooldown       time.Duration `yaml:"cooldown"`
+	MaxCooldown    time.Duration `yaml:"max_cooldown"`
+}
+
+type HealthCheckConfig struct {
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	// HTTPPath probes backends with a GET request to the path instead of a websocket handshake
+	HTTPPath string `yaml:"http_path"`
+}
+
+// BootstrapConfig Requires message framed buffering, first messages and prefixes are counted and matched against whole
+// websocket messages
+type BootstrapConfig struct {
+	FirstMessages int `yaml:"first_messages"`
+	MaxBytes      int `yaml:"max_bytes"`
+	// MatchPrefixes records any other message starting with one of the prefixes
+	MatchPrefixes []string `yaml:"match_prefixes"`
+}
+
+// DialerConfig Template of the websocket config used to dial backends
+type DialerConfig struct {
+	Timeout   time.Duration     `yaml:"timeout"`
+	Origin    string            `yaml:"origin"`
+	Protocols []string          `yaml:"protocols"`
+	Headers   map[string]string `yaml:"headers"`
+	// CAFile verifies wss:// backends against the given CA bundle instead of the system roots
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// MetricsConfig Serves prometheus metrics on Path of the listen address when Path is set
+type MetricsConfig struct {
+	Namespace string `yaml:"namespace"`
+	Path      string `yaml:"path"`
+}
+
+// AdminConfig Serves the admin endpoints on ListenAddress when it is set. The endpoints are not authenticated, the
+// address is meant to be reachable from within the deployment only
+type AdminConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+}
+
+// loadConfig Reads and validates the config file, unset values take their defaults
+func loadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = ":8080"
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = time.Second * 30
+	}
+	if config.Handler.MaxIdleConnCount <= 0 {
+		config.Handler.MaxIdleConnCount = 5
+	}
+	if config.Handler.MaxAllowedErrorCountPerConn <= 0 {
+		config.Handler.MaxAllowedErrorCountPerConn = 100
+	}
+	if config.Handler.InterruptMemoryLimitPerConnInBytes <= 0 {
+		config.Handler.InterruptMemoryLimitPerConnInBytes = 5 * 1024 * 1024
+	}
+	if config.Metrics.Namespace == "" {
+		config.Metrics.Namespace = "interruptible_websocket_proxy"
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("both tls cert_file and key_file are required to serve over tls")
+	}
+	if _, err := config.Handler.releasePolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Handler.balancerStrategy(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Handler.clientBufferOverflowPolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Handler.globalMemoryExhaustionPolicy(); err != nil {
+		return nil, err
+	}
+	if config.Admin.ListenAddress != "" && config.Admin.ListenAddress == config.ListenAddress {
+		return nil, fmt.Errorf("admin listen_address has to differ from the proxy listen_address")
+	}
+	if config.Handler.ReliableDelivery && !config.Handler.MessageFramedBuffering {
+		return nil, fmt.Errorf("reliable_delivery requires message_framed_buffering")
+	}
+	if config.Handler.Bootstrap != nil && !config.Handler.MessageFramedBuffering {
+		return nil, fmt.Errorf("bootstrap requires message_framed_buffering")
+	}
+	if config.Handler.WarmConnections != nil {
+		return nil, fmt.Errorf("warm_connections are not supported, the proxy forwards the client handshake on every dial")
+	}
+	if config.Handler.HealthCheck != nil && config.Handler.HealthCheck.Interval <= 0 {
+		return nil, fmt.Errorf("health_check interval is required")
+	}
+	seen := map[string]bool{}
+	for _, backend := range config.Backends {
+		if backend.Url == "" {
+			return nil, fmt.Errorf("backend url is required")
+		}
+		if seen[backend.Url] {
+			return nil, fmt.Errorf("backend url: %s is listed more than once", backend.Url)
+		}
+		seen[backend.Url] = true
+	}
+	return config, nil
+}
+
+// handlerConfig Builds the proxy.HandlerConfig, metrics are only set when they are served
+func (c *Config) handlerConfig() (proxy.HandlerConfig, error) {
+	hc := c.Handler
+	releasePolicy, _ := hc.releasePolicy()
+	strategy, _ := hc.balancerStrategy()
+	overflowPolicy, _ := hc.clientBufferOverflowPolicy()
+	exhaustionPolicy, _ := hc.globalMemoryExhaustionPolicy()
+	dialer, err := c.Dialer.dialer()
+	if err != nil {
+		return proxy.HandlerConfig{}, err
+	}
+	backends := make(map[string]proxy.BackendOptions, len(c.Backends))
+	for _, backend := range c.Backends {
+		backends[backend.Url] = proxy.BackendOptions{Capacity: backend.Capacity, Weight: backend.Weight}
+	}
+	handlerConfig := proxy.HandlerConfig{
+		Backends:                    backends,
+		MaxIdleConnCount:            hc.MaxIdleConnCount,
+		MaxAllowedErrorCountPerConn: hc.MaxAllowedErrorCountPerConn,
+		CircuitBreaker: proxy.CircuitBreakerConfig{
+			ErrorThreshold: hc.CircuitBreaker.ErrorThreshold,
+			ErrorWindow:    hc.CircuitBreaker.ErrorWindow,
+			Cooldown:       hc.CircuitBreaker.Cooldown,
+			MaxCooldown:    hc.CircuitBreaker.MaxCooldown,
+		},
+		InterruptMemoryLimitPerConnInBytes: hc.InterruptMemoryLimitPerConnInBytes,
+		ClientBufferLimitInBytes:           hc.ClientBufferLimitInBytes,
+		ClientBufferOverflowPolicy:         overflowPolicy,
+		GlobalMemoryLimitInBytes:           hc.GlobalMemoryLimitInBytes,
+		GlobalMemoryExhaustionPolicy:       exhaustionPolicy,
+		BackendReleasePolicy:               releasePolicy,
+		ClientReconnectGracePeriod:         hc.ClientReconnectGracePeriod,
+		BackendAffinityTTL:                 hc.BackendAffinityTTL,
+		MaxBackendWaitTime:                 hc.MaxBackendWaitTime,
+		BackendDialer:                      dialer,
+		BalancerStrategy:                   strategy,
+		ForwardedHeaders:                   hc.ForwardedHeaders,
+		ForwardClientPath:                  hc.ForwardClientPath,
+		MessageFramedBuffering:             hc.MessageFramedBuffering,
+		ReliableDelivery:                   hc.ReliableDelivery,
+		InterruptDiskLimitPerConnInBytes:   hc.InterruptDiskLimitPerConnInBytes,
+		InterruptSpillDirectory:            hc.InterruptSpillDirectory,
+	}
+	if hc.HealthCheck != nil {
+		healthCheck := &proxy.HealthCheckConfig{
+			Interval:           hc.HealthCheck.Interval,
+			Timeout:            hc.HealthCheck.Timeout,
+			UnhealthyThreshold: hc.HealthCheck.UnhealthyThreshold,
+			HealthyThreshold:   hc.HealthCheck.HealthyThreshold,
+		}
+		if hc.HealthCheck.HTTPPath != "" {
+			healthCheck.Probe = proxy.NewHTTPHealthProbe(nil, hc.HealthCheck.HTTPPath)
+		}
+		handlerConfig.HealthCheck = healthCheck
+	}
+	if hc.Bootstrap != nil {
+		handlerConfig.Bootstrap = hc.Bootstrap.bootstrapConfig()
+	}
+	if c.Metrics.Path != "" {
+		handlerConfig.Metrics = proxy.NewMetrics(c.Metrics.Namespace)
+	}
+	return handlerConfig, nil
+}
+
+// reloadedHandlerConfig Builds the proxy.HandlerConfig for a reload. Values built from sections of the file which did
+// not change since the previous config are carried over, so that they are not reported as changed and a stateful
+// balancer strategy keeps its state
+func (c *Config) reloadedHandlerConfig(previous *Config, previousHandlerConfig proxy.HandlerConfig) (proxy.HandlerConfig, error) {
+	handlerConfig, err := c.handlerConfig()
+	if err != nil {
+		return handlerConfig, err
+	}
+	if c.Handler.BalancerStrategy == previous.Handler.BalancerStrategy {
+		handlerConfig.BalancerStrategy = previousHandlerConfig.BalancerStrategy
+	}
+	if reflect.DeepEqual(c.Dialer, previous.Dialer) {
+		handlerConfig.BackendDialer = previousHandlerConfig.BackendDialer
+	}
+	if reflect.DeepEqual(c.Handler.HealthCheck, previous.Handler.HealthCheck) {
+		handlerConfig.HealthCheck = previousHandlerConfig.HealthCheck
+	}
+	if reflect.DeepEqual(c.Handler.Bootstrap, previous.Handler.Bootstrap) {
+		handlerConfig.Bootstrap = previousHandlerConfig.Bootstrap
+	}
+	if c.Metrics == previous.Metrics {
+		handlerConfig.Metrics = previousHandlerConfig.Metrics
+	}
+	return handlerConfig, nil
+}
+
+func (hc HandlerConfig) releasePolicy() (proxy.ReleasePolicy, error) {
+	switch hc.BackendReleasePolicy {
+	case "", "redial":
+		return proxy.ReleaseRedial, nil
+	case "reuse":
+		return proxy.ReleaseRedial, fmt.Errorf("backend_release_policy reuse is not supported, the proxy forwards the client handshake on every dial")
+	}
+	return proxy.ReleaseRedial, fmt.Errorf("unknown backend_release_policy: %s", hc.BackendReleasePolicy)
+}
+
+func (hc HandlerConfig) clientBufferOverflowPolicy() (proxy.OverflowPolicy, error) {
+	switch hc.ClientBufferOverflowPolicy {
+	case "", "disconnect":
+		return proxy.OverflowDisconnect, nil
+	case "drop_oldest":
+		return proxy.OverflowDropOldest, nil
+	case "drop_newest":
+		return proxy.OverflowDropNewest, nil
+	}
+	return proxy.OverflowDisconnect, fmt.Errorf("unknown client_buffer_overflow_policy: %s", hc.ClientBufferOverflowPolicy)
+}
+
+func (hc HandlerConfig) globalMemoryExhaustionPolicy() (proxy.MemoryExhaustionPolicy, error) {
+	switch hc.GlobalMemoryExhaustionPolicy {
+	case "", "reject_buffering":
+		return proxy.MemoryRejectBuffering, nil
+	case "evict_largest":
+		return proxy.MemoryEvictLargest, nil
+	case "refuse_clients":
+		return proxy.MemoryRefuseClients, nil
+	}
+	return proxy.MemoryRejectBuffering, fmt.Errorf("unknown global_memory_exhaustion_policy: %s", hc.GlobalMemoryExhaustionPolicy)
+}
+
+// balancerStrategy Strategy by name, nil for the default of handing out the backend idle the longest
+func (hc HandlerConfig) balancerStrategy() (proxy.BalancerStrategy, error) {
+	switch hc.BalancerStrategy {
+	case "":
+		return nil, nil
+	case "round_robin":
+		return proxy.NewRoundRobinStrategy(), nil
+	case "least_connections":
+		return proxy.NewLeastConnectionsStrategy(), nil
+	case "random_two_choices":
+		return proxy.NewRandomTwoChoicesStrategy(), nil
+	case "weighted":
+		return proxy.NewWeightedStrategy(), nil
+	case "consistent_hash":
+		return proxy.NewConsistentHashStrategy(), nil
+	}
+	return nil, fmt.Errorf("unknown balancer_strategy: %s", hc.BalancerStrategy)
+}
+
+func (bc BootstrapConfig) bootstrapConfig() *proxy.BootstrapConfig {
+	config := &proxy.BootstrapConfig{FirstMessages: bc.FirstMessages, MaxBytes: bc.MaxBytes}
+	if len(bc.MatchPrefixes) > 0 {
+		prefixes := bc.MatchPrefixes
+		config.Match = func(data []byte) bool {
+			for _, prefix := range prefixes {
+				if bytes.HasPrefix(data, []byte(prefix)) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return config
+}
+
+func (dc DialerConfig) dialer() (*proxy.WebsocketDialer, error) {
+	template := websocket.Config{Protocol: dc.Protocols}
+	if dc.Origin != "" {
+		origin, err := url.Parse(dc.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dialer origin: %w", err)
+		}
+		template.Origin = origin
+	}
+	if len(dc.Headers) > 0 {
+		template.Header = http.Header{}
+		for name, value := range dc.Headers {
+			template.Header.Set(name, value)
+		}
+	}
+	if dc.CAFile != "" || dc.InsecureSkipVerify {
+		template.TlsConfig = &tls.Config{InsecureSkipVerify: dc.InsecureSkipVerify}
+		if dc.CAFile != "" {
+			caBundle, err := os.ReadFile(dc.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(caBundle) {
+				return nil, fmt.Errorf("no certificates found in dialer ca_file: %s", dc.CAFile)
+			}
+			template.TlsConfig.RootCAs = roots
+		}
+	}
+	return proxy.NewWebsocketDialer(template, dc.Timeout), nil
+}
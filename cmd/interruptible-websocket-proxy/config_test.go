@@ -0,0 +1,110 @@
+package main
+
+import (
+	proxy "github.com/krishnakumar4a4/interruptible-websocket-proxy"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("ShouldLoadExampleConfig", func(t *testing.T) {
+		config, err := loadConfig("config.example.yaml")
+		assert.Nil(t, err)
+		assert.Equal(t, ":8080", config.ListenAddress)
+		assert.Equal(t, []BackendConfig{
+			{Url: "ws://localhost:8081/listener"},
+			{Url: "ws://localhost:8082/listener", Capacity: 10, Weight: 2},
+		}, config.Backends)
+		assert.Equal(t, time.Second*30, config.Handler.ClientReconnectGracePeriod)
+		assert.Equal(t, "127.0.0.1:8090", config.Admin.ListenAddress)
+
+		handlerConfig, err := config.handlerConfig()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(20), handlerConfig.MaxIdleConnCount)
+		assert.Equal(t, proxy.ReleaseRedial, handlerConfig.BackendReleasePolicy)
+		assert.Equal(t, 1024*1024, handlerConfig.ClientBufferLimitInBytes)
+		assert.Equal(t, proxy.OverflowDisconnect, handlerConfig.ClientBufferOverflowPolicy)
+		assert.Equal(t, 512*1024*1024, handlerConfig.GlobalMemoryLimitInBytes)
+		assert.Equal(t, proxy.MemoryRefuseClients, handlerConfig.GlobalMemoryExhaustionPolicy)
+		assert.Equal(t, time.Minute*10, handlerConfig.BackendAffinityTTL)
+		assert.Equal(t, proxy.NewLeastConnectionsStrategy(), handlerConfig.BalancerStrategy)
+		assert.Equal(t, time.Second*10, handlerConfig.HealthCheck.Interval)
+		assert.Equal(t, 1, handlerConfig.Bootstrap.FirstMessages)
+		assert.True(t, handlerConfig.Bootstrap.Match([]byte(`{"type":"subscribe","topic":"prices"}`)))
+		assert.False(t, handlerConfig.Bootstrap.Match([]byte(`{"type":"ping"}`)))
+		assert.NotNil(t, handlerConfig.HealthCheck.Probe)
+		assert.NotNil(t, handlerConfig.Metrics)
+		dialer := handlerConfig.BackendDialer.(*proxy.WebsocketDialer)
+		assert.Equal(t, "interruptible-websocket-proxy", dialer.Config.Header.Get("X-Proxy"))
+	})
+
+	t.Run("ShouldLoadJSONAndApplyDefaults", func(t *testing.T) {
+		path := writeConfigFile(t, "config.json", `{"backends": [{"url": "ws://localhost:8081"}], "handler": {"max_backend_wait_time": "5s"}}`)
+		config, err := loadConfig(path)
+		assert.Nil(t, err)
+		assert.Equal(t, ":8080", config.ListenAddress)
+		assert.Equal(t, "info", config.LogLevel)
+		assert.Equal(t, time.Second*30, config.ShutdownTimeout)
+		assert.Equal(t, time.Second*5, config.Handler.MaxBackendWaitTime)
+		assert.Equal(t, 5*1024*1024, config.Handler.InterruptMemoryLimitPerConnInBytes)
+
+		handlerConfig, err := config.handlerConfig()
+		assert.Nil(t, err)
+		assert.Nil(t, handlerConfig.BalancerStrategy)
+		assert.Nil(t, handlerConfig.HealthCheck)
+		assert.Nil(t, handlerConfig.Metrics)
+	})
+
+	t.Run("ShouldRejectInvalidConfig", func(t *testing.T) {
+		for _, content := range []string{
+			`handler: {balancer_strategy: fastest}`,
+			`handler: {backend_release_policy: keep}`,
+			`handler: {backend_release_policy: reuse}`,
+			`handler: {client_buffer_overflow_policy: drop_all}`,
+			`handler: {global_memory_exhaustion_policy: swap}`,
+			`handler: {health_check: {timeout: 1s}}`,
+			`tls: {cert_file: tls.crt}`,
+			`backends: [{capacity: 2}]`,
+			`listen_address: [`,
+			`admin: {listen_address: ":8080"}`,
+			`handler: {reliable_delivery: true}`,
+			`handler: {bootstrap: {first_messages: 1}}`,
+			`handler: {warm_connections: {ping_interval: 10s}}`,
+		} {
+			_, err := loadConfig(writeConfigFile(t, "config.yaml", content))
+			assert.NotNil(t, err, content)
+		}
+	})
+}
+
+func TestConfig_ReloadedHandlerConfig(t *testing.T) {
+	t.Run("ShouldCarryOverValuesOfUnchangedSections", func(t *testing.T) {
+		previous, err := loadConfig(writeConfigFile(t, "config.yaml", `{handler: {balancer_strategy: round_robin}, metrics: {path: /metrics}}`))
+		assert.Nil(t, err)
+		previousHandlerConfig, err := previous.handlerConfig()
+		assert.Nil(t, err)
+
+		next, err := loadConfig(writeConfigFile(t, "config.yaml", `{handler: {balancer_strategy: round_robin, max_idle_conn_count: 10}, metrics: {path: /metrics}}`))
+		assert.Nil(t, err)
+		handlerConfig, err := next.reloadedHandlerConfig(previous, previousHandlerConfig)
+		assert.Nil(t, err)
+		assert.Same(t, previousHandlerConfig.BalancerStrategy, handlerConfig.BalancerStrategy)
+		assert.Same(t, previousHandlerConfig.BackendDialer, handlerConfig.BackendDialer)
+		assert.Same(t, previousHandlerConfig.Metrics, handlerConfig.Metrics)
+		assert.Equal(t, int64(10), handlerConfig.MaxIdleConnCount)
+
+		next.Handler.BalancerStrategy = "weighted"
+		handlerConfig, err = next.reloadedHandlerConfig(previous, previousHandlerConfig)
+		assert.Nil(t, err)
+		assert.Equal(t, proxy.NewWeightedStrategy(), handlerConfig.BalancerStrategy)
+	})
+}
@@ -0,0 +1,181 @@
+// Command interruptible-websocket-proxy Runs the interruptible websocket proxy as a standalone binary configured from a
+// YAML or JSON file, see Config for the available settings.
+//
+// E.g:
+//
+//	interruptible-websocket-proxy -config /etc/interruptible-websocket-proxy/config.yaml
+//
+// SIGINT and SIGTERM shut the proxy down gracefully, pipes are waited for up to the configured shutdown timeout.
+// SIGHUP reloads the config file, see InterruptibleWebsocketProxyHandler.Reload for the settings applied
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	proxy "github.com/krishnakumar4a4/interruptible-websocket-proxy"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// zapLogger Adapts a zap logger to the logger of the proxy
+type zapLogger struct {
+	logger *zap.Logger
+}
+
+func (zl *zapLogger) Warn(msg string, nestedErr error) {
+	zl.logger.Warn(msg, zap.Error(nestedErr))
+}
+
+func (zl *zapLogger) Error(msg string, nestedErr error) {
+	zl.logger.Error(msg, zap.Error(nestedErr))
+}
+
+func (zl *zapLogger) Debug(msg string) {
+	zl.logger.Debug(msg)
+}
+
+// newLogger Creates a logger whose level can be changed later through the returned level
+func newLogger(level string) (*zap.Logger, zap.AtomicLevel, error) {
+	atomicLevel, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, atomicLevel, err
+	}
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = atomicLevel
+	logger, err := loggerConfig.Build()
+	return logger, atomicLevel, err
+}
+
+func main() {
+	configPath := flag.String("config", "config.yaml", "path of the YAML or JSON config file")
+	flag.Parse()
+	if err := run(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	zl, logLevel, err := newLogger(config.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log_level: %w", err)
+	}
+	defer zl.Sync()
+	// Callers of the adapter are reported instead of the adapter itself
+	lgr := &zapLogger{logger: zl.WithOptions(zap.AddCallerSkip(1))}
+
+	handlerConfig, err := config.handlerConfig()
+	if err != nil {
+		return err
+	}
+	handler := proxy.NewInterruptibleWebsocketProxyHandler(websocket.Config{}, handlerConfig, lgr)
+
+	mux := http.NewServeMux()
+	if handlerConfig.Metrics != nil {
+		mux.Handle(config.Metrics.Path, handlerConfig.Metrics.Handler())
+	}
+	mux.Handle("/", handler)
+	server := &http.Server{Addr: config.ListenAddress, Handler: mux}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		zl.Info("starting proxy", zap.String("address", config.ListenAddress), zap.Int("backends", len(config.Backends)))
+		if config.TLS.CertFile != "" {
+			serveErr <- server.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	var adminServer *http.Server
+	if config.Admin.ListenAddress != "" {
+		adminServer = &http.Server{Addr: config.Admin.ListenAddress, Handler: handler.AdminHandler()}
+		go func() {
+			zl.Info("starting admin endpoints", zap.String("address", config.Admin.ListenAddress))
+			serveErr <- adminServer.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for running := true; running; {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				config, handlerConfig = reload(configPath, config, handlerConfig, handler, logLevel, zl)
+				continue
+			}
+			zl.Info("shutting down proxy", zap.String("signal", sig.String()))
+			running = false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	// Stop accepting new clients first, hijacked websocket connections are left to the handler
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		lgr.Warn("error shutting down http server", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lgr.Warn("error shutting down admin server", err)
+		}
+	}
+	if err := handler.Shutdown(ctx); err != nil {
+		lgr.Warn("pipes did not finish within shutdown timeout", err)
+	}
+	return nil
+}
+
+// reload Reads the config file again and applies it to the running handler, the current config stays in effect if the
+// file cannot be loaded. Returns the config in effect afterwards
+func reload(configPath string, current *Config, currentHandlerConfig proxy.HandlerConfig,
+	handler *proxy.InterruptibleWebsocketProxyHandler, logLevel zap.AtomicLevel, zl *zap.Logger) (*Config, proxy.HandlerConfig) {
+	next, err := loadConfig(configPath)
+	if err == nil {
+		err = logLevel.UnmarshalText([]byte(next.LogLevel))
+	}
+	if err != nil {
+		zl.Error("error reloading config, keeping the current one", zap.Error(err))
+		return current, currentHandlerConfig
+	}
+	handlerConfig, err := next.reloadedHandlerConfig(current, currentHandlerConfig)
+	if err != nil {
+		zl.Error("error reloading config, keeping the current one", zap.Error(err))
+		return current, currentHandlerConfig
+	}
+	report, err := handler.Reload(handlerConfig)
+	if err != nil {
+		zl.Error("error applying reloaded config", zap.Error(err))
+	}
+	var requiresRestart []string
+	if next.ListenAddress != current.ListenAddress {
+		requiresRestart = append(requiresRestart, "listen_address")
+	}
+	if next.TLS != current.TLS {
+		requiresRestart = append(requiresRestart, "tls")
+	}
+	if next.Admin != current.Admin {
+		requiresRestart = append(requiresRestart, "admin")
+	}
+	zl.Info("reloaded config", zap.Strings("immediate", report.Immediate), zap.Strings("new_pipes_only", report.NewPipesOnly),
+		zap.Strings("requires_restart", append(requiresRestart, report.RequiresRestart...)))
+	// Settings requiring a restart are kept as they are running, so the next reload compares against those
+	next.ListenAddress, next.TLS, next.Metrics, next.Admin = current.ListenAddress, current.TLS, current.Metrics, current.Admin
+	next.Handler.HealthCheck = current.Handler.HealthCheck
+	handlerConfig.Metrics, handlerConfig.Discoverer = currentHandlerConfig.Metrics, currentHandlerConfig.Discoverer
+	handlerConfig.HealthCheck = currentHandlerConfig.HealthCheck
+	return next, handlerConfig
+}
@@ -0,0 +1,147 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BackendDialer Opens the connection to a backend url whenever the pool needs a fresh one
+type BackendDialer interface {
+	Dial(ctx context.Context, backendUrl string) (net.Conn, error)
+}
+
+// WebsocketDialer Default BackendDialer. Every dial uses a copy of the Config template with the location set to the
+// backend url, so the origin, subprotocols, extra headers, TLS config (for wss://) and net dialer of the template
+// apply to every backend. The origin defaults to the scheme and host of the backend url when the template has none.
+// Headers of a ClientHandshake found in the context are added on top of the template headers, its path is appended to
+// the path of the backend url and its query added to the query of the backend url
+type WebsocketDialer struct {
+	Config websocket.Config
+	// Timeout Bounds the whole dial including the websocket handshake, zero leaves it to the context
+	Timeout time.Duration
+}
+
+// NewWebsocketDialer Creates a dialer with the given config template and dial timeout
+func NewWebsocketDialer(template websocket.Config, timeout time.Duration) *WebsocketDialer {
+	return &WebsocketDialer{Config: template, Timeout: timeout}
+}
+
+func (wd *WebsocketDialer) Dial(ctx context.Context, backendUrl string) (net.Conn, error) {
+	config, err := wd.configFor(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	if handshake, ok := ClientHandshakeFromContext(ctx); ok {
+		if config.Header == nil {
+			config.Header = http.Header{}
+		}
+		for name, values := range handshake.Header {
+			config.Header[name] = values
+		}
+		config.Location = locationFor(config.Location, handshake)
+	}
+	if wd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wd.Timeout)
+		defer cancel()
+	}
+	netConn, err := dialNetConn(ctx, config)
+	if err != nil {
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+
+	// The handshake does not take a context, a deadline and a watcher closing the connection bound it instead
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	ws, err := websocket.NewClient(config, netConn)
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+	netConn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// configFor Copies the template for the given backend url
+func (wd *WebsocketDialer) configFor(backendUrl string) (*websocket.Config, error) {
+	location, err := url.Parse(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme != "ws" && location.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported scheme for backend url %s", backendUrl)
+	}
+	config := wd.Config
+	config.Location = location
+	if config.Origin == nil {
+		originScheme := "http"
+		if location.Scheme == "wss" {
+			originScheme = "https"
+		}
+		config.Origin = &url.URL{Scheme: originScheme, Host: location.Host}
+	}
+	if config.Version == 0 {
+		config.Version = websocket.ProtocolVersionHybi13
+	}
+	config.Header = wd.Config.Header.Clone()
+	return &config, nil
+}
+
+// locationFor Backend url with the path of the client handshake appended to its path and the query of the handshake
+// added to its query, the way a reverse proxy rewrites a request
+func locationFor(backendUrl *url.URL, handshake *ClientHandshake) *url.URL {
+	location := *backendUrl
+	if handshake.Path != "" {
+		location.Path = strings.TrimSuffix(location.Path, "/") + "/" + strings.TrimPrefix(handshake.Path, "/")
+		location.RawPath = ""
+	}
+	switch {
+	case handshake.RawQuery == "":
+	case location.RawQuery == "":
+		location.RawQuery = handshake.RawQuery
+	default:
+		location.RawQuery += "&" + handshake.RawQuery
+	}
+	return &location
+}
+
+// dialNetConn Opens the underlying tcp connection, wrapped in TLS for wss://
+func dialNetConn(ctx context.Context, config *websocket.Config) (net.Conn, error) {
+	netDialer := config.Dialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+	address := config.Location.Host
+	if config.Location.Port() == "" {
+		if config.Location.Scheme == "wss" {
+			address = net.JoinHostPort(config.Location.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(config.Location.Hostname(), "80")
+		}
+	}
+	if config.Location.Scheme == "wss" {
+		tlsDialer := &tls.Dialer{NetDialer: netDialer, Config: config.TlsConfig}
+		return tlsDialer.DialContext(ctx, "tcp", address)
+	}
+	return netDialer.DialContext(ctx, "tcp", address)
+}
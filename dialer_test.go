@@ -0,0 +1,106 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketDialer_Dial(t *testing.T) {
+	t.Run("ShouldSendHeadersSubprotocolsAndOriginOfTemplate", func(t *testing.T) {
+		handshake := make(chan *websocket.Config, 1)
+		server := httptest.NewServer(websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				config.Header = r.Header
+				handshake <- config
+				return nil
+			},
+			Handler: func(c *websocket.Conn) {},
+		})
+		defer server.Close()
+
+		dialer := NewWebsocketDialer(websocket.Config{
+			Protocol: []string{"chat"},
+			Header:   http.Header{"Authorization": []string{"Bearer token"}},
+		}, time.Second)
+		conn, err := dialer.Dial(context.Background(), testBackendUrl(server))
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		config := <-handshake
+		assert.Equal(t, []string{"chat"}, config.Protocol)
+		assert.Equal(t, "Bearer token", config.Header.Get("Authorization"))
+		assert.Equal(t, "http://"+strings.TrimPrefix(testBackendUrl(server), "ws://"), config.Header.Get("Origin"))
+	})
+
+	t.Run("ShouldAppendPathAndQueryOfClientHandshake", func(t *testing.T) {
+		requestUri := make(chan string, 1)
+		server := httptest.NewServer(websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				requestUri <- r.URL.RequestURI()
+				return nil
+			},
+			Handler: func(c *websocket.Conn) {},
+		})
+		defer server.Close()
+
+		dialer := NewWebsocketDialer(websocket.Config{}, time.Second)
+		ctx := WithClientHandshake(context.Background(), &ClientHandshake{Path: "/chat/room", RawQuery: "user=1"})
+		conn, err := dialer.Dial(ctx, testBackendUrl(server)+"/ws/?region=eu")
+		assert.Nil(t, err)
+		defer conn.Close()
+		assert.Equal(t, "/ws/chat/room?region=eu&user=1", <-requestUri)
+	})
+
+	t.Run("ShouldDialTLSBackendWithTemplateTLSConfig", func(t *testing.T) {
+		server := httptest.NewTLSServer(websocket.Handler(func(c *websocket.Conn) {}))
+		defer server.Close()
+		certPool := x509.NewCertPool()
+		certPool.AddCert(server.Certificate())
+
+		dialer := NewWebsocketDialer(websocket.Config{}, time.Second)
+		dialer.Config.TlsConfig = &tls.Config{RootCAs: certPool}
+		conn, err := dialer.Dial(context.Background(), strings.Replace(server.URL, "https://", "wss://", 1))
+		assert.Nil(t, err)
+		conn.Close()
+
+		dialer.Config.TlsConfig = nil
+		_, err = dialer.Dial(context.Background(), strings.Replace(server.URL, "https://", "wss://", 1))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ShouldTimeoutWhenBackendDoesNotCompleteHandshake", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "localhost:0")
+		assert.Nil(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		dialer := NewWebsocketDialer(websocket.Config{}, time.Millisecond*200)
+		startedAt := time.Now()
+		_, err = dialer.Dial(context.Background(), "ws://"+listener.Addr().String())
+		assert.NotNil(t, err)
+		assert.Less(t, time.Since(startedAt), time.Second*2)
+	})
+
+	t.Run("ShouldRejectNonWebsocketUrl", func(t *testing.T) {
+		dialer := NewWebsocketDialer(websocket.Config{}, 0)
+		_, err := dialer.Dial(context.Background(), "http://localhost:8081")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,293 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiscoveryEventType Kind of change reported by a Discoverer
+type DiscoveryEventType int
+
+const (
+	// BackendDiscovered A backend url showed up
+	BackendDiscovered DiscoveryEventType = iota
+	// BackendLost A backend url previously discovered went away
+	BackendLost
+	// DiscoveryFailed A lookup failed, the backends known so far are left as they are
+	DiscoveryFailed
+)
+
+// DiscoveryEvent Change in the backends known to a Discoverer, Err is only set for DiscoveryFailed
+type DiscoveryEvent struct {
+	Type DiscoveryEventType
+	Url  string
+	Err  error
+}
+
+// Discoverer Source of backend urls for the pool. Run sends events till the context is done
+type Discoverer interface {
+	Run(ctx context.Context, events chan<- DiscoveryEvent) error
+}
+
+// StaticDiscoverer Discovers a fixed list of backend urls once
+type StaticDiscoverer struct {
+	urls []string
+}
+
+// NewStaticDiscoverer Creates a discoverer of the given backend urls
+func NewStaticDiscoverer(urls ...string) *StaticDiscoverer {
+	return &StaticDiscoverer{urls: urls}
+}
+
+func (sd *StaticDiscoverer) Run(ctx context.Context, events chan<- DiscoveryEvent) error {
+	for _, backendUrl := range sd.urls {
+		if !sendDiscoveryEvent(ctx, events, DiscoveryEvent{Type: BackendDiscovered, Url: backendUrl}) {
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// FileDiscoverer Watches a file holding a list of backend urls by reading it on an interval. Files ending with .yaml
+// or .yml are read as YAML, anything else as JSON, e.g. ["ws://10.0.0.1:8081/listener", "ws://10.0.0.2:8081/listener"]
+type FileDiscoverer struct {
+	path     string
+	interval time.Duration
+}
+
+// defaultDiscoveryInterval Interval discoverers poll on when none is given
+const defaultDiscoveryInterval = time.Second * 30
+
+// NewFileDiscoverer Creates a discoverer reading the file at path every interval, which defaults to 30s when not positive
+func NewFileDiscoverer(path string, interval time.Duration) *FileDiscoverer {
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	return &FileDiscoverer{path: path, interval: interval}
+}
+
+func (fd *FileDiscoverer) Run(ctx context.Context, events chan<- DiscoveryEvent) error {
+	return pollDiscovery(ctx, fd.interval, events, func(ctx context.Context) ([]string, error) {
+		return readBackendUrlsFile(fd.path)
+	})
+}
+
+// readBackendUrlsFile Reads a JSON or YAML list of backend urls
+func readBackendUrlsFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &urls)
+	default:
+		err = json.Unmarshal(content, &urls)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing backend urls file %s: %w", path, err)
+	}
+	return urls, nil
+}
+
+// Resolver DNS lookups used by DNSDiscoverer, satisfied by *net.Resolver
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSRecordType Records looked up by DNSDiscoverer
+type DNSRecordType int
+
+const (
+	// DNSRecordA Looks up the A/AAAA records of the name, every address is combined with the configured port
+	DNSRecordA DNSRecordType = iota
+	// DNSRecordSRV Looks up the SRV records of the name, every target is combined with its own port
+	DNSRecordSRV
+)
+
+// DNSDiscoveryConfig Configuration of DNSDiscoverer
+type DNSDiscoveryConfig struct {
+	// Resolver defaults to net.DefaultResolver
+	Resolver   Resolver
+	RecordType DNSRecordType
+	// Name host name for A records, e.g. backend.default.svc.cluster.local, or the SRV name
+	Name string
+	// Service and Proto of the SRV lookup, both empty to look up Name as is
+	Service string
+	Proto   string
+	// Port used with the addresses of A records
+	Port int
+	// Scheme defaults to ws, Path is appended to every backend url
+	Scheme string
+	Path   string
+	// Interval the records are polled on, defaults to 30s
+	Interval time.Duration
+}
+
+// DNSDiscoverer Discovers backends by polling DNS A or SRV records, so pods coming and going are picked up
+type DNSDiscoverer struct {
+	config DNSDiscoveryConfig
+}
+
+// NewDNSDiscoverer Creates a discoverer polling DNS with the given configuration
+func NewDNSDiscoverer(config DNSDiscoveryConfig) *DNSDiscoverer {
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	if config.Scheme == "" {
+		config.Scheme = "ws"
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultDiscoveryInterval
+	}
+	return &DNSDiscoverer{config: config}
+}
+
+func (dd *DNSDiscoverer) Run(ctx context.Context, events chan<- DiscoveryEvent) error {
+	return pollDiscovery(ctx, dd.config.Interval, events, dd.lookup)
+}
+
+func (dd *DNSDiscoverer) lookup(ctx context.Context) ([]string, error) {
+	var hostPorts []string
+	switch dd.config.RecordType {
+	case DNSRecordSRV:
+		_, records, err := dd.config.Resolver.LookupSRV(ctx, dd.config.Service, dd.config.Proto, dd.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	default:
+		addresses, err := dd.config.Resolver.LookupHost(ctx, dd.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			hostPorts = append(hostPorts, net.JoinHostPort(address, strconv.Itoa(dd.config.Port)))
+		}
+	}
+	urls := make([]string, 0, len(hostPorts))
+	for _, hostPort := range hostPorts {
+		backendUrl := url.URL{Scheme: dd.config.Scheme, Host: hostPort, Path: dd.config.Path}
+		urls = append(urls, backendUrl.String())
+	}
+	return urls, nil
+}
+
+// pollDiscovery Looks up the backend urls every interval and reports the difference to the previous lookup
+func pollDiscovery(ctx context.Context, interval time.Duration, events chan<- DiscoveryEvent, lookup func(ctx context.Context) ([]string, error)) error {
+	known := map[string]bool{}
+	for {
+		urls, err := lookup(ctx)
+		if err != nil {
+			if !sendDiscoveryEvent(ctx, events, DiscoveryEvent{Type: DiscoveryFailed, Err: err}) {
+				return nil
+			}
+		} else {
+			current := map[string]bool{}
+			for _, backendUrl := range urls {
+				current[backendUrl] = true
+			}
+			for _, event := range diffDiscovered(known, current) {
+				if !sendDiscoveryEvent(ctx, events, event) {
+					return nil
+				}
+			}
+			known = current
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// diffDiscovered Events turning the known urls into the current ones, in a stable order
+func diffDiscovered(known, current map[string]bool) []DiscoveryEvent {
+	var events []DiscoveryEvent
+	for backendUrl := range current {
+		if !known[backendUrl] {
+			events = append(events, DiscoveryEvent{Type: BackendDiscovered, Url: backendUrl})
+		}
+	}
+	for backendUrl := range known {
+		if !current[backendUrl] {
+			events = append(events, DiscoveryEvent{Type: BackendLost, Url: backendUrl})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+		return events[i].Url < events[j].Url
+	})
+	return events
+}
+
+func sendDiscoveryEvent(ctx context.Context, events chan<- DiscoveryEvent, event DiscoveryEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// RunDiscoverer Keeps the pool in sync with the discoverer till the pool is closed. Discovered urls are added to the
+// pool, lost ones are drained so their pipes can finish or move to another backend
+func (bp *BackendWSConnPool) RunDiscoverer(discoverer Discoverer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan DiscoveryEvent)
+	bp.loopsWg.Add(2)
+	go func() {
+		defer bp.loopsWg.Done()
+		defer cancel()
+		if err := discoverer.Run(ctx, events); err != nil {
+			bp.logger.Error("backend discovery stopped", err)
+		}
+	}()
+	go func() {
+		defer bp.loopsWg.Done()
+		for {
+			select {
+			case <-bp.closed:
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				bp.applyDiscoveryEvent(event)
+			}
+		}
+	}()
+}
+
+func (bp *BackendWSConnPool) applyDiscoveryEvent(event DiscoveryEvent) {
+	var err error
+	switch event.Type {
+	case BackendDiscovered:
+		err = bp.addReplacingDrain(event.Url, BackendOptions{})
+	case BackendLost:
+		err = bp.Drain(event.Url)
+	case DiscoveryFailed:
+		err = event.Err
+	}
+	if err != nil {
+		bp.logger.Warn("error applying discovered backend change", err)
+	}
+}
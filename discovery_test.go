@@ -0,0 +1,168 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver Answers lookups from records set by the test
+type fakeResolver struct {
+	mut     sync.Mutex
+	hosts   []string
+	records []*net.SRV
+	err     error
+}
+
+func (fr *fakeResolver) set(hosts []string, records []*net.SRV, err error) {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	fr.hosts, fr.records, fr.err = hosts, records, err
+}
+
+func (fr *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	return fr.hosts, fr.err
+}
+
+func (fr *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	fr.mut.Lock()
+	defer fr.mut.Unlock()
+	return name, fr.records, fr.err
+}
+
+// runDiscoverer Runs the discoverer for the lifetime of the test and returns its events
+func runDiscoverer(t *testing.T, discoverer Discoverer) chan DiscoveryEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	events := make(chan DiscoveryEvent, 16)
+	go discoverer.Run(ctx, events)
+	return events
+}
+
+func nextEvent(t *testing.T, events chan DiscoveryEvent) DiscoveryEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second * 5):
+		t.Fatal("no discovery event received")
+		return DiscoveryEvent{}
+	}
+}
+
+func TestStaticDiscoverer(t *testing.T) {
+	t.Run("ShouldDiscoverEveryUrlOnce", func(t *testing.T) {
+		events := runDiscoverer(t, NewStaticDiscoverer("ws://localhost:8081", "ws://localhost:8082"))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://localhost:8081"}, nextEvent(t, events))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://localhost:8082"}, nextEvent(t, events))
+	})
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	t.Run("ShouldPickUpChangesOfJsonFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "backends.json")
+		assert.Nil(t, os.WriteFile(path, []byte(`["ws://10.0.0.1:8081", "ws://10.0.0.2:8081"]`), 0o644))
+		events := runDiscoverer(t, NewFileDiscoverer(path, time.Millisecond*50))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.1:8081"}, nextEvent(t, events))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.2:8081"}, nextEvent(t, events))
+
+		assert.Nil(t, os.WriteFile(path, []byte(`["ws://10.0.0.2:8081", "ws://10.0.0.3:8081"]`), 0o644))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.3:8081"}, nextEvent(t, events))
+		assert.Equal(t, DiscoveryEvent{Type: BackendLost, Url: "ws://10.0.0.1:8081"}, nextEvent(t, events))
+	})
+
+	t.Run("ShouldReadYamlFileAndReportParseErrors", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "backends.yaml")
+		assert.Nil(t, os.WriteFile(path, []byte("- ws://10.0.0.1:8081\n"), 0o644))
+		events := runDiscoverer(t, NewFileDiscoverer(path, time.Millisecond*50))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.1:8081"}, nextEvent(t, events))
+
+		assert.Nil(t, os.WriteFile(path, []byte("backends: {"), 0o644))
+		event := nextEvent(t, events)
+		assert.Equal(t, DiscoveryFailed, event.Type)
+		assert.NotNil(t, event.Err)
+	})
+}
+
+func TestNewFileDiscoverer(t *testing.T) {
+	t.Run("ShouldDefaultIntervalWhenNotPositive", func(t *testing.T) {
+		assert.Equal(t, defaultDiscoveryInterval, NewFileDiscoverer("backends.json", 0).interval)
+		assert.Equal(t, defaultDiscoveryInterval, NewDNSDiscoverer(DNSDiscoveryConfig{Interval: -time.Second}).config.Interval)
+		assert.Equal(t, time.Second, NewFileDiscoverer("backends.json", time.Second).interval)
+	})
+}
+
+func TestDNSDiscoverer(t *testing.T) {
+	t.Run("ShouldCombineARecordsWithPortAndPath", func(t *testing.T) {
+		resolver := &fakeResolver{}
+		resolver.set([]string{"10.0.0.1"}, nil, nil)
+		events := runDiscoverer(t, NewDNSDiscoverer(DNSDiscoveryConfig{
+			Resolver: resolver,
+			Name:     "backend.local",
+			Port:     8081,
+			Path:     "/listener",
+			Interval: time.Millisecond * 50,
+		}))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.1:8081/listener"}, nextEvent(t, events))
+
+		resolver.set(nil, nil, errors.New("lookup failed"))
+		assert.Equal(t, DiscoveryFailed, nextEvent(t, events).Type)
+
+		resolver.set([]string{"10.0.0.2"}, nil, nil)
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "ws://10.0.0.2:8081/listener"}, nextEvent(t, events))
+		assert.Equal(t, DiscoveryEvent{Type: BackendLost, Url: "ws://10.0.0.1:8081/listener"}, nextEvent(t, events))
+	})
+
+	t.Run("ShouldUseTargetAndPortOfSRVRecords", func(t *testing.T) {
+		resolver := &fakeResolver{}
+		resolver.set(nil, []*net.SRV{{Target: "pod-1.backend.local.", Port: 9001}, {Target: "pod-2.backend.local.", Port: 9002}}, nil)
+		events := runDiscoverer(t, NewDNSDiscoverer(DNSDiscoveryConfig{
+			Resolver:   resolver,
+			RecordType: DNSRecordSRV,
+			Service:    "ws",
+			Proto:      "tcp",
+			Name:       "backend.local",
+			Scheme:     "wss",
+			Interval:   time.Millisecond * 50,
+		}))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "wss://pod-1.backend.local:9001"}, nextEvent(t, events))
+		assert.Equal(t, DiscoveryEvent{Type: BackendDiscovered, Url: "wss://pod-2.backend.local:9002"}, nextEvent(t, events))
+	})
+}
+
+func TestBackendWSConnPool_RunDiscoverer(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldRegisterDiscoveredAndDrainLostBackends", func(t *testing.T) {
+		resolver := &fakeResolver{}
+		resolver.set([]string{"10.0.0.1", "10.0.0.2"}, nil, nil)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.RunDiscoverer(NewDNSDiscoverer(DNSDiscoveryConfig{
+			Resolver: resolver,
+			Name:     "backend.local",
+			Port:     8081,
+			Interval: time.Millisecond * 50,
+		}))
+		assert.Eventually(t, func() bool {
+			_, ok1 := pool.loadRegistration("ws://10.0.0.1:8081")
+			_, ok2 := pool.loadRegistration("ws://10.0.0.2:8081")
+			return ok1 && ok2
+		}, time.Second*5, time.Millisecond*50)
+
+		resolver.set([]string{"10.0.0.2"}, nil, nil)
+		assert.Eventually(t, func() bool {
+			_, ok := pool.loadRegistration("ws://10.0.0.1:8081")
+			return !ok
+		}, time.Second*5, time.Millisecond*50)
+		_, ok := pool.loadRegistration("ws://10.0.0.2:8081")
+		assert.True(t, ok)
+	})
+}
@@ -0,0 +1,68 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"net"
+	"net/http"
+)
+
+// ClientHandshake Metadata of the client handshake forwarded to the backend, it is applied on every dial made for the
+// pipe of the client including the ones during failover. Header holds the forwarded headers, X-Forwarded-* included.
+// Path and RawQuery of the client request are appended to the backend url by the WebsocketDialer, the handler only sets
+// them with HandlerConfig.ForwardClientPath
+type ClientHandshake struct {
+	ClientID   uuid.UUID
+	Path       string
+	RawQuery   string
+	RemoteAddr string
+	Header     http.Header
+}
+
+// NewClientHandshake Captures the handshake of the client request, only the headers in forwardedHeaders are kept.
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host are always set, an incoming X-Forwarded-For is extended
+// instead of replaced only if it is one of the forwarded headers
+func NewClientHandshake(clientId uuid.UUID, request *http.Request, forwardedHeaders []string) *ClientHandshake {
+	header := http.Header{}
+	for _, name := range forwardedHeaders {
+		if values := request.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+
+	clientIP := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	if prior := header.Get("X-Forwarded-For"); prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	header.Set("X-Forwarded-For", clientIP)
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", request.Host)
+
+	return &ClientHandshake{
+		ClientID:   clientId,
+		Path:       request.URL.Path,
+		RawQuery:   request.URL.RawQuery,
+		RemoteAddr: request.RemoteAddr,
+		Header:     header,
+	}
+}
+
+type clientHandshakeKey struct{}
+
+// WithClientHandshake Attaches the handshake to the context passed on to the BackendDialer
+func WithClientHandshake(ctx context.Context, handshake *ClientHandshake) context.Context {
+	return context.WithValue(ctx, clientHandshakeKey{}, handshake)
+}
+
+// ClientHandshakeFromContext Handshake of the client a backend is being dialed for, if any
+func ClientHandshakeFromContext(ctx context.Context) (*ClientHandshake, bool) {
+	handshake, ok := ctx.Value(clientHandshakeKey{}).(*ClientHandshake)
+	return handshake, ok && handshake != nil
+}
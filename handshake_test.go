@@ -0,0 +1,106 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewClientHandshake(t *testing.T) {
+	clientId := uuid.New()
+
+	t.Run("ShouldKeepOnlyForwardedHeadersAndSetForwardingHeaders", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "http://proxy.local/listener?room=1", nil)
+		request.RemoteAddr = "10.0.0.1:5000"
+		request.Header.Set("Authorization", "Bearer token")
+		request.Header.Set("Cookie", "session=1")
+		request.Header.Set("X-Forwarded-For", "10.0.0.9")
+
+		handshake := NewClientHandshake(clientId, request, []string{"authorization"})
+		assert.Equal(t, clientId, handshake.ClientID)
+		assert.Equal(t, "/listener", handshake.Path)
+		assert.Equal(t, "room=1", handshake.RawQuery)
+		assert.Equal(t, "10.0.0.1:5000", handshake.RemoteAddr)
+		assert.Equal(t, "Bearer token", handshake.Header.Get("Authorization"))
+		assert.Empty(t, handshake.Header.Get("Cookie"))
+		assert.Equal(t, "10.0.0.1", handshake.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", handshake.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "proxy.local", handshake.Header.Get("X-Forwarded-Host"))
+	})
+
+	t.Run("ShouldExtendIncomingForwardedForWhenForwarded", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "https://proxy.local/", nil)
+		request.RemoteAddr = "10.0.0.1:5000"
+		request.Header.Set("X-Forwarded-For", "10.0.0.9")
+
+		handshake := NewClientHandshake(clientId, request, []string{"X-Forwarded-For"})
+		assert.Equal(t, "10.0.0.9, 10.0.0.1", handshake.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", handshake.Header.Get("X-Forwarded-Proto"))
+	})
+
+	t.Run("ShouldBeCarriedByContext", func(t *testing.T) {
+		_, ok := ClientHandshakeFromContext(context.Background())
+		assert.False(t, ok)
+		_, ok = ClientHandshakeFromContext(WithClientHandshake(context.Background(), nil))
+		assert.False(t, ok)
+
+		handshake := &ClientHandshake{ClientID: clientId}
+		carried, ok := ClientHandshakeFromContext(WithClientHandshake(context.Background(), handshake))
+		assert.True(t, ok)
+		assert.Equal(t, handshake, carried)
+	})
+}
+
+func TestInterruptibleWebsocketProxyHandler_ForwardClientPath(t *testing.T) {
+	tl := &testLogger{}
+
+	for name, forward := range map[string]bool{
+		"ShouldDialRegisteredBackendUrlAsIsByDefault":   false,
+		"ShouldAppendPathAndQueryOfClientWhenForwarded": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			requested := make(chan string, 1)
+			backend := httptest.NewServer(websocket.Server{
+				Handshake: func(config *websocket.Config, r *http.Request) error {
+					requested <- r.URL.RequestURI()
+					return nil
+				},
+				Handler: func(c *websocket.Conn) {
+					defer c.Close()
+					_, _ = c.Read(make([]byte, 1))
+				},
+			})
+			defer backend.Close()
+			handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, HandlerConfig{
+				MaxIdleConnCount:                   5,
+				MaxAllowedErrorCountPerConn:        100,
+				InterruptMemoryLimitPerConnInBytes: 1024,
+				ForwardClientPath:                  forward,
+			}, tl)
+			defer handler.Shutdown(context.Background())
+			assert.Nil(t, handler.AddConnectionToPool(testBackendUrl(backend)+"/listener"))
+			proxy := httptest.NewServer(handler)
+			defer proxy.Close()
+
+			clientId := uuid.New()
+			client, err := websocket.Dial(testBackendUrl(proxy)+"/"+clientId.String()+"?room=1", "", "http://localhost")
+			assert.Nil(t, err)
+			defer client.Close()
+			expected := "/listener"
+			if forward {
+				expected = "/listener/" + clientId.String() + "?room=1"
+			}
+			select {
+			case uri := <-requested:
+				assert.Equal(t, expected, uri)
+			case <-time.After(time.Second * 10):
+				t.Fatal("backend was not dialed")
+			}
+		})
+	}
+}
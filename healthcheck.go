@@ -0,0 +1,277 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthProbe Checks whether the backend url is able to serve clients, a nil error means healthy
+type HealthProbe func(ctx context.Context, backendUrl string) error
+
+// NewWebsocketHealthProbe Probes a backend by completing a websocket handshake with the dialer and closing it right away
+func NewWebsocketHealthProbe(dialer BackendDialer) HealthProbe {
+	return func(ctx context.Context, backendUrl string) error {
+		conn, err := dialer.Dial(ctx, backendUrl)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// NewHTTPHealthProbe Probes a backend with a GET request to the given path on the same host, ws:// and wss:// map to
+// http:// and https://. Any 2xx status is healthy, the default http client is used if client is nil
+func NewHTTPHealthProbe(client *http.Client, path string) HealthProbe {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, backendUrl string) error {
+		healthUrl, err := url.Parse(backendUrl)
+		if err != nil {
+			return err
+		}
+		switch healthUrl.Scheme {
+		case "ws":
+			healthUrl.Scheme = "http"
+		case "wss":
+			healthUrl.Scheme = "https"
+		}
+		healthUrl.Path = path
+		healthUrl.RawQuery = ""
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, healthUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("health check of %s returned status %d", healthUrl, response.StatusCode)
+		}
+		return nil
+	}
+}
+
+// HealthCheckConfig Configuration for actively checking the registered backends
+type HealthCheckConfig struct {
+	// Probe defaults to a websocket handshake with the dialer of the pool
+	Probe HealthProbe
+	// Interval backends are probed on, defaults to 10s
+	Interval time.Duration
+	// Timeout Bounds a single probe, defaults to the interval
+	Timeout time.Duration
+	// UnhealthyThreshold consecutive failed probes take a backend out, defaults to 1
+	UnhealthyThreshold int
+	// HealthyThreshold consecutive passed probes bring an unhealthy backend back, defaults to 1
+	HealthyThreshold int
+}
+
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Interval <= 0 {
+		hc.Interval = time.Second * 10
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = hc.Interval
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 1
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 1
+	}
+	return hc
+}
+
+// BackendHealth Health state of a registered backend url as seen by the health checker, along with its circuit
+type BackendHealth struct {
+	Url                  string
+	Healthy              bool
+	Circuit              CircuitState
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+	LastChecked          time.Time
+	LastError            error
+}
+
+// healthState Health of a registration, a backend is healthy till the health checker says otherwise
+type healthState struct {
+	mut                  sync.Mutex
+	unhealthy            bool
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	lastChecked          time.Time
+	lastError            error
+}
+
+// record Applies the result of a probe, returns whether the backend turned healthy or unhealthy with it
+func (hs *healthState) record(err error, config HealthCheckConfig) (changed bool, healthy bool) {
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	hs.lastChecked = time.Now()
+	hs.lastError = err
+	if err != nil {
+		hs.consecutiveFailures++
+		hs.consecutiveSuccesses = 0
+		if !hs.unhealthy && hs.consecutiveFailures >= config.UnhealthyThreshold {
+			hs.unhealthy = true
+			return true, false
+		}
+		return false, !hs.unhealthy
+	}
+	hs.consecutiveSuccesses++
+	hs.consecutiveFailures = 0
+	if hs.unhealthy && hs.consecutiveSuccesses >= config.HealthyThreshold {
+		hs.unhealthy = false
+		return true, true
+	}
+	return false, !hs.unhealthy
+}
+
+func (hs *healthState) isHealthy() bool {
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	return !hs.unhealthy
+}
+
+func (hs *healthState) snapshot(url string) BackendHealth {
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	return BackendHealth{
+		Url:                  url,
+		Healthy:              !hs.unhealthy,
+		ConsecutiveFailures:  hs.consecutiveFailures,
+		ConsecutiveSuccesses: hs.consecutiveSuccesses,
+		LastChecked:          hs.lastChecked,
+		LastError:            hs.lastError,
+	}
+}
+
+// EnableHealthCheck Starts probing every registered backend on the configured interval. A backend failing the
+// unhealthy threshold of probes is kept out of the idle connections, and handed out again only after passing the
+// healthy threshold of consecutive probes. To be called once, the checker stops when the pool is closed
+func (bp *BackendWSConnPool) EnableHealthCheck(config HealthCheckConfig) {
+	config = config.withDefaults()
+	if config.Probe == nil {
+		config.Probe = NewWebsocketHealthProbe(bp.currentSettings().dialer)
+	}
+	bp.loopsWg.Add(1)
+	go func() {
+		defer bp.loopsWg.Done()
+		for sleepUnlessClosed(config.Interval, bp.closed) {
+			bp.checkBackends(config)
+		}
+	}()
+}
+
+// checkBackends Probes every registered backend concurrently and waits for all of them
+func (bp *BackendWSConnPool) checkBackends(config HealthCheckConfig) {
+	var wg sync.WaitGroup
+	bp.registeredBackendUrls.Range(func(key, value any) bool {
+		registration := value.(*backendRegistration)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			defer cancel()
+			err := config.Probe(ctx, registration.url)
+			changed, healthy := registration.health.record(err, config)
+			if !changed {
+				return
+			}
+			if healthy {
+				bp.logger.Debug(fmt.Sprintf("backend url is healthy again: %s", registration.url))
+				bp.unparkEntries(registration)
+			} else {
+				bp.logger.Warn(fmt.Sprintf("backend url is unhealthy, taking it out of the idle connections: %s", registration.url), err)
+				bp.parkIdleEntries(registration)
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+}
+
+// BackendHealth Health state of the registered backend url
+func (bp *BackendWSConnPool) BackendHealth(url string) (BackendHealth, bool) {
+	registration, ok := bp.loadRegistration(url)
+	if !ok {
+		return BackendHealth{}, false
+	}
+	return registration.healthSnapshot(), true
+}
+
+// BackendsHealth Health state of every registered backend url
+func (bp *BackendWSConnPool) BackendsHealth() []BackendHealth {
+	var healths []BackendHealth
+	bp.registeredBackendUrls.Range(func(key, value any) bool {
+		healths = append(healths, value.(*backendRegistration).healthSnapshot())
+		return true
+	})
+	return healths
+}
+
+func (br *backendRegistration) healthSnapshot() BackendHealth {
+	health := br.health.snapshot(br.url)
+	health.Circuit = br.breaker.currentState()
+	return health
+}
+
+// pushIdle Adds the entry to the idle connections, or parks it while its backend is unhealthy. An entry left over
+// from a lowered capacity is dropped.
+// Returns whether the entry went into the idle connections, to be called with idleConnMutex held
+func (bp *BackendWSConnPool) pushIdle(conn *BackendConn) bool {
+	if conn.registration.surplus > 0 {
+		conn.registration.surplus--
+		closeBackendConn(conn)
+		return false
+	}
+	if !conn.registration.health.isHealthy() {
+		closeBackendConn(conn)
+		bp.parkedConnections.PushBack(conn)
+		return false
+	}
+	bp.idleConnections.PushBack(conn)
+	return true
+}
+
+// parkIdleEntries Moves the idle entries of an unhealthy registration aside
+func (bp *BackendWSConnPool) parkIdleEntries(registration *backendRegistration) {
+	bp.idleConnMutex.Lock()
+	defer bp.idleConnMutex.Unlock()
+	for e := bp.idleConnections.Front(); e != nil; {
+		next := e.Next()
+		if conn := e.Value.(*BackendConn); conn.registration == registration {
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			closeBackendConn(conn)
+			bp.parkedConnections.PushBack(conn)
+		}
+		e = next
+	}
+}
+
+// unparkEntries Brings the parked entries of a registration which turned healthy back into the idle connections
+func (bp *BackendWSConnPool) unparkEntries(registration *backendRegistration) {
+	bp.idleConnMutex.Lock()
+	defer bp.idleConnMutex.Unlock()
+	for e := bp.parkedConnections.Front(); e != nil; {
+		next := e.Next()
+		if conn := e.Value.(*BackendConn); conn.registration == registration {
+			bp.parkedConnections.Remove(e)
+			if bp.isActive(registration) {
+				atomic.AddInt64(bp.idleConnCount, 1)
+				bp.idleConnections.PushBack(conn)
+			} else {
+				bp.discardConn(conn)
+			}
+		}
+		e = next
+	}
+}
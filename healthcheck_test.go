@@ -0,0 +1,94 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHealthBackend Starts a websocket backend which also serves /health, healthy is toggled by the returned flag
+func newTestHealthBackend(t *testing.T) (string, *int32) {
+	healthy := int32(1)
+	mux := http.NewServeMux()
+	mux.Handle("/", websocket.Handler(func(c *websocket.Conn) {
+		time.Sleep(time.Minute)
+	}))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return testBackendUrl(server), &healthy
+}
+
+func TestNewHTTPHealthProbe(t *testing.T) {
+	t.Run("ShouldProbeHealthPathOnBackendHost", func(t *testing.T) {
+		backendUrl, healthy := newTestHealthBackend(t)
+		probe := NewHTTPHealthProbe(nil, "/health")
+
+		assert.Nil(t, probe(context.Background(), backendUrl+"/listener?room=1"))
+		atomic.StoreInt32(healthy, 0)
+		assert.NotNil(t, probe(context.Background(), backendUrl))
+	})
+}
+
+func TestBackendWSConnPool_EnableHealthCheck(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldDefaultIntervalWhenNotPositive", func(t *testing.T) {
+		config := HealthCheckConfig{Interval: -time.Second}.withDefaults()
+		assert.Equal(t, time.Second*10, config.Interval)
+		assert.Equal(t, time.Second*10, config.Timeout)
+		assert.Equal(t, time.Second, HealthCheckConfig{Interval: time.Second}.withDefaults().Interval)
+	})
+
+	t.Run("ShouldKeepUnhealthyBackendOutTillItPassesConsecutiveChecks", func(t *testing.T) {
+		backendUrl, healthy := newTestHealthBackend(t)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.SetMaxGetConnWait(time.Millisecond * 200)
+		pool.EnableHealthCheck(HealthCheckConfig{
+			Probe:            NewHTTPHealthProbe(nil, "/health"),
+			Interval:         time.Millisecond * 100,
+			HealthyThreshold: 2,
+		})
+		err := pool.AddToPool(backendUrl)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			pool.idleConnMutex.Lock()
+			defer pool.idleConnMutex.Unlock()
+			return pool.idleConnections.Len() == 1
+		}, time.Second*5, time.Millisecond*50)
+
+		atomic.StoreInt32(healthy, 0)
+		assert.Eventually(t, func() bool {
+			health, ok := pool.BackendHealth(backendUrl)
+			return ok && !health.Healthy
+		}, time.Second*5, time.Millisecond*50)
+		pool.idleConnMutex.Lock()
+		assert.Equal(t, 0, pool.idleConnections.Len())
+		assert.Equal(t, 1, pool.parkedConnections.Len())
+		pool.idleConnMutex.Unlock()
+		_, err = pool.GetConn(context.Background())
+		assert.ErrorIs(t, err, ErrNoBackendAvailable)
+
+		atomic.StoreInt32(healthy, 1)
+		assert.Eventually(t, func() bool {
+			health, _ := pool.BackendHealth(backendUrl)
+			return health.Healthy
+		}, time.Second*5, time.Millisecond*50)
+		health, _ := pool.BackendHealth(backendUrl)
+		assert.GreaterOrEqual(t, health.ConsecutiveSuccesses, 2)
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, backendUrl, conn.connUrl)
+		assert.Len(t, pool.BackendsHealth(), 1)
+	})
+}
@@ -0,0 +1,254 @@
+package interruptible_websocket_proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrMemoryBudgetExceeded Returned to clients refused, and to the ones whose pipe was evicted, once the global memory
+// limit of the pipes is used up
+var ErrMemoryBudgetExceeded = errors.New("global memory limit of pipes reached")
+
+// MemoryExhaustionPolicy Decides what happens once the data held by all pipes together reaches the global memory limit
+type MemoryExhaustionPolicy int
+
+const (
+	// MemoryRejectBuffering Refuses data which does not fit, the pipe handles it as it does data outgrowing its own limit
+	MemoryRejectBuffering MemoryExhaustionPolicy = iota
+	// MemoryEvictLargest Closes the pipes holding the most data, other than the one buffering, to make room
+	MemoryEvictLargest
+	// MemoryRefuseClients Refuses new clients once the limit left cannot take another pipe at the per connection memory
+	// limit, data which does not fit is refused as well
+	MemoryRefuseClients
+)
+
+// memoryBudget Accounts the data held by all the pipes of a manager against the global memory limit, zero for no limit.
+// evict is called to make room for bytes the requesting pipe could not reserve, returns whether room was made
+type memoryBudget struct {
+	limit  int64
+	policy int32
+	used   int64
+	evict  func(requester *PersistentPipe, bytes int64) bool
+}
+
+// take Counts the bytes as used unless they would exceed the limit
+func (mb *memoryBudget) take(bytes int64) bool {
+	for {
+		used, limit := atomic.LoadInt64(&mb.used), atomic.LoadInt64(&mb.limit)
+		if limit > 0 && used+bytes > limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&mb.used, used, used+bytes) {
+			return true
+		}
+	}
+}
+
+func (mb *memoryBudget) give(bytes int64) {
+	atomic.AddInt64(&mb.used, -bytes)
+}
+
+func (mb *memoryBudget) currentPolicy() MemoryExhaustionPolicy {
+	return MemoryExhaustionPolicy(atomic.LoadInt32(&mb.policy))
+}
+
+// refusesClients Whether a new client is to be refused, when what is left of the limit cannot take perConnBytes more
+func (mb *memoryBudget) refusesClients(perConnBytes int) bool {
+	limit := atomic.LoadInt64(&mb.limit)
+	return mb.currentPolicy() == MemoryRefuseClients && limit > 0 && limit-atomic.LoadInt64(&mb.used) < int64(perConnBytes)
+}
+
+// SetGlobalMemoryLimit Bounds the data held in memory by all pipes together, interrupt buffers, client buffers and data
+// awaiting acknowledgement alike. Data spilled to disk is not counted, data refused by the limit is spilled instead
+// when the interrupt buffer spills to disk. What happens once it is used up is decided by the policy.
+// Zero, the default, leaves pipes bounded by their own limits only. Applies to the running pipes as well
+func (pm *WebsocketPipeManager) SetGlobalMemoryLimit(limitInBytes int, policy MemoryExhaustionPolicy) {
+	atomic.StoreInt64(&pm.memoryBudget.limit, int64(limitInBytes))
+	atomic.StoreInt32(&pm.memoryBudget.policy, int32(policy))
+}
+
+// MemoryUsed Number of bytes held by all pipes together, as counted against the global memory limit
+func (pm *WebsocketPipeManager) MemoryUsed() int {
+	return int(atomic.LoadInt64(&pm.memoryBudget.used))
+}
+
+// evictLargestPipes Closes the pipes holding the most data, other than the requester, till bytes more fit in the
+// budget. Their data is given back to the budget right away, none are closed if they could not make enough room
+func (pm *WebsocketPipeManager) evictLargestPipes(requester *PersistentPipe, bytes int64) bool {
+	budget := pm.memoryBudget
+	shortage := atomic.LoadInt64(&budget.used) + bytes - atomic.LoadInt64(&budget.limit)
+	type candidate struct {
+		persistentPipe *PersistentPipe
+		reserved       int64
+	}
+	var candidates []candidate
+	var reserved int64
+	pm.clientPipesMap.Range(func(key, value any) bool {
+		persistentPipe := value.(*PersistentPipe)
+		if pipeReserved := persistentPipe.memoryReserved(); persistentPipe != requester && pipeReserved > 0 {
+			candidates = append(candidates, candidate{persistentPipe: persistentPipe, reserved: pipeReserved})
+			reserved += pipeReserved
+		}
+		return true
+	})
+	if reserved < shortage {
+		return false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].reserved > candidates[j].reserved
+	})
+	var freed int64
+	for _, c := range candidates {
+		if freed >= shortage {
+			break
+		}
+		persistentPipe := c.persistentPipe
+		evictedBytes := persistentPipe.evictMemory()
+		if evictedBytes == 0 {
+			continue
+		}
+		freed += evictedBytes
+		pm.logger.Warn(fmt.Sprintf("evicting pipe associated with client id %s holding %d bytes", persistentPipe.ClientID, evictedBytes), ErrMemoryBudgetExceeded)
+		// Closed in the background, the requester holds locks of its own pipe
+		go pm.forceClosePipe(persistentPipe.ClientID, persistentPipe, ErrMemoryBudgetExceeded)
+	}
+	return freed >= shortage
+}
+
+// budgetedPipeBuffer Counts the data held in memory by the buffer of a pipe against the global memory limit, data a
+// spilling buffer holds on disk is not counted
+type budgetedPipeBuffer struct {
+	PipeBuffer
+	pipe *PersistentPipe
+}
+
+// spillingPipeBuffer A buffer holding part of its data on disk, like FileSpillPipeBuffer
+type spillingPipeBuffer interface {
+	memorySize() int
+	spill(payloadType byte, data []byte) error
+}
+
+// memorySize Number of bytes the buffer holds in memory
+func (bb budgetedPipeBuffer) memorySize() int {
+	if spilling, ok := bb.PipeBuffer.(spillingPipeBuffer); ok {
+		return spilling.memorySize()
+	}
+	return bb.PipeBuffer.Size()
+}
+
+func (bb budgetedPipeBuffer) Push(payloadType byte, data []byte) error {
+	spilling, canSpill := bb.PipeBuffer.(spillingPipeBuffer)
+	var reserved bool
+	if canSpill {
+		// Spilled to disk, which does not count against the limit, rather than evicting other pipes to make room
+		reserved = bb.pipe.budget == nil || bb.pipe.tryReserveMemory(len(data))
+	} else {
+		reserved = bb.pipe.reserveMemory(len(data))
+	}
+	if !reserved {
+		if canSpill {
+			return spilling.spill(payloadType, data)
+		}
+		return fmt.Errorf("%w: %s", ErrPipeBufferFull, ErrMemoryBudgetExceeded)
+	}
+	held := bb.memorySize()
+	if err := bb.PipeBuffer.Push(payloadType, data); err != nil {
+		bb.pipe.releaseMemory(len(data))
+		return err
+	}
+	// Whatever went to disk is given back
+	bb.pipe.releaseMemory(len(data) - (bb.memorySize() - held))
+	return nil
+}
+
+func (bb budgetedPipeBuffer) Flush(write func(payloadType byte, data []byte) error) error {
+	// Data in memory is written ahead of the data on disk
+	inMemory := bb.memorySize()
+	return bb.PipeBuffer.Flush(func(payloadType byte, data []byte) error {
+		if err := write(payloadType, data); err != nil {
+			return err
+		}
+		written := len(data)
+		if written > inMemory {
+			written = inMemory
+		}
+		inMemory -= written
+		bb.pipe.releaseMemory(written)
+		return nil
+	})
+}
+
+func (bb budgetedPipeBuffer) Close() error {
+	bb.pipe.releaseMemory(bb.memorySize())
+	return bb.PipeBuffer.Close()
+}
+
+// useMemoryBudget Counts the data the pipe holds against the budget
+func (pep *PersistentPipe) useMemoryBudget(budget *memoryBudget) {
+	pep.budget = budget
+	pep.backendBuffer = budgetedPipeBuffer{PipeBuffer: pep.backendBuffer, pipe: pep}
+	pep.clientBuffer = budgetedPipeBuffer{PipeBuffer: pep.clientBuffer, pipe: pep}
+}
+
+// reserveMemory Counts bytes about to be held by the pipe against the budget, evicting other pipes to make room when
+// the policy says so. Returns false if they do not fit
+func (pep *PersistentPipe) reserveMemory(bytes int) bool {
+	if pep.budget == nil || bytes <= 0 {
+		return true
+	}
+	if pep.tryReserveMemory(bytes) {
+		return true
+	}
+	if pep.budget.currentPolicy() != MemoryEvictLargest || !pep.budget.evict(pep, int64(bytes)) {
+		return false
+	}
+	return pep.tryReserveMemory(bytes)
+}
+
+func (pep *PersistentPipe) tryReserveMemory(bytes int) bool {
+	pep.budgetMut.Lock()
+	defer pep.budgetMut.Unlock()
+	if pep.evicted || !pep.budget.take(int64(bytes)) {
+		return false
+	}
+	pep.reservedBytes += int64(bytes)
+	return true
+}
+
+// releaseMemory Gives bytes no longer held by the pipe back to the budget
+func (pep *PersistentPipe) releaseMemory(bytes int) {
+	if pep.budget == nil || bytes <= 0 {
+		return
+	}
+	pep.budgetMut.Lock()
+	defer pep.budgetMut.Unlock()
+	if pep.evicted {
+		// Given back on eviction
+		return
+	}
+	pep.reservedBytes -= int64(bytes)
+	pep.budget.give(int64(bytes))
+}
+
+func (pep *PersistentPipe) memoryReserved() int64 {
+	pep.budgetMut.Lock()
+	defer pep.budgetMut.Unlock()
+	return pep.reservedBytes
+}
+
+// evictMemory Gives everything the pipe holds back to the budget ahead of closing it, nothing more can be reserved
+// by it afterwards. Returns the bytes given back, zero if the pipe was already evicted
+func (pep *PersistentPipe) evictMemory() int64 {
+	pep.budgetMut.Lock()
+	defer pep.budgetMut.Unlock()
+	if pep.evicted {
+		return 0
+	}
+	pep.evicted = true
+	evictedBytes := pep.reservedBytes
+	pep.reservedBytes = 0
+	pep.budget.give(evictedBytes)
+	return evictedBytes
+}
@@ -0,0 +1,106 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBudgetedPipeBuffer(t *testing.T) {
+	t.Run("ShouldReserveHeldBytesFromBudgetAndGiveThemBack", func(t *testing.T) {
+		budget := &memoryBudget{limit: 10}
+		persistentPipe := NewPersistentPipe(uuid.New(), nil, nil, 100)
+		persistentPipe.useMemoryBudget(budget)
+
+		assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte("first")))
+		assert.Nil(t, persistentPipe.clientBuffer.Push(0, []byte("abc")))
+		assert.ErrorIs(t, persistentPipe.backendBuffer.Push(0, []byte("second")), ErrPipeBufferFull)
+		assert.Equal(t, int64(8), budget.used)
+
+		assert.Nil(t, persistentPipe.backendBuffer.Flush(func(payloadType byte, data []byte) error {
+			return nil
+		}))
+		assert.Equal(t, int64(3), budget.used)
+		assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte("second")))
+		persistentPipe.closeBuffers()
+		assert.Equal(t, int64(0), budget.used)
+		assert.Equal(t, int64(0), persistentPipe.memoryReserved())
+	})
+
+	t.Run("ShouldReserveOnlyDataHeldInMemoryBySpillingBuffer", func(t *testing.T) {
+		budget := &memoryBudget{limit: 10}
+		persistentPipe := NewPersistentPipe(uuid.New(), nil, nil, 100)
+		persistentPipe.backendBuffer = NewFileSpillPipeBuffer(t.TempDir(), "pipe-*.buf", 5, 100)
+		persistentPipe.useMemoryBudget(budget)
+
+		assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte("ab")))
+		assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte("cdef")))
+		assert.Equal(t, int64(2), budget.used)
+
+		// Data refused by the budget is spilled
+		assert.Nil(t, persistentPipe.clientBuffer.Push(0, []byte("ghijklmn")))
+		assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte("o")))
+		assert.Equal(t, int64(10), budget.used)
+		assert.Equal(t, 7, persistentPipe.backendBuffer.Size())
+
+		var written []string
+		assert.Nil(t, persistentPipe.backendBuffer.Flush(func(payloadType byte, data []byte) error {
+			written = append(written, string(data))
+			return nil
+		}))
+		assert.Equal(t, []string{"ab", "cdef", "o"}, written)
+		assert.Equal(t, int64(8), budget.used)
+		persistentPipe.closeBuffers()
+		assert.Equal(t, int64(0), budget.used)
+	})
+}
+
+func TestWebsocketPipeManager_SetGlobalMemoryLimit(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldEvictPipesHoldingTheMostData", func(t *testing.T) {
+		pipeManager := NewWebsocketPipeManager(NewBackendConnPool(5, 100, tl), 100, tl)
+		pipeManager.SetGlobalMemoryLimit(10, MemoryEvictLargest)
+		var pipes []*PersistentPipe
+		for _, data := range []string{"abcd", "abcde", ""} {
+			persistentPipe := NewPersistentPipe(uuid.New(), nil, nil, 100)
+			persistentPipe.useMemoryBudget(pipeManager.memoryBudget)
+			pipeManager.clientPipesMap.Store(persistentPipe.ClientID, persistentPipe)
+			assert.Nil(t, persistentPipe.backendBuffer.Push(0, []byte(data)))
+			pipes = append(pipes, persistentPipe)
+		}
+
+		assert.Nil(t, pipes[2].backendBuffer.Push(0, []byte("abcdef")))
+		assert.Equal(t, 10, pipeManager.MemoryUsed())
+		assert.Eventually(t, func() bool {
+			_, ok := pipeManager.clientPipesMap.Load(pipes[1].ClientID)
+			return !ok
+		}, time.Second*10, time.Millisecond*50)
+		_, ok := pipeManager.clientPipesMap.Load(pipes[0].ClientID)
+		assert.True(t, ok)
+
+		// Nothing is evicted when the others cannot make enough room
+		assert.NotNil(t, pipes[0].backendBuffer.Push(0, []byte("abcdefg")))
+		assert.Equal(t, 10, pipeManager.MemoryUsed())
+	})
+
+	t.Run("ShouldRefuseNewClientsOnceLimitCannotTakeAnotherPipe", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		assert.Nil(t, pipeManager.AddConnectionToPool(expUrl))
+		pipeManager.SetGlobalMemoryLimit(1000, MemoryRefuseClients)
+		clientPeer, pipeErr := startTestPipe(pipeManager, uuid.New())
+		defer clientPeer.Close()
+		assert.ErrorIs(t, <-pipeErr, ErrMemoryBudgetExceeded)
+
+		pipeManager.SetGlobalMemoryLimit(2048, MemoryRefuseClients)
+		clientPeer, pipeErr = startTestPipe(pipeManager, uuid.New())
+		assertEcho(t, clientPeer, "admitted")
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+}
@@ -0,0 +1,130 @@
+package interruptible_websocket_proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+)
+
+// wsMessage A chunk of data travelling through the pipe. In message framed mode it is one complete websocket message
+// along with its payload type (text/binary), otherwise it is a raw chunk of the byte stream and payloadType is unused.
+// seq numbers client messages in reliable delivery mode, zero otherwise
+type wsMessage struct {
+	payloadType byte
+	data        []byte
+	seq         uint64
+}
+
+// messageCodec Same as websocket.Message, except that the payload type of a received frame is preserved in wsMessage
+// so the message can be replayed with the same opcode
+var messageCodec = websocket.Codec{Marshal: marshalMessage, Unmarshal: unmarshalMessage}
+
+func marshalMessage(v interface{}) ([]byte, byte, error) {
+	msg, ok := v.(wsMessage)
+	if !ok {
+		return nil, websocket.UnknownFrame, websocket.ErrNotSupported
+	}
+	return msg.data, msg.payloadType, nil
+}
+
+func unmarshalMessage(data []byte, payloadType byte, v interface{}) error {
+	msg, ok := v.(*wsMessage)
+	if !ok {
+		return websocket.ErrNotSupported
+	}
+	msg.payloadType = payloadType
+	msg.data = data
+	return nil
+}
+
+// Close status codes sent to clients whose pipe could not be served, and to backends a pipe migrated away from
+const (
+	closeStatusNormal        = 1000
+	closeStatusGoingAway     = 1001
+	closeStatusTryAgainLater = 1013
+)
+
+// writeCloseFrame Sends a close frame with the given status code and reason, the connection is to be closed afterwards
+func writeCloseFrame(ws *websocket.Conn, statusCode uint16, reason string) error {
+	data := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(data, statusCode)
+	copy(data[2:], reason)
+	return messageCodec.Send(ws, wsMessage{payloadType: websocket.CloseFrame, data: data})
+}
+
+// asWebsocketConn Unwraps the websocket connection behind either end of a pipe
+func asWebsocketConn(conn io.ReadWriteCloser) (*websocket.Conn, bool) {
+	switch c := conn.(type) {
+	case *websocket.Conn:
+		return c, true
+	case *BackendConn:
+		ws, ok := c.Conn.(*websocket.Conn)
+		return ws, ok
+	}
+	return nil, false
+}
+
+// messageQueue Ordered messages held while the other end of the pipe is unavailable, size is the total payload in bytes
+type messageQueue struct {
+	messages []wsMessage
+	size     int
+}
+
+// push Holds a copy of the message, as the data of a raw chunk is reused by the reader
+func (mq *messageQueue) push(msg wsMessage) {
+	data := make([]byte, len(msg.data))
+	copy(data, msg.data)
+	mq.messages = append(mq.messages, wsMessage{payloadType: msg.payloadType, data: data})
+	mq.size += len(data)
+}
+
+// flush Writes the held messages in order, the ones not written are kept when a write fails
+func (mq *messageQueue) flush(write func(msg wsMessage) error) error {
+	for len(mq.messages) > 0 {
+		if err := write(mq.messages[0]); err != nil {
+			return err
+		}
+		mq.size -= len(mq.messages[0].data)
+		mq.messages[0] = wsMessage{}
+		mq.messages = mq.messages[1:]
+	}
+	mq.messages = nil
+	return nil
+}
+
+// readFrame Reads the next chunk from conn, a whole message in message framed mode. Returns nil if nothing was read
+func (pep *PersistentPipe) readFrame(conn io.ReadWriteCloser, buf []byte) (*wsMessage, error) {
+	if pep.messageFramed {
+		ws, ok := asWebsocketConn(conn)
+		if !ok {
+			return nil, fmt.Errorf("message framed pipe requires websocket connections")
+		}
+		var msg wsMessage
+		if err := messageCodec.Receive(ws, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+	nr, err := conn.Read(buf)
+	if nr > 0 {
+		return &wsMessage{data: buf[0:nr]}, err
+	}
+	return nil, err
+}
+
+// writeFrame Writes the chunk to conn, as a single message with the original payload type in message framed mode
+func (pep *PersistentPipe) writeFrame(conn io.ReadWriteCloser, msg wsMessage) error {
+	if pep.messageFramed {
+		ws, ok := asWebsocketConn(conn)
+		if !ok {
+			return fmt.Errorf("message framed pipe requires websocket connections")
+		}
+		return messageCodec.Send(ws, msg)
+	}
+	nw, err := conn.Write(msg.data)
+	if err == nil && nw != len(msg.data) {
+		err = fmt.Errorf("invalid write error: %s", io.ErrShortWrite)
+	}
+	return err
+}
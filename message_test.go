@@ -0,0 +1,103 @@
+package interruptible_websocket_proxy
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessageQueue(t *testing.T) {
+	t.Run("ShouldKeepMessagesWhichCouldNotBeFlushed", func(t *testing.T) {
+		mq := messageQueue{}
+		mq.push(wsMessage{payloadType: websocket.TextFrame, data: []byte("first")})
+		mq.push(wsMessage{payloadType: websocket.BinaryFrame, data: []byte("second")})
+		assert.Equal(t, 11, mq.size)
+
+		var written []wsMessage
+		err := mq.flush(func(msg wsMessage) error {
+			if len(written) == 1 {
+				return fmt.Errorf("write failed")
+			}
+			written = append(written, msg)
+			return nil
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, "first", string(written[0].data))
+		assert.Equal(t, 6, mq.size)
+
+		err = mq.flush(func(msg wsMessage) error {
+			written = append(written, msg)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, byte(websocket.BinaryFrame), written[1].payloadType)
+		assert.Equal(t, 0, mq.size)
+	})
+
+	t.Run("ShouldHoldACopyOfTheMessageData", func(t *testing.T) {
+		mq := messageQueue{}
+		data := []byte("chunk")
+		mq.push(wsMessage{data: data})
+		data[0] = 'x'
+		assert.Equal(t, "chunk", string(mq.messages[0].data))
+	})
+}
+
+func TestMessageFramedPipe(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldPreservePayloadTypeOfEachMessage", func(t *testing.T) {
+		backend := httptest.NewServer(websocket.Server{
+			Handler: func(c *websocket.Conn) {
+				defer c.Close()
+				for {
+					var msg wsMessage
+					if err := messageCodec.Receive(c, &msg); err != nil {
+						return
+					}
+					if err := messageCodec.Send(c, msg); err != nil {
+						return
+					}
+				}
+			},
+		})
+		defer backend.Close()
+
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, HandlerConfig{
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+			MessageFramedBuffering:             true,
+		}, tl)
+		err := handler.AddConnectionToPool(testBackendUrl(backend))
+		assert.Nil(t, err)
+		proxy := httptest.NewServer(handler)
+		defer proxy.Close()
+
+		proxyUrl := testBackendUrl(proxy) + "/" + uuid.New().String()
+		client, err := websocket.Dial(proxyUrl, "", "http://localhost")
+		assert.Nil(t, err)
+		defer client.Close()
+
+		err = websocket.Message.Send(client, "text message")
+		assert.Nil(t, err)
+		err = websocket.Message.Send(client, []byte{0, 1, 2})
+		assert.Nil(t, err)
+
+		_ = client.SetReadDeadline(time.Now().Add(time.Second * 10))
+		var msg wsMessage
+		err = messageCodec.Receive(client, &msg)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(websocket.TextFrame), msg.payloadType)
+		assert.Equal(t, "text message", string(msg.data))
+
+		err = messageCodec.Receive(client, &msg)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(websocket.BinaryFrame), msg.payloadType)
+		assert.Equal(t, []byte{0, 1, 2}, msg.data)
+	})
+}
@@ -0,0 +1,156 @@
+package interruptible_websocket_proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics Optional prometheus metrics for the backend pool and pipes. A Metrics instance is meant to be shared by one
+// pool and one pipe manager, a nil *Metrics records nothing
+type Metrics struct {
+	namespace       string
+	registry        *prometheus.Registry
+	failovers       prometheus.Counter
+	copiedBytes     *prometheus.CounterVec
+	droppedBytes    *prometheus.CounterVec
+	getConnWaitTime prometheus.Histogram
+}
+
+// NewMetrics Creates metrics registered to a dedicated registry, every metric name is prefixed with namespace
+func NewMetrics(namespace string) *Metrics {
+	m := &Metrics{
+		namespace: namespace,
+		registry:  prometheus.NewRegistry(),
+		failovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_failovers_total",
+			Help:      "Number of times a pipe was moved to another backend after its backend connection failed",
+		}),
+		copiedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipe_copied_bytes_total",
+			Help:      "Number of bytes copied by pipes, by direction",
+		}, []string{"direction"}),
+		droppedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipe_dropped_bytes_total",
+			Help:      "Number of bytes dropped by pipes as their buffer overflowed, by direction",
+		}, []string{"direction"}),
+		getConnWaitTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pool_get_conn_wait_seconds",
+			Help:      "Time taken to obtain a backend connection from the pool",
+			Buckets:   []float64{.005, .01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		}),
+	}
+	m.registry.MustRegister(m.failovers, m.copiedBytes, m.droppedBytes, m.getConnWaitTime)
+	return m
+}
+
+// Handler Serves the metrics in prometheus exposition format, can be mounted next to the proxy handler
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry Registry holding the metrics, useful to gather them along with other metrics of the application
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+func (m *Metrics) observeFailover() {
+	if m == nil {
+		return
+	}
+	m.failovers.Inc()
+}
+
+func (m *Metrics) observeCopiedBytes(cd CopyDirection, n int) {
+	if m == nil {
+		return
+	}
+	m.copiedBytes.WithLabelValues(cd.String()).Add(float64(n))
+}
+
+func (m *Metrics) observeDroppedBytes(cd CopyDirection, n int) {
+	if m == nil {
+		return
+	}
+	m.droppedBytes.WithLabelValues(cd.String()).Add(float64(n))
+}
+
+func (m *Metrics) observeGetConnWait(startedAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.getConnWaitTime.Observe(time.Since(startedAt).Seconds())
+}
+
+// registerPool Exposes the idle, in use and errored connection counts of the pool
+func (m *Metrics) registerPool(bp *BackendWSConnPool) {
+	m.registry.MustRegister(
+		m.newGaugeFunc("pool_idle_connections", "Number of backend connections waiting to be handed out", func() float64 {
+			bp.idleConnMutex.Lock()
+			defer bp.idleConnMutex.Unlock()
+			return float64(bp.idleConnections.Len())
+		}),
+		m.newGaugeFunc("pool_in_use_connections", "Number of backend connections used by pipes", func() float64 {
+			return float64(countSyncMap(&bp.inUseMap))
+		}),
+		m.newGaugeFunc("pool_errored_connections", "Number of backend connections waiting to be refreshed after an error", func() float64 {
+			bp.erroredConnMutex.Lock()
+			defer bp.erroredConnMutex.Unlock()
+			return float64(bp.erroredConnections.Len())
+		}),
+	)
+}
+
+// registerPipeManager Exposes the number of active pipes and the bytes they currently hold during interruptions
+func (m *Metrics) registerPipeManager(pm *WebsocketPipeManager) {
+	bufferedBytes := func(cd CopyDirection) func() float64 {
+		return func() float64 {
+			var total int
+			pm.clientPipesMap.Range(func(key, value any) bool {
+				total += value.(*PersistentPipe).bufferedBytes(cd)
+				return true
+			})
+			return float64(total)
+		}
+	}
+	bufferedBytesHelp := "Number of bytes currently held by pipes while the other end is unavailable, by direction"
+	m.registry.MustRegister(
+		m.newGaugeFunc("active_pipes", "Number of pipes currently managed", func() float64 {
+			return float64(countSyncMap(&pm.clientPipesMap))
+		}),
+		m.newGaugeFunc("pipe_memory_used_bytes", "Number of bytes held by all pipes together, counted against the global memory limit", func() float64 {
+			return float64(pm.MemoryUsed())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   m.namespace,
+			Name:        "pipe_buffered_bytes",
+			Help:        bufferedBytesHelp,
+			ConstLabels: prometheus.Labels{"direction": CopyToBackend.String()},
+		}, bufferedBytes(CopyToBackend)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   m.namespace,
+			Name:        "pipe_buffered_bytes",
+			Help:        bufferedBytesHelp,
+			ConstLabels: prometheus.Labels{"direction": CopyFromBacked.String()},
+		}, bufferedBytes(CopyFromBacked)),
+	)
+}
+
+func (m *Metrics) newGaugeFunc(name, help string, function func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: m.namespace, Name: name, Help: help}, function)
+}
+
+func countSyncMap(m *sync.Map) int {
+	count := 0
+	m.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	return count
+}
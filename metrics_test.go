@@ -0,0 +1,72 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatheredValue Value of the gauge/counter, or sample count of the histogram, with the given name
+func gatheredValue(t *testing.T, metrics *Metrics, name string) float64 {
+	families, err := metrics.Registry().Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		var total float64
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetGauge() != nil:
+				total += metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				total += metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				total += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+		return total
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldExposePoolStateAndGetConnWaitTime", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Second)
+		metrics := NewMetrics("proxy")
+		pool := NewBackendConnPool(5, 100, tl)
+		pool.SetMetrics(metrics)
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, float64(1), gatheredValue(t, metrics, "proxy_pool_in_use_connections"))
+		assert.Equal(t, float64(0), gatheredValue(t, metrics, "proxy_pool_idle_connections"))
+		assert.Equal(t, float64(1), gatheredValue(t, metrics, "proxy_pool_get_conn_wait_seconds"))
+
+		pool.MarkError(conn)
+		assert.Equal(t, float64(0), gatheredValue(t, metrics, "proxy_pool_in_use_connections"))
+		assert.Equal(t, float64(1), gatheredValue(t, metrics, "proxy_pool_errored_connections"))
+	})
+
+	t.Run("ShouldServeMetricsOverHttp", func(t *testing.T) {
+		metrics := NewMetrics("proxy")
+		pipeManager := NewWebsocketPipeManager(NewBackendConnPool(5, 100, tl), 1024, tl)
+		pipeManager.SetMetrics(metrics)
+		metrics.observeCopiedBytes(CopyToBackend, 10)
+
+		recorder := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+		assert.True(t, strings.Contains(body, "proxy_active_pipes 0"))
+		assert.True(t, strings.Contains(body, `proxy_pipe_buffered_bytes{direction="from_backend"} 0`))
+		assert.True(t, strings.Contains(body, `proxy_pipe_copied_bytes_total{direction="to_backend"} 10`))
+	})
+}
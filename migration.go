@@ -0,0 +1,188 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMigrationTimeout Bounds obtaining the new backend and waiting for the old one to close, see SetMigrationTimeout
+const defaultMigrationTimeout = time.Second * 10
+
+// SetMigrationTimeout Bounds each of the two waits of MigratePipe, obtaining a connection to the new backend and
+// waiting for the old backend to close after the close frame. Defaults to 10s
+func (pm *WebsocketPipeManager) SetMigrationTimeout(timeout time.Duration) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.migrationTimeout = timeout
+}
+
+func (pm *WebsocketPipeManager) currentMigrationTimeout() time.Duration {
+	pm.settingsMut.RLock()
+	defer pm.settingsMut.RUnlock()
+	if pm.migrationTimeout <= 0 {
+		return defaultMigrationTimeout
+	}
+	return pm.migrationTimeout
+}
+
+// MigratePipe Moves the live pipe of the client to another backend without the client noticing. Data from the client
+// is held while a connection to the backend url targetUrl is obtained, an empty targetUrl leaves the pick to the pool
+// among the backends other than the current one.
+// The held data is then replayed to the new backend and the client carries on with it, while the old backend is sent
+// a normal close frame and whatever it still sends is delivered to the client before data from the new backend.
+// The old connection is given back to the pool once the backend closes it, or forcibly after the migration timeout.
+// Returns ErrPipeNotFound if the client has no pipe, or an error if no connection to the target could be obtained
+// within the migration timeout, in which case the pipe carries on with its current backend
+func (pm *WebsocketPipeManager) MigratePipe(clientId uuid.UUID, targetUrl string) error {
+	value, ok := pm.clientPipesMap.Load(clientId)
+	if !ok {
+		return ErrPipeNotFound
+	}
+	persistentPipe := value.(*PersistentPipe)
+	if err := persistentPipe.beginPlannedMigration(); err != nil {
+		return fmt.Errorf("error migrating pipe associated with client id %s: %w", clientId, err)
+	}
+	timeout := pm.currentMigrationTimeout()
+	backendConn, err := pm.obtainMigrationTarget(persistentPipe, targetUrl, timeout)
+	if err != nil {
+		if flushErr := persistentPipe.endPlannedMigration(false); flushErr != nil {
+			pm.logger.Warn(fmt.Sprintf("error writing held data to backend for client id: %s", clientId), flushErr)
+		}
+		return fmt.Errorf("error migrating pipe associated with client id %s: %w", clientId, err)
+	}
+	oldConn, retired, done := persistentPipe.swapBackend(backendConn)
+	if oldConn == nil {
+		pm.backendPool.Release(backendConn)
+		if flushErr := persistentPipe.endPlannedMigration(false); flushErr != nil {
+			pm.logger.Warn(fmt.Sprintf("error writing held data to backend for client id: %s", clientId), flushErr)
+		}
+		return fmt.Errorf("error migrating pipe associated with client id %s: pipe stopped or its backend failed meanwhile", clientId)
+	}
+	pm.rememberBackend(clientId, backendConn)
+	if err := persistentPipe.endPlannedMigration(true); err != nil {
+		// Read side of the new backend reports the failure and the pipe fails over from there
+		pm.logger.Warn(fmt.Sprintf("error replaying held data to migrated backend for client id: %s", clientId), err)
+	}
+	pm.retireBackend(oldConn.(*BackendConn), retired, done, timeout)
+	pm.logger.Debug(fmt.Sprintf("migrated pipe associated with client id %s from %s to %s", clientId,
+		oldConn.(*BackendConn).connUrl, backendConn.connUrl))
+	return nil
+}
+
+// obtainMigrationTarget Obtains a connection to the target backend url, or any backend other than the current one
+// when targetUrl is empty
+func (pm *WebsocketPipeManager) obtainMigrationTarget(persistentPipe *PersistentPipe, targetUrl string, timeout time.Duration) (*BackendConn, error) {
+	ctx, cancel := context.WithTimeout(pm.dialContext(persistentPipe), timeout)
+	defer cancel()
+	if targetUrl != "" {
+		ctx = WithPreferredBackend(ctx, targetUrl)
+	} else if currentConn, ok := persistentPipe.currentBackend().(*BackendConn); ok {
+		ctx = withExcludedBackend(ctx, currentConn.connUrl)
+	}
+	backendConn, err := pm.backendPool.GetConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if targetUrl != "" && backendConn.connUrl != targetUrl {
+		pm.backendPool.Release(backendConn)
+		return nil, fmt.Errorf("backend url: %s is at capacity or unavailable", targetUrl)
+	}
+	return backendConn, nil
+}
+
+type excludedBackendKey struct{}
+
+// withExcludedBackend Asks GetConn not to hand out the backend url, as for a pipe moving off it
+func withExcludedBackend(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, excludedBackendKey{}, url)
+}
+
+// excludedBackendFromContext Backend url not to be handed out for the connection being obtained, empty if none
+func excludedBackendFromContext(ctx context.Context) string {
+	url, _ := ctx.Value(excludedBackendKey{}).(string)
+	return url
+}
+
+// retireBackend Sends the backend a pipe migrated away from a normal close frame and waits for the pipe to be done
+// reading from it, the read is interrupted once the timeout elapses. The connection is given back to the pool after
+func (pm *WebsocketPipeManager) retireBackend(oldConn *BackendConn, retired, done chan struct{}, timeout time.Duration) {
+	if ws, ok := asWebsocketConn(oldConn); ok {
+		if err := writeCloseFrame(ws, closeStatusNormal, "migrated"); err != nil {
+			interruptRead(oldConn)
+		}
+	} else {
+		interruptRead(oldConn)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-retired:
+	case <-done:
+	case <-timer.C:
+		pm.logger.Warn(fmt.Sprintf("backend %s did not close within migration timeout, closing it", oldConn.connUrl), nil)
+		interruptRead(oldConn)
+		select {
+		case <-retired:
+		case <-done:
+		}
+	}
+	// Backend did nothing wrong, its socket is done with and is not to be handed out as is
+	closeBackendConn(oldConn)
+	pm.backendPool.Release(oldConn)
+}
+
+// MigrateAllFrom Drains the backend url and moves every pipe using it to other backends through MigratePipe, for
+// taking a backend out without its clients noticing, e.g. during a rolling deploy. The url is de-registered once the
+// last pipe has moved, add it back once it is ready to serve again. Pipes are migrated concurrently, returns the number
+// of pipes migrated along with an error listing the pipes which could not be, those carry on with the drained backend
+func (pm *WebsocketPipeManager) MigrateAllFrom(backendUrl string) (int, error) {
+	if err := pm.backendPool.Drain(backendUrl); err != nil {
+		// Already draining or not registered anymore, pipes still using the url are moved all the same
+		pm.logger.Debug(fmt.Sprintf("not draining backend url before migrating its pipes: %s", err))
+	}
+	var clientIds []uuid.UUID
+	pm.clientPipesMap.Range(func(key, value any) bool {
+		if backendConn, _ := value.(*PersistentPipe).heldBackend(); isBackendOf(backendConn, backendUrl) {
+			clientIds = append(clientIds, key.(uuid.UUID))
+		}
+		return true
+	})
+
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	var errs []string
+	migrated := 0
+	for _, clientId := range clientIds {
+		wg.Add(1)
+		go func(clientId uuid.UUID) {
+			defer wg.Done()
+			err := pm.MigratePipe(clientId, "")
+			mut.Lock()
+			defer mut.Unlock()
+			switch {
+			case err == nil:
+				migrated++
+			case !errors.Is(err, ErrPipeNotFound):
+				// A pipe closed meanwhile has nothing left to migrate
+				errs = append(errs, err.Error())
+			}
+		}(clientId)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return migrated, fmt.Errorf("error migrating %d pipes off backend url %s: %s", len(errs), backendUrl, strings.Join(errs, "; "))
+	}
+	return migrated, nil
+}
+
+// isBackendOf Whether the connection held by a pipe is a connection to the backend url
+func isBackendOf(conn io.ReadWriteCloser, backendUrl string) bool {
+	backendConn, ok := conn.(*BackendConn)
+	return ok && backendConn.connUrl == backendUrl
+}
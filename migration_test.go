@@ -0,0 +1,146 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// assertEcho Writes the message through the client peer and expects it back from the echo backend
+func assertEcho(t *testing.T, clientPeer net.Conn, message string) {
+	_, err := clientPeer.Write([]byte(message))
+	assert.Nil(t, err)
+	buf := make([]byte, 64)
+	n, err := clientPeer.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, message, string(buf[:n]))
+}
+
+func TestWebsocketPipeManager_MigratePipe(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldMoveLivePipeToTargetBackend", func(t *testing.T) {
+		// Old backend echoes with a delay, its reply is still delivered after the pipe moved
+		oldUrl, newUrl := newTestEchoBackend(t, time.Millisecond*500), newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetMigrationTimeout(time.Second * 5)
+		assert.Nil(t, pipeManager.AddConnectionToPool(oldUrl))
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return pool.InUseCount(oldUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+		assert.Nil(t, pipeManager.AddConnectionToPool(newUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		_, err := clientPeer.Write([]byte("before"))
+		assert.Nil(t, err)
+		startedAt := time.Now()
+		migrateErr := make(chan error, 1)
+		go func() {
+			migrateErr <- pipeManager.MigratePipe(clientId, newUrl)
+		}()
+		buf := make([]byte, 64)
+		n, err := clientPeer.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "before", string(buf[:n]))
+		assert.Nil(t, <-migrateErr)
+		// Old backend closed on the close frame rather than on the migration timeout
+		assert.Less(t, time.Since(startedAt), time.Second*4)
+
+		assert.Equal(t, 0, pool.InUseCount(oldUrl))
+		assert.Equal(t, 1, pool.InUseCount(newUrl))
+		for _, backend := range pool.Backends() {
+			assert.Equal(t, 0, backend.ErrorsInWindow)
+		}
+		assertEcho(t, clientPeer, "after")
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+
+	t.Run("ShouldMoveToAnotherBackendWhenNoTargetIsGiven", func(t *testing.T) {
+		oldUrl, newUrl := newTestEchoBackend(t, 0), newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		assert.Nil(t, pipeManager.AddConnectionToPoolWithCapacity(oldUrl, 2))
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return pool.InUseCount(oldUrl) == 1 && idleLen(pool) == 1
+		}, time.Second*10, time.Millisecond*50)
+		// Current backend can take another pipe and its idle entry is ahead of the new one
+		assert.Nil(t, pipeManager.AddConnectionToPool(newUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 2
+		}, time.Second*10, time.Millisecond*50)
+
+		assert.Nil(t, pipeManager.MigratePipe(clientId, ""))
+		assert.Equal(t, 0, pool.InUseCount(oldUrl))
+		assert.Equal(t, 1, pool.InUseCount(newUrl))
+		assertEcho(t, clientPeer, "after")
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+
+	t.Run("ShouldCarryOnWithCurrentBackendWhenTargetIsUnavailable", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		pipeManager.SetMigrationTimeout(time.Second)
+		assert.Nil(t, pipeManager.AddConnectionToPool(expUrl))
+		clientId := uuid.New()
+		clientPeer, pipeErr := startTestPipe(pipeManager, clientId)
+		assert.Eventually(t, func() bool {
+			return pool.InUseCount(expUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		assert.NotNil(t, pipeManager.MigratePipe(clientId, "ws://localhost:1"))
+		assert.Equal(t, ErrPipeNotFound, pipeManager.MigratePipe(uuid.New(), expUrl))
+		assertEcho(t, clientPeer, "still here")
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+}
+
+func TestWebsocketPipeManager_MigrateAllFrom(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldMoveEveryPipeOffTheBackendAndDrainIt", func(t *testing.T) {
+		oldUrl, newUrl := newTestEchoBackend(t, 0), newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		defer pipeManager.Shutdown(context.Background())
+		assert.Nil(t, pipeManager.AddConnectionToPoolWithCapacity(oldUrl, 2))
+		var clientPeers []net.Conn
+		for i := 0; i < 2; i++ {
+			clientPeer, _ := startTestPipe(pipeManager, uuid.New())
+			clientPeers = append(clientPeers, clientPeer)
+		}
+		assert.Eventually(t, func() bool {
+			return pool.InUseCount(oldUrl) == 2
+		}, time.Second*10, time.Millisecond*50)
+		assert.Nil(t, pipeManager.AddConnectionToPoolWithCapacity(newUrl, 2))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 2
+		}, time.Second*10, time.Millisecond*50)
+
+		migrated, err := pipeManager.MigrateAllFrom(oldUrl)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, migrated)
+		assert.Equal(t, 2, pool.InUseCount(newUrl))
+		_, ok := pool.loadRegistration(oldUrl)
+		assert.False(t, ok)
+		for _, clientPeer := range clientPeers {
+			assertEcho(t, clientPeer, "moved")
+		}
+	})
+}
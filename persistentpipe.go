@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type PersistentPipe struct {
@@ -18,24 +20,123 @@ type PersistentPipe struct {
 	BackendConn   io.ReadWriteCloser
 	ClientErr     error
 	BackendErr    error
-	// streamMut useful to update streamOn state
+	// streamMut useful to update streamOn state, it guards BackendConn and BackendErr as well once the stream is on
 	streamMut sync.Mutex
 	// streamOn useful to quickly check if stream is on, used to avoid duplicate streams
-	streamOn        bool
-	backendBuffer   []byte
-	bufferByteLimit int
+	streamOn bool
+	// backendDetached is set while an errored backend connection is being substituted. migrating is set when the
+	// backend connection was dropped on purpose to move the pipe, preferably to the backend url migrateTo
+	backendDetached bool
+	migrating       bool
+	migrateTo       string
+	// plannedMigration is set while MigratePipe moves the pipe, retiringBackend is the backend connection it moved
+	// away from, which is still read from till it closes. retired is closed once it is done with
+	plannedMigration bool
+	retiringBackend  io.ReadWriteCloser
+	retired          chan struct{}
+	// done is closed when the stream is stopped, copyWg tracks the copy routines of the running stream
+	done    chan struct{}
+	errChan chan error
+	copyWg  sync.WaitGroup
+	// clientMut guards the client side of the pipe, which can go away and be attached again while the backend stays on
+	clientMut sync.Mutex
+	// holdForClient keeps the backend streaming into clientBuffer after the client is gone, till a client attaches again
+	holdForClient    bool
+	clientBuffer     PipeBuffer
+	clientBufferFull bool
+	// clientQueue holds all data from the backend for a writer routine of its own, in place of clientBuffer, when the
+	// pipe buffers for the client
+	clientQueue *clientQueue
+	// clientDone, clientGraceTimer and clientHandshake are maintained by the pipe manager for the currently attached
+	// client, clientGracePeriod is the reconnect grace period the pipe was created with
+	clientDone        chan error
+	clientGraceTimer  *time.Timer
+	clientHandshake   *ClientHandshake
+	clientGracePeriod time.Duration
+	closeOnce         sync.Once
+	createdAt         time.Time
+	// backendMut guards writes to the backend along with the data held in backendBuffer, data is held as well while
+	// backendPaused is set
+	backendMut    sync.Mutex
+	backendBuffer PipeBuffer
+	backendPaused bool
+	// bootstrap records client messages delivered to the backend which a replacement backend is sent first, reliable
+	// holds the client messages till the backend acknowledges them in reliable delivery mode, in place of backendBuffer
+	bootstrap *bootstrapLog
+	reliable  *reliableLog
+	// budget accounts the data held by the pipe against the global memory limit, budgetMut guards reservedBytes, the
+	// bytes the pipe accounts for, and evicted, set once the pipe gave them back to make room for others
+	budget        *memoryBudget
+	budgetMut     sync.Mutex
+	reservedBytes int64
+	evicted       bool
+	// backendBufferedBytes and clientBufferedBytes mirror the size of the buffers for lock free reads
+	backendBufferedBytes int64
+	clientBufferedBytes  int64
+	metrics              *Metrics
+	// messageFramed copies whole websocket messages with their payload type instead of raw chunks of the byte stream,
+	// so that data held during an interruption is replayed on message boundaries
+	messageFramed bool
+}
+
+// readDeadliner Connections whose blocked reads can be interrupted, both websocket.Conn and net.Conn satisfy this
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// writeDeadliner Connections whose blocked writes can be interrupted, both websocket.Conn and net.Conn satisfy this
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
 }
 
 // NewPersistentPipe Creates a new preempt-able websocket pipe
 func NewPersistentPipe(clientID uuid.UUID, clientConn, backendConn io.ReadWriteCloser, interruptMemoryLimitPerConnInBytes int) *PersistentPipe {
 	return &PersistentPipe{
-		ID:              uuid.New(),
-		ClientID:        clientID,
-		ClientConn:      clientConn,
-		BackendConn:     backendConn,
-		bufferByteLimit: interruptMemoryLimitPerConnInBytes,
-		backendBuffer:   make([]byte, 0, interruptMemoryLimitPerConnInBytes),
+		ID:            uuid.New(),
+		ClientID:      clientID,
+		ClientConn:    clientConn,
+		BackendConn:   backendConn,
+		backendBuffer: NewMemoryPipeBuffer(interruptMemoryLimitPerConnInBytes),
+		clientBuffer:  NewMemoryPipeBuffer(interruptMemoryLimitPerConnInBytes),
+		createdAt:     time.Now(),
+	}
+}
+
+// useBuffers Replaces the default in-memory buffers of the pipe with the ones created by the factory
+func (pep *PersistentPipe) useBuffers(factory PipeBufferFactory) {
+	pep.backendBuffer = factory(pep.ID, CopyToBackend)
+	pep.clientBuffer = factory(pep.ID, CopyFromBacked)
+}
+
+// bufferedBytes Number of bytes currently held for the given direction
+func (pep *PersistentPipe) bufferedBytes(cd CopyDirection) int {
+	if cd == CopyToBackend {
+		return int(atomic.LoadInt64(&pep.backendBufferedBytes))
+	}
+	return int(atomic.LoadInt64(&pep.clientBufferedBytes))
+}
+
+// closeBuffers Discards any data still held by the pipe, to be called once the pipe is stopped
+func (pep *PersistentPipe) closeBuffers() {
+	pep.backendMut.Lock()
+	if err := pep.backendBuffer.Close(); err != nil {
+		log.Printf("WARN: error closing backend buffer of pipe %s: %s", pep.ID, err)
+	}
+	if pep.reliable != nil {
+		pep.releaseMemory(pep.reliable.clear())
+	}
+	atomic.StoreInt64(&pep.backendBufferedBytes, 0)
+	pep.backendMut.Unlock()
+	pep.clientMut.Lock()
+	if err := pep.clientBuffer.Close(); err != nil {
+		log.Printf("WARN: error closing client buffer of pipe %s: %s", pep.ID, err)
+	}
+	if pep.clientQueue != nil {
+		pep.releaseMemory(pep.clientQueue.queue.size)
+		pep.clientQueue.queue = messageQueue{}
 	}
+	atomic.StoreInt64(&pep.clientBufferedBytes, 0)
+	pep.clientMut.Unlock()
 }
 
 // Stream runs back and forth stream copy between clientConn and backendConn
@@ -50,18 +151,329 @@ func (pep *PersistentPipe) Stream() error {
 	if pep.ClientConn == nil || pep.BackendConn == nil {
 		return fmt.Errorf("error streaming, either of the connections are nil, clientConn: %v, backendConn: %v", pep.ClientConn, pep.BackendConn)
 	}
-	go pep.copyBuffer(CopyToBackend, errChan)
-	go pep.copyBuffer(CopyFromBacked, errChan)
-	go pep.listenForErrors(errChan)
+	if pep.messageFramed {
+		if _, ok := asWebsocketConn(pep.ClientConn); !ok {
+			return fmt.Errorf("error streaming, message framed pipe requires a websocket client connection")
+		}
+		if _, ok := asWebsocketConn(pep.BackendConn); !ok {
+			return fmt.Errorf("error streaming, message framed pipe requires a websocket backend connection")
+		}
+	} else if pep.reliable != nil {
+		return fmt.Errorf("error streaming, reliable delivery requires message framed buffering")
+	}
+	done := make(chan struct{})
+	pep.done = done
+	pep.errChan = errChan
+	pep.copyWg.Add(2)
+	go pep.copyBuffer(CopyToBackend, errChan, done)
+	go pep.copyBuffer(CopyFromBacked, errChan, done)
+	if pep.clientQueue != nil {
+		pep.copyWg.Add(1)
+		go pep.writeQueuedToClient(errChan, done)
+	}
+	go pep.listenForErrors(errChan, done)
 	pep.streamOn = true
 	return nil
 }
 
-func (pep *PersistentPipe) listenForErrors(errChan chan error) {
+// Stop Stops copying in both directions and waits for the copy routines to exit. Connections are left open, so the
+// backend connection can still be handed back to the pool. Reads on connections which cannot take a read deadline
+// are not interrupted, Stop waits for them to return on their own
+func (pep *PersistentPipe) Stop() {
+	pep.streamMut.Lock()
+	if pep.done == nil {
+		pep.streamMut.Unlock()
+		return
+	}
+	close(pep.done)
+	pep.done = nil
+	pep.streamOn = false
+	backendConn, retiringBackend := pep.BackendConn, pep.retiringBackend
+	pep.streamMut.Unlock()
+
+	pep.clientMut.Lock()
+	clientConn := pep.ClientConn
+	pep.clientMut.Unlock()
+	interruptRead(clientConn)
+	interruptRead(backendConn)
+	if retiringBackend != nil {
+		interruptRead(retiringBackend)
+	}
+	if pep.clientQueue != nil {
+		interruptWrite(clientConn)
+	}
+	pep.copyWg.Wait()
+	resetReadDeadline(clientConn)
+	resetReadDeadline(backendConn)
+	if pep.clientQueue != nil {
+		resetWriteDeadline(clientConn)
+	}
+}
+
+// AttachClient Attaches a reconnected client to a pipe whose previous client went away. Data held from the backend
+// in the meantime is flushed to the new client before the stream from the client resumes
+func (pep *PersistentPipe) AttachClient(clientConn io.ReadWriteCloser) error {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.done == nil {
+		return fmt.Errorf("pipe is not streaming anymore")
+	}
+	pep.clientMut.Lock()
+	defer pep.clientMut.Unlock()
+	if pep.ClientErr == nil {
+		return fmt.Errorf("a client is still attached to the pipe")
+	}
+	if pep.clientQueue != nil {
+		// Writer routine carries on with the data held for the new client
+		pep.ClientConn = clientConn
+		pep.ClientErr = nil
+		pep.clientQueue.wakeWriter()
+		pep.copyWg.Add(1)
+		go pep.copyBuffer(CopyToBackend, pep.errChan, pep.done)
+		return nil
+	}
+	err := pep.clientBuffer.Flush(func(payloadType byte, data []byte) error {
+		return pep.writeFrame(clientConn, wsMessage{payloadType: payloadType, data: data})
+	})
+	atomic.StoreInt64(&pep.clientBufferedBytes, int64(pep.clientBuffer.Size()))
+	if err != nil {
+		return err
+	}
+	pep.ClientConn = clientConn
+	pep.ClientErr = nil
+	pep.copyWg.Add(1)
+	go pep.copyBuffer(CopyToBackend, pep.errChan, pep.done)
+	return nil
+}
+
+// detachErroredBackend Takes the errored backend connection off the pipe so that it can be marked in the pool,
+// returns nil if the stream is already stopped
+func (pep *PersistentPipe) detachErroredBackend() io.ReadWriteCloser {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.done == nil || pep.backendDetached {
+		return nil
+	}
+	pep.backendDetached = true
+	return pep.BackendConn
+}
+
+// attachBackend Resumes the pipe with a substituted backend connection, returns false if the stream got stopped meanwhile
+func (pep *PersistentPipe) attachBackend(backendConn io.ReadWriteCloser) bool {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.done == nil {
+		return false
+	}
+	pep.BackendConn = backendConn
+	pep.BackendErr = nil
+	pep.backendDetached = false
+	return true
+}
+
+// startMigration Flags the pipe for moving off its backend connection, which is returned to be dropped. Returns nil
+// if the pipe is stopped or its backend is already errored or being substituted
+func (pep *PersistentPipe) startMigration(targetUrl string) io.ReadWriteCloser {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.done == nil || pep.backendDetached || pep.migrating || pep.plannedMigration || pep.BackendErr != nil {
+		return nil
+	}
+	pep.migrating = true
+	pep.migrateTo = targetUrl
+	return pep.BackendConn
+}
+
+// takeMigration Clears the migration flag of the pipe, returns whether it was set along with the target backend url
+func (pep *PersistentPipe) takeMigration() (bool, string) {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	migrating, targetUrl := pep.migrating, pep.migrateTo
+	pep.migrating, pep.migrateTo = false, ""
+	return migrating, targetUrl
+}
+
+// beginPlannedMigration Holds data from the client in the backend buffer from now on, returns an error if the pipe
+// is not streaming from a backend or is already moving to another one
+func (pep *PersistentPipe) beginPlannedMigration() error {
+	pep.streamMut.Lock()
+	if pep.done == nil || pep.backendDetached || pep.migrating || pep.plannedMigration || pep.BackendErr != nil {
+		pep.streamMut.Unlock()
+		return fmt.Errorf("pipe is not streaming from a backend or is already moving to another one")
+	}
+	pep.plannedMigration = true
+	pep.streamMut.Unlock()
+
+	pep.backendMut.Lock()
+	pep.backendPaused = true
+	pep.backendMut.Unlock()
+	return nil
+}
+
+// swapBackend Makes the given connection the backend of the pipe, the previous one is read from till it closes.
+// Returns the previous connection along with the channel closed once it is done with and the done channel of the
+// stream, nil if the stream got stopped or its backend errored meanwhile
+func (pep *PersistentPipe) swapBackend(backendConn io.ReadWriteCloser) (io.ReadWriteCloser, chan struct{}, chan struct{}) {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.done == nil || pep.backendDetached || pep.BackendErr != nil {
+		return nil, nil, nil
+	}
+	pep.retiringBackend = pep.BackendConn
+	pep.retired = make(chan struct{})
+	pep.BackendConn = backendConn
+	return pep.retiringBackend, pep.retired, pep.done
+}
+
+// endPlannedMigration Resumes writing to the backend, data held meanwhile is written first. The bootstrap log is
+// replayed ahead of it when the backend was swapped
+func (pep *PersistentPipe) endPlannedMigration(swapped bool) error {
+	pep.backendMut.Lock()
+	pep.backendPaused = false
+	var err error
+	if swapped && pep.backendErr() == nil {
+		err = pep.replayBootstrapLocked()
+		pep.resendAllUnacked()
+	}
+	if err == nil && pep.backendErr() == nil {
+		err = pep.flushBackendBufferLocked()
+	}
+	pep.backendMut.Unlock()
+
+	pep.streamMut.Lock()
+	pep.plannedMigration = false
+	pep.streamMut.Unlock()
+	return err
+}
+
+// currentBackend Backend connection data from the client is written to
+func (pep *PersistentPipe) currentBackend() io.ReadWriteCloser {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	return pep.BackendConn
+}
+
+// backendErr Error seen on the current backend connection, nil till one is reported
+func (pep *PersistentPipe) backendErr() error {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	return pep.BackendErr
+}
+
+// reportBackendErr Records the first error seen on the current backend connection, returns false if one was already
+// recorded
+func (pep *PersistentPipe) reportBackendErr(err error) bool {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.BackendErr != nil {
+		return false
+	}
+	pep.BackendErr = err
+	return true
+}
+
+// clientSource Connection the client side of the pipe is read from
+func (pep *PersistentPipe) clientSource() io.ReadWriteCloser {
+	pep.clientMut.Lock()
+	defer pep.clientMut.Unlock()
+	return pep.ClientConn
+}
+
+// clientErr Error seen on the attached client connection, nil while a client is attached
+func (pep *PersistentPipe) clientErr() error {
+	pep.clientMut.Lock()
+	defer pep.clientMut.Unlock()
+	return pep.ClientErr
+}
+
+// backendSource Connection the backend side of the pipe is read from, the retiring backend as long as there is one
+func (pep *PersistentPipe) backendSource() io.ReadWriteCloser {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.retiringBackend != nil {
+		return pep.retiringBackend
+	}
+	return pep.BackendConn
+}
+
+// retireBackend Done reading from the connection, returns false unless it is the retiring backend
+func (pep *PersistentPipe) retireBackend(conn io.ReadWriteCloser) bool {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.retiringBackend == nil || pep.retiringBackend != conn {
+		return false
+	}
+	pep.retiringBackend = nil
+	close(pep.retired)
+	return true
+}
+
+// heldBackend Returns the backend connection still held by the pipe along with whether it has errored, nil if the
+// connection was already taken off the pipe
+func (pep *PersistentPipe) heldBackend() (io.ReadWriteCloser, bool) {
+	pep.streamMut.Lock()
+	defer pep.streamMut.Unlock()
+	if pep.backendDetached {
+		return nil, false
+	}
+	return pep.BackendConn, pep.BackendErr != nil
+}
+
+// isStopped Whether the given stream has been stopped
+func isStopped(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportClientErr Records the first error seen on the client connection, returns false if one was already recorded
+func (pep *PersistentPipe) reportClientErr(err error) bool {
+	pep.clientMut.Lock()
+	defer pep.clientMut.Unlock()
+	if pep.ClientErr != nil {
+		return false
+	}
+	pep.ClientErr = err
+	return true
+}
+
+func (pep *PersistentPipe) listenForErrors(errChan chan error, done chan struct{}) {
 	for {
-		err := <-errChan
-		log.Printf("error reported to listener: %s", err)
-		pep.streamOn = false
-		pep.ErrorListener(pep.ID, err)
+		select {
+		case err := <-errChan:
+			// streamOn is left to Stream and Stop, the stream carries on while the listener substitutes a backend
+			log.Printf("error reported to listener: %s", err)
+			pep.ErrorListener(pep.ID, err)
+		case <-done:
+			return
+		}
+	}
+}
+
+func interruptRead(conn io.ReadWriteCloser) {
+	if rd, ok := conn.(readDeadliner); ok {
+		_ = rd.SetReadDeadline(time.Now())
+	}
+}
+
+func resetReadDeadline(conn io.ReadWriteCloser) {
+	if rd, ok := conn.(readDeadliner); ok {
+		_ = rd.SetReadDeadline(time.Time{})
+	}
+}
+
+// interruptWrite Makes a write blocked on a client which does not read return
+func interruptWrite(conn io.ReadWriteCloser) {
+	if wd, ok := conn.(writeDeadliner); ok {
+		_ = wd.SetWriteDeadline(time.Now())
+	}
+}
+
+func resetWriteDeadline(conn io.ReadWriteCloser) {
+	if wd, ok := conn.(writeDeadliner); ok {
+		_ = wd.SetWriteDeadline(time.Time{})
 	}
 }
@@ -0,0 +1,214 @@
+package interruptible_websocket_proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrPipeBufferFull Returned by a PipeBuffer when a message does not fit within its limits
+var ErrPipeBufferFull = errors.New("pipe buffer reached max limit")
+
+// PipeBuffer Holds the data of one direction of a pipe, in the order it was received, while the other end is
+// unavailable. payloadType is the websocket payload type of a message in message framed mode, unused otherwise
+type PipeBuffer interface {
+	// Push Holds a copy of data, returns ErrPipeBufferFull if it does not fit within the limits of the buffer
+	Push(payloadType byte, data []byte) error
+	// Flush Writes the held data in order, the data not written is kept when a write fails
+	Flush(write func(payloadType byte, data []byte) error) error
+	// Size Number of bytes held
+	Size() int
+	// Close Discards the held data and releases resources held by the buffer
+	Close() error
+}
+
+// PipeBufferFactory Creates the buffer for the given direction of a pipe
+type PipeBufferFactory func(pipeId uuid.UUID, direction CopyDirection) PipeBuffer
+
+// MemoryPipeBuffer Holds data in memory up to a byte limit
+type MemoryPipeBuffer struct {
+	queue     messageQueue
+	byteLimit int
+}
+
+// NewMemoryPipeBuffer Creates an in-memory buffer holding at most byteLimit bytes
+func NewMemoryPipeBuffer(byteLimit int) *MemoryPipeBuffer {
+	return &MemoryPipeBuffer{byteLimit: byteLimit}
+}
+
+// NewMemoryPipeBufferFactory Creates in-memory buffers of byteLimit for every pipe, this is the default
+func NewMemoryPipeBufferFactory(byteLimit int) PipeBufferFactory {
+	return func(pipeId uuid.UUID, direction CopyDirection) PipeBuffer {
+		return NewMemoryPipeBuffer(byteLimit)
+	}
+}
+
+func (mb *MemoryPipeBuffer) Push(payloadType byte, data []byte) error {
+	if mb.queue.size+len(data) > mb.byteLimit {
+		return ErrPipeBufferFull
+	}
+	mb.queue.push(wsMessage{payloadType: payloadType, data: data})
+	return nil
+}
+
+func (mb *MemoryPipeBuffer) Flush(write func(payloadType byte, data []byte) error) error {
+	return mb.queue.flush(func(msg wsMessage) error {
+		return write(msg.payloadType, msg.data)
+	})
+}
+
+func (mb *MemoryPipeBuffer) Size() int {
+	return mb.queue.size
+}
+
+func (mb *MemoryPipeBuffer) Close() error {
+	mb.queue = messageQueue{}
+	return nil
+}
+
+// FileSpillPipeBuffer Holds data in memory up to a threshold, anything beyond is spilled to a temp file of the pipe
+// up to a separate disk limit. Data in memory is always older than the data on disk, so order is preserved.
+// The temp file is created on the first spill and removed on Close
+type FileSpillPipeBuffer struct {
+	mut             sync.Mutex
+	memory          MemoryPipeBuffer
+	dir             string
+	filePattern     string
+	diskLimit       int
+	file            *os.File
+	diskSize        int
+	readOffset      int64
+	writeOffset     int64
+	pendingMessages int
+}
+
+// spillRecordHeaderSize payload type byte followed by the big endian payload length
+const spillRecordHeaderSize = 5
+
+// NewFileSpillPipeBuffer Creates a buffer holding memoryThreshold bytes in memory and up to diskLimit bytes more in
+// a temp file created under dir, the default temp directory is used if dir is empty
+func NewFileSpillPipeBuffer(dir, filePattern string, memoryThreshold, diskLimit int) *FileSpillPipeBuffer {
+	return &FileSpillPipeBuffer{
+		memory:      MemoryPipeBuffer{byteLimit: memoryThreshold},
+		dir:         dir,
+		filePattern: filePattern,
+		diskLimit:   diskLimit,
+	}
+}
+
+// NewFileSpillPipeBufferFactory Creates file spilling buffers for every pipe, each direction of a pipe gets its own file
+func NewFileSpillPipeBufferFactory(dir string, memoryThreshold, diskLimit int) PipeBufferFactory {
+	return func(pipeId uuid.UUID, direction CopyDirection) PipeBuffer {
+		filePattern := fmt.Sprintf("pipe-%s-%d-*.buf", pipeId, direction)
+		return NewFileSpillPipeBuffer(dir, filePattern, memoryThreshold, diskLimit)
+	}
+}
+
+func (fb *FileSpillPipeBuffer) Push(payloadType byte, data []byte) error {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	if fb.pendingMessages == 0 {
+		if err := fb.memory.Push(payloadType, data); err == nil {
+			return nil
+		}
+	}
+	return fb.spillLocked(payloadType, data)
+}
+
+// spillLocked Appends the data to the spill file, to be called with mut held
+func (fb *FileSpillPipeBuffer) spillLocked(payloadType byte, data []byte) error {
+	if fb.diskSize+len(data) > fb.diskLimit {
+		return ErrPipeBufferFull
+	}
+	if fb.file == nil {
+		file, err := os.CreateTemp(fb.dir, fb.filePattern)
+		if err != nil {
+			return fmt.Errorf("error creating spill file: %w", err)
+		}
+		fb.file = file
+	}
+	record := make([]byte, spillRecordHeaderSize+len(data))
+	record[0] = payloadType
+	binary.BigEndian.PutUint32(record[1:spillRecordHeaderSize], uint32(len(data)))
+	copy(record[spillRecordHeaderSize:], data)
+	if _, err := fb.file.WriteAt(record, fb.writeOffset); err != nil {
+		return fmt.Errorf("error spilling to file: %w", err)
+	}
+	fb.writeOffset += int64(len(record))
+	fb.diskSize += len(data)
+	fb.pendingMessages++
+	return nil
+}
+
+func (fb *FileSpillPipeBuffer) Flush(write func(payloadType byte, data []byte) error) error {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	if err := fb.memory.Flush(write); err != nil {
+		return err
+	}
+	if fb.pendingMessages == 0 {
+		return nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(fb.file, fb.readOffset, fb.writeOffset-fb.readOffset))
+	header := make([]byte, spillRecordHeaderSize)
+	for fb.pendingMessages > 0 {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return fmt.Errorf("error reading spill file: %w", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return fmt.Errorf("error reading spill file: %w", err)
+		}
+		if err := write(header[0], data); err != nil {
+			return err
+		}
+		fb.readOffset += int64(spillRecordHeaderSize + len(data))
+		fb.diskSize -= len(data)
+		fb.pendingMessages--
+	}
+	// Everything on disk is flushed, reuse the file from the start
+	fb.readOffset, fb.writeOffset = 0, 0
+	return fb.file.Truncate(0)
+}
+
+func (fb *FileSpillPipeBuffer) Size() int {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	return fb.memory.Size() + fb.diskSize
+}
+
+// memorySize Number of bytes held in memory, the rest is on disk
+func (fb *FileSpillPipeBuffer) memorySize() int {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	return fb.memory.Size()
+}
+
+// spill Holds a copy of data on disk whether or not it would fit in memory
+func (fb *FileSpillPipeBuffer) spill(payloadType byte, data []byte) error {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	return fb.spillLocked(payloadType, data)
+}
+
+func (fb *FileSpillPipeBuffer) Close() error {
+	fb.mut.Lock()
+	defer fb.mut.Unlock()
+	fb.memory.Close()
+	fb.diskSize, fb.pendingMessages, fb.readOffset, fb.writeOffset = 0, 0, 0, 0
+	if fb.file == nil {
+		return nil
+	}
+	name := fb.file.Name()
+	closeErr := fb.file.Close()
+	fb.file = nil
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return closeErr
+}
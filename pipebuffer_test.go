@@ -0,0 +1,88 @@
+package interruptible_websocket_proxy
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryPipeBuffer(t *testing.T) {
+	t.Run("ShouldRejectDataBeyondByteLimit", func(t *testing.T) {
+		buffer := NewMemoryPipeBuffer(8)
+		assert.Nil(t, buffer.Push(0, []byte("12345")))
+		assert.Equal(t, ErrPipeBufferFull, buffer.Push(0, []byte("6789")))
+		assert.Nil(t, buffer.Push(0, []byte("678")))
+		assert.Equal(t, 8, buffer.Size())
+	})
+}
+
+func TestFileSpillPipeBuffer(t *testing.T) {
+	t.Run("ShouldSpillBeyondMemoryThresholdAndFlushInOrder", func(t *testing.T) {
+		dir := t.TempDir()
+		buffer := NewFileSpillPipeBufferFactory(dir, 4, 16)(uuid.New(), CopyToBackend)
+		for _, data := range []string{"one", "two", "three", "four"} {
+			assert.Nil(t, buffer.Push(1, []byte(data)))
+		}
+		assert.Equal(t, 15, buffer.Size())
+		files, _ := os.ReadDir(dir)
+		assert.Len(t, files, 1)
+
+		var flushed []string
+		err := buffer.Flush(func(payloadType byte, data []byte) error {
+			assert.Equal(t, byte(1), payloadType)
+			flushed = append(flushed, string(data))
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"one", "two", "three", "four"}, flushed)
+		assert.Equal(t, 0, buffer.Size())
+	})
+
+	t.Run("ShouldRejectDataBeyondDiskLimit", func(t *testing.T) {
+		buffer := NewFileSpillPipeBuffer(t.TempDir(), "pipe-*.buf", 4, 6)
+		assert.Nil(t, buffer.Push(0, []byte("1234")))
+		assert.Nil(t, buffer.Push(0, []byte("56789")))
+		assert.Equal(t, ErrPipeBufferFull, buffer.Push(0, []byte("ab")))
+		assert.Equal(t, 9, buffer.Size())
+	})
+
+	t.Run("ShouldKeepSpilledDataWhichCouldNotBeFlushed", func(t *testing.T) {
+		buffer := NewFileSpillPipeBuffer(t.TempDir(), "pipe-*.buf", 0, 64)
+		for _, data := range []string{"one", "two", "three"} {
+			assert.Nil(t, buffer.Push(0, []byte(data)))
+		}
+		var flushed []string
+		err := buffer.Flush(func(payloadType byte, data []byte) error {
+			if string(data) == "two" {
+				return fmt.Errorf("write failed")
+			}
+			flushed = append(flushed, string(data))
+			return nil
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, 8, buffer.Size())
+
+		err = buffer.Flush(func(payloadType byte, data []byte) error {
+			flushed = append(flushed, string(data))
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"one", "two", "three"}, flushed)
+	})
+
+	t.Run("ShouldRemoveSpillFileOnClose", func(t *testing.T) {
+		dir := t.TempDir()
+		buffer := NewFileSpillPipeBuffer(dir, "pipe-*.buf", 0, 64)
+		assert.Nil(t, buffer.Push(0, []byte("data")))
+		matches, _ := filepath.Glob(filepath.Join(dir, "pipe-*.buf"))
+		assert.Len(t, matches, 1)
+
+		assert.Nil(t, buffer.Close())
+		matches, _ = filepath.Glob(filepath.Join(dir, "pipe-*.buf"))
+		assert.Len(t, matches, 0)
+		assert.Equal(t, 0, buffer.Size())
+	})
+}
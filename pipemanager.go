@@ -1,18 +1,37 @@
 package interruptible_websocket_proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrShuttingDown Returned for pipes closed or refused while the pipe manager is shutting down
+var ErrShuttingDown = errors.New("pipe manager is shutting down")
+
+// ErrPipeNotFound Returned when there is no pipe for the given client ID
+var ErrPipeNotFound = errors.New("no pipe found for client")
+
+// ErrPipeClosed Returned to a client session whose pipe was closed through ClosePipe
+var ErrPipeClosed = errors.New("pipe closed")
+
 type PipeErrorListener func(pipeId uuid.UUID, err error)
 
 type ConnectionProviderPool interface {
 	AddToPool(url string) error
-	GetConn() *BackendConn
+	AddToPoolWithCapacity(url string, capacity int) error
+	AddToPoolWithOptions(url string, options BackendOptions) error
+	RemoveFromPool(url string) error
+	Drain(url string) error
+	GetConn(ctx context.Context) (*BackendConn, error)
 	MarkError(conn *BackendConn)
+	Release(conn *BackendConn)
+	Close(ctx context.Context) error
 }
 
 type logger interface {
@@ -28,29 +47,44 @@ type WebsocketPipeManager struct {
 	backendPool ConnectionProviderPool
 	backOffFunc func(counter *int64)
 
+	// settingsMut guards the settings below which can be changed while pipes are running, pipes take them on creation
+	settingsMut                        sync.RWMutex
 	interruptMemoryLimitPerConnInBytes int
-	logger                             logger
+	clientReconnectGracePeriod         time.Duration
+	messageFramedBuffering             bool
+	pipeBufferFactory                  PipeBufferFactory
+	affinity                           *backendAffinity
+	migrationTimeout                   time.Duration
+	bootstrap                          *BootstrapConfig
+	reliableDelivery                   bool
+	clientBufferLimit                  int
+	clientBufferOverflowPolicy         OverflowPolicy
+
+	// memoryBudget accounts the data held by all pipes against the global memory limit
+	memoryBudget *memoryBudget
+
+	metrics      *Metrics
+	logger       logger
+	shuttingDown int32
 }
 
 // NewWebsocketPipeManager Creates a websocket pipe manager with provided connection pool
 func NewWebsocketPipeManager(pool ConnectionProviderPool, interruptMemoryLimitPerConnInBytes int, logger logger) *WebsocketPipeManager {
-	return &WebsocketPipeManager{
+	pm := &WebsocketPipeManager{
 		clientPipesMap:                     sync.Map{},
 		backendPool:                        pool,
 		interruptMemoryLimitPerConnInBytes: interruptMemoryLimitPerConnInBytes,
+		memoryBudget:                       &memoryBudget{},
 		logger:                             logger,
 	}
+	pm.memoryBudget.evict = pm.evictLargestPipes
+	return pm
 }
 
 // NewDefaultWebsocketPipeManager Creates a default pipe manager with given pool configuration as arguments
 func NewDefaultWebsocketPipeManager(maxIdleConnCount, maxAllowedErrorCount int64, interruptMemoryLimitPerConnInBytes int, logger logger) *WebsocketPipeManager {
 	pool := NewBackendConnPool(maxIdleConnCount, maxAllowedErrorCount, logger)
-	return &WebsocketPipeManager{
-		clientPipesMap:                     sync.Map{},
-		backendPool:                        pool,
-		interruptMemoryLimitPerConnInBytes: interruptMemoryLimitPerConnInBytes,
-		logger:                             logger,
-	}
+	return NewWebsocketPipeManager(pool, interruptMemoryLimitPerConnInBytes, logger)
 }
 
 // AddConnectionToPool Can add connection to the pool
@@ -60,45 +94,381 @@ func (pm *WebsocketPipeManager) AddConnectionToPool(url string) error {
 	return pm.backendPool.AddToPool(url)
 }
 
+// AddConnectionToPoolWithCapacity Same as AddConnectionToPool, the backend can serve up to capacity pipes at once
+func (pm *WebsocketPipeManager) AddConnectionToPoolWithCapacity(url string, capacity int) error {
+	return pm.backendPool.AddToPoolWithCapacity(url, capacity)
+}
+
+// AddConnectionToPoolWithOptions Same as AddConnectionToPool, with the capacity and weight of the backend
+func (pm *WebsocketPipeManager) AddConnectionToPoolWithOptions(url string, options BackendOptions) error {
+	return pm.backendPool.AddToPoolWithOptions(url, options)
+}
+
+// RemoveConnectionFromPool Can remove a backend url from the pool right away, a pipe already using it is left untouched
+// but the backend will not be handed out again
+func (pm *WebsocketPipeManager) RemoveConnectionFromPool(url string) error {
+	return pm.backendPool.RemoveFromPool(url)
+}
+
+// DrainConnectionFromPool Stops handing out the backend url to new pipes, pipes already using it can finish or move
+// to another backend. The url is removed from the pool once it is no longer in use
+func (pm *WebsocketPipeManager) DrainConnectionFromPool(url string) error {
+	return pm.backendPool.Drain(url)
+}
+
 // SetBackOffStrategyFunc Can set a custom defined back off function when failed to get new connection for backend
 // The argument for the back off function can be used to pass counter from outside which can help with strategies like exponential backoff etc
 func (pm *WebsocketPipeManager) SetBackOffStrategyFunc(backOffFunc func(counter *int64)) {
 	pm.backOffFunc = backOffFunc
 }
 
+// SetClientReconnectGracePeriod Keeps the pipe and its backend alive for the given period after a client goes away,
+// data from the backend is held (bounded by the interrupt memory limit) till a client with the same client ID reconnects.
+// Zero, the default, tears down the pipe as soon as the client is gone
+func (pm *WebsocketPipeManager) SetClientReconnectGracePeriod(gracePeriod time.Duration) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.clientReconnectGracePeriod = gracePeriod
+}
+
+// SetInterruptMemoryLimitPerConn Sets the memory limit per connection for data held during an interruption, applies to
+// the pipes created afterwards
+func (pm *WebsocketPipeManager) SetInterruptMemoryLimitPerConn(interruptMemoryLimitPerConnInBytes int) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.interruptMemoryLimitPerConnInBytes = interruptMemoryLimitPerConnInBytes
+}
+
+// SetMessageFramedBuffering Makes pipes copy and hold whole websocket messages with their payload type instead of raw
+// chunks of the byte stream, so data replayed after an interruption starts and ends on message boundaries.
+// Requires both client and backend connections to be websocket connections
+func (pm *WebsocketPipeManager) SetMessageFramedBuffering(enabled bool) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.messageFramedBuffering = enabled
+}
+
+// SetPipeBufferFactory Sets the factory creating buffers which hold data of a pipe during an interruption, pipes hold
+// up to the interrupt memory limit in memory when not set. Applies to the pipes created afterwards
+func (pm *WebsocketPipeManager) SetPipeBufferFactory(factory PipeBufferFactory) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.pipeBufferFactory = factory
+}
+
+// SetMetrics Exposes the pipes managed through the given metrics, to be called once before creating pipes.
+// Metrics of the pool are to be set on the pool itself
+func (pm *WebsocketPipeManager) SetMetrics(metrics *Metrics) {
+	pm.metrics = metrics
+	metrics.registerPipeManager(pm)
+}
+
 // CreatePipe This function is a blocking call when the pipe runs till completion.
 // Returns nil if client closed the connection for any reason, otherwise can return error during connection fetch, stream
+// An error wrapping ErrNoBackendAvailable is returned when no backend could be obtained for the pipe
+// If a pipe for the client ID is waiting for its client to reconnect, the connection is attached to that pipe instead
 func (pm *WebsocketPipeManager) CreatePipe(clientId uuid.UUID, conn io.ReadWriteCloser) error {
-	if _, ok := pm.clientPipesMap.Load(clientId); ok {
-		return fmt.Errorf("a pipe already existed with clientId: %s", clientId)
+	return pm.CreatePipeWithHandshake(clientId, conn, nil)
+}
+
+// CreatePipeWithHandshake Same as CreatePipe, additionally the handshake of the client is handed to the backend dialer
+// on every dial for the pipe, failovers included. A reconnecting client replaces the handshake of its pipe
+func (pm *WebsocketPipeManager) CreatePipeWithHandshake(clientId uuid.UUID, conn io.ReadWriteCloser, handshake *ClientHandshake) error {
+	if pm.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	if existing, ok := pm.clientPipesMap.Load(clientId); ok {
+		return pm.resumePipe(clientId, existing.(*PersistentPipe), conn, handshake)
+	}
+	pm.settingsMut.RLock()
+	refused := pm.memoryBudget.refusesClients(pm.interruptMemoryLimitPerConnInBytes)
+	pm.settingsMut.RUnlock()
+	if refused {
+		return ErrMemoryBudgetExceeded
 	}
-	errChan := make(chan error)
 	// Create and get backendConn
-	backendConn := pm.backendPool.GetConn()
+	ctx := pm.withAffinity(WithClientID(WithClientHandshake(context.Background(), handshake), clientId), clientId)
+	backendConn, err := pm.backendPool.GetConn(ctx)
+	if err != nil {
+		return err
+	}
+	pm.rememberBackend(clientId, backendConn)
 
+	pm.settingsMut.RLock()
 	persistentPipe := NewPersistentPipe(clientId, conn, backendConn, pm.interruptMemoryLimitPerConnInBytes)
+	persistentPipe.clientHandshake = handshake
+	persistentPipe.clientGracePeriod = pm.clientReconnectGracePeriod
+	persistentPipe.holdForClient = pm.clientReconnectGracePeriod > 0
+	persistentPipe.messageFramed = pm.messageFramedBuffering
+	if pm.bootstrap != nil {
+		persistentPipe.bootstrap = newBootstrapLog(*pm.bootstrap)
+	}
+	if pm.reliableDelivery {
+		persistentPipe.reliable = &reliableLog{maxBytes: pm.interruptMemoryLimitPerConnInBytes}
+	}
+	if pm.clientBufferLimit > 0 {
+		persistentPipe.clientQueue = newClientQueue(pm.clientBufferLimit, pm.clientBufferOverflowPolicy)
+	}
+	pipeBufferFactory := pm.pipeBufferFactory
+	pm.settingsMut.RUnlock()
+	persistentPipe.metrics = pm.metrics
+	if pipeBufferFactory != nil {
+		persistentPipe.useBuffers(pipeBufferFactory)
+	}
+	persistentPipe.useMemoryBudget(pm.memoryBudget)
+	clientDone := make(chan error, 1)
+	persistentPipe.clientDone = clientDone
 	persistentPipe.ErrorListener = func(pipeId uuid.UUID, err error) {
-		for {
-			if persistentPipe.BackendErr != nil {
-				bc := persistentPipe.BackendConn.(*BackendConn)
-				pm.logger.Warn(fmt.Sprintf("stream for client Id %s interrupted with backend conn %s, attempting another connection", clientId, bc.connUrl), persistentPipe.BackendErr)
+		if backendErr := persistentPipe.backendErr(); backendErr != nil {
+			erroredConn := persistentPipe.detachErroredBackend()
+			if erroredConn == nil {
+				return
+			}
+			bc := erroredConn.(*BackendConn)
+			ctx := pm.dialContext(persistentPipe)
+			if migrating, targetUrl := persistentPipe.takeMigration(); migrating {
+				pm.logger.Debug(fmt.Sprintf("moving pipe for client id %s off backend conn %s", clientId, bc.connUrl))
+				// Backend did nothing wrong, its socket is already closed and is not to be handed out as is
+				closeBackendConn(bc)
+				pm.backendPool.Release(bc)
+				if targetUrl != "" {
+					ctx = WithPreferredBackend(ctx, targetUrl)
+				}
+			} else {
+				pm.logger.Warn(fmt.Sprintf("stream for client Id %s interrupted with backend conn %s, attempting another connection", clientId, bc.connUrl), backendErr)
 				pm.backendPool.MarkError(bc)
-				backendConn := pm.backendPool.GetConn()
-				persistentPipe.BackendConn = backendConn
-				persistentPipe.BackendErr = nil
-				pm.logger.Debug(fmt.Sprintf("substituted new backend for pipe associated with client id: %s", clientId))
-				break
-			} else if persistentPipe.ClientErr != nil {
-				// TODO: Can have intelligent way of waiting for client to comeback
-				errChan <- fmt.Errorf("client connection errored out: %s", persistentPipe.ClientErr)
-				break
+				pm.metrics.observeFailover()
+			}
+			backendConn, err := pm.backendPool.GetConn(ctx)
+			if err != nil {
+				pm.logger.Error(fmt.Sprintf("could not substitute backend, closing pipe associated with client id: %s", clientId), err)
+				pm.forceClosePipe(clientId, persistentPipe, err)
+				return
+			}
+			if !persistentPipe.attachBackend(backendConn) {
+				// Pipe got closed while waiting for a backend
+				pm.backendPool.Release(backendConn)
+				return
+			}
+			pm.rememberBackend(clientId, backendConn)
+			pm.logger.Debug(fmt.Sprintf("substituted new backend for pipe associated with client id: %s", clientId))
+			if err := persistentPipe.replayToSubstitute(); err != nil {
+				pm.logger.Warn(fmt.Sprintf("error replaying held data to substituted backend for client id: %s", clientId), err)
+			}
+		} else if persistentPipe.clientErr() != nil {
+			pm.handleClientErr(clientId, persistentPipe)
+		}
+	}
+	if _, loaded := pm.clientPipesMap.LoadOrStore(clientId, persistentPipe); loaded {
+		pm.backendPool.Release(backendConn)
+		return fmt.Errorf("a pipe already existed with clientId: %s", clientId)
+	}
+	if pipeErr := persistentPipe.Stream(); pipeErr != nil {
+		pm.closePipe(clientId, persistentPipe)
+		return pipeErr
+	}
+	return pm.awaitClient(clientId, persistentPipe, clientDone)
+}
+
+// resumePipe Attaches a reconnected client to its pipe if the pipe is still waiting for it
+func (pm *WebsocketPipeManager) resumePipe(clientId uuid.UUID, persistentPipe *PersistentPipe, conn io.ReadWriteCloser, handshake *ClientHandshake) error {
+	if !persistentPipe.holdForClient || !pm.cancelClientGrace(persistentPipe) {
+		return fmt.Errorf("a pipe already existed with clientId: %s", clientId)
+	}
+	clientDone := make(chan error, 1)
+	persistentPipe.clientMut.Lock()
+	persistentPipe.clientDone = clientDone
+	if handshake != nil {
+		persistentPipe.clientHandshake = handshake
+	}
+	persistentPipe.clientMut.Unlock()
+	if err := persistentPipe.AttachClient(conn); err != nil {
+		pm.closePipe(clientId, persistentPipe)
+		return fmt.Errorf("error re-attaching client to pipe: %s", err)
+	}
+	pm.logger.Debug(fmt.Sprintf("re-attached client to existing pipe associated with client id: %s", clientId))
+	return pm.awaitClient(clientId, persistentPipe, clientDone)
+}
+
+// awaitClient Blocks till the attached client goes away. Unless the pipe waits for the client to come back, the pipe is
+// closed and its backend is given back to the pool for other clients
+func (pm *WebsocketPipeManager) awaitClient(clientId uuid.UUID, persistentPipe *PersistentPipe, clientDone chan error) error {
+	clientErr := <-clientDone
+	if !persistentPipe.holdForClient || pm.isShuttingDown() {
+		pm.closePipe(clientId, persistentPipe)
+	}
+	if clientErr == io.EOF {
+		return nil
+	}
+	if pm.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	if errors.Is(clientErr, ErrNoBackendAvailable) || errors.Is(clientErr, ErrPipeClosed) || errors.Is(clientErr, ErrMemoryBudgetExceeded) {
+		return clientErr
+	}
+	return fmt.Errorf("client connection errored out: %s", clientErr)
+}
+
+// handleClientErr Lets the attached client session return, and either starts the reconnect grace period or closes the
+// pipe right away when the data held for the client has outgrown the limit
+func (pm *WebsocketPipeManager) handleClientErr(clientId uuid.UUID, persistentPipe *PersistentPipe) {
+	persistentPipe.clientMut.Lock()
+	clientDone := persistentPipe.clientDone
+	persistentPipe.clientDone = nil
+	if clientDone != nil {
+		clientDone <- persistentPipe.ClientErr
+		if persistentPipe.holdForClient && !persistentPipe.clientBufferFull && !pm.isShuttingDown() {
+			persistentPipe.clientGraceTimer = time.AfterFunc(persistentPipe.clientGracePeriod, func() {
+				pm.logger.Debug(fmt.Sprintf("client did not reconnect within grace period, closing pipe associated with client id: %s", clientId))
+				pm.closePipe(clientId, persistentPipe)
+			})
+		}
+	}
+	bufferFull, clientErr := persistentPipe.clientBufferFull, persistentPipe.ClientErr
+	persistentPipe.clientMut.Unlock()
+
+	if bufferFull {
+		pm.logger.Warn(fmt.Sprintf("closing pipe associated with client id %s waiting for client to reconnect", clientId), clientErr)
+		pm.cancelClientGrace(persistentPipe)
+		pm.closePipe(clientId, persistentPipe)
+	}
+}
+
+// dialContext Context for obtaining a backend for the pipe, carrying its client ID and the handshake of its latest client
+func (pm *WebsocketPipeManager) dialContext(persistentPipe *PersistentPipe) context.Context {
+	persistentPipe.clientMut.Lock()
+	defer persistentPipe.clientMut.Unlock()
+	return WithClientID(WithClientHandshake(context.Background(), persistentPipe.clientHandshake), persistentPipe.ClientID)
+}
+
+// cancelClientGrace Stops the reconnect grace period of the pipe, returns false if the pipe is not waiting for a
+// client or the grace period has already expired
+func (pm *WebsocketPipeManager) cancelClientGrace(persistentPipe *PersistentPipe) bool {
+	persistentPipe.clientMut.Lock()
+	defer persistentPipe.clientMut.Unlock()
+	if persistentPipe.clientGraceTimer == nil {
+		return false
+	}
+	stopped := persistentPipe.clientGraceTimer.Stop()
+	persistentPipe.clientGraceTimer = nil
+	return stopped
+}
+
+// closePipe Stops the pipe, gives its backend back to the pool and forgets the pipe, only the first call has any effect
+func (pm *WebsocketPipeManager) closePipe(clientId uuid.UUID, persistentPipe *PersistentPipe) {
+	persistentPipe.closeOnce.Do(func() {
+		persistentPipe.Stop()
+		persistentPipe.closeBuffers()
+		backendConn, errored := persistentPipe.heldBackend()
+		switch {
+		case backendConn == nil:
+			// Backend is being substituted, the substitute is released as soon as it is obtained
+		case errored:
+			pm.backendPool.MarkError(backendConn.(*BackendConn))
+		default:
+			// Affinity TTL counts from the moment the client stops using its backend
+			pm.rememberBackend(clientId, backendConn.(*BackendConn))
+			if migrating, _ := persistentPipe.takeMigration(); migrating {
+				closeBackendConn(backendConn.(*BackendConn))
 			}
+			pm.backendPool.Release(backendConn.(*BackendConn))
+		}
+		if current, ok := pm.clientPipesMap.Load(clientId); ok && current == persistentPipe {
+			pm.clientPipesMap.Delete(clientId)
+		}
+		pm.logger.Debug(fmt.Sprintf("released backend connection of pipe associated with client id: %s", clientId))
+	})
+}
+
+// Shutdown Refuses new pipes and closes the client connections of the existing ones, which sends them a websocket close
+// frame, pipes waiting for their client to reconnect are closed right away. Waits for the pipes to finish till the
+// context is done, force-closes the ones left and finally closes the backend pool
+func (pm *WebsocketPipeManager) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&pm.shuttingDown, 1)
+	pm.clientPipesMap.Range(func(key, value any) bool {
+		clientId, persistentPipe := key.(uuid.UUID), value.(*PersistentPipe)
+		if pm.cancelClientGrace(persistentPipe) {
+			pm.closePipe(clientId, persistentPipe)
+			return true
 		}
+		persistentPipe.clientMut.Lock()
+		clientConn := persistentPipe.ClientConn
+		persistentPipe.clientMut.Unlock()
+		if clientConn != nil {
+			clientConn.Close()
+		}
+		return true
+	})
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for countSyncMap(&pm.clientPipesMap) > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		pm.clientPipesMap.Range(func(key, value any) bool {
+			clientId, persistentPipe := key.(uuid.UUID), value.(*PersistentPipe)
+			pm.logger.Warn(fmt.Sprintf("force closing pipe associated with client id: %s", clientId), err)
+			pm.forceClosePipe(clientId, persistentPipe, ErrShuttingDown)
+			return true
+		})
+	}
+
+	if closeErr := pm.backendPool.Close(ctx); err == nil {
+		err = closeErr
 	}
-	pm.clientPipesMap.Store(clientId, persistentPipe)
-	pipeErr := persistentPipe.Stream()
-	if pipeErr != nil {
-		errChan <- pipeErr
+	return err
+}
+
+// ClosePipe Closes the pipe of the client right away, the client session blocked on it returns ErrPipeClosed and
+// the backend is given back to the pool. Returns ErrPipeNotFound if the client has no pipe
+func (pm *WebsocketPipeManager) ClosePipe(clientId uuid.UUID) error {
+	value, ok := pm.clientPipesMap.Load(clientId)
+	if !ok {
+		return ErrPipeNotFound
+	}
+	pm.logger.Debug(fmt.Sprintf("closing pipe associated with client id: %s", clientId))
+	pm.forceClosePipe(clientId, value.(*PersistentPipe), ErrPipeClosed)
+	return nil
+}
+
+// ForceMigratePipe Moves the pipe of the client to another backend by dropping its current backend connection, the
+// pipe goes through the same substitution as on a backend error, except that the backend is given back to the pool
+// instead of being marked errored. The backend url targetUrl is preferred when it is below its capacity, an empty
+// targetUrl leaves the pick to the pool. Data the old backend had in flight to the client is lost.
+// Returns ErrPipeNotFound if the client has no pipe
+func (pm *WebsocketPipeManager) ForceMigratePipe(clientId uuid.UUID, targetUrl string) error {
+	value, ok := pm.clientPipesMap.Load(clientId)
+	if !ok {
+		return ErrPipeNotFound
+	}
+	backendConn := value.(*PersistentPipe).startMigration(targetUrl)
+	if backendConn == nil {
+		return fmt.Errorf("pipe associated with client id: %s is not streaming from a backend", clientId)
+	}
+	pm.logger.Debug(fmt.Sprintf("force migrating pipe associated with client id: %s", clientId))
+	// Read side of the pipe reports the closed connection, which starts the substitution
+	return backendConn.Close()
+}
+
+func (pm *WebsocketPipeManager) isShuttingDown() bool {
+	return atomic.LoadInt32(&pm.shuttingDown) == 1
+}
+
+// forceClosePipe Closes the pipe and lets the client session blocked on it return with the given error
+func (pm *WebsocketPipeManager) forceClosePipe(clientId uuid.UUID, persistentPipe *PersistentPipe, err error) {
+	pm.cancelClientGrace(persistentPipe)
+	pm.closePipe(clientId, persistentPipe)
+	persistentPipe.clientMut.Lock()
+	clientDone := persistentPipe.clientDone
+	persistentPipe.clientDone = nil
+	persistentPipe.clientMut.Unlock()
+	if clientDone != nil {
+		clientDone <- err
 	}
-	return <-errChan
 }
@@ -1,13 +1,21 @@
 package interruptible_websocket_proxy
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"golang.org/x/net/websocket"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
 )
 
 type exampleLogger struct {
@@ -82,3 +90,225 @@ func ExampleNewWebsocketPipeManager() {
 		return
 	}
 }
+
+// newTestEchoBackend Starts a websocket backend on a random port which echoes every message back after the given delay
+func newTestEchoBackend(t *testing.T, delay time.Duration) string {
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(c *websocket.Conn) {
+			defer c.Close()
+			for {
+				var msg []byte
+				if err := websocket.Message.Receive(c, &msg); err != nil {
+					return
+				}
+				time.Sleep(delay)
+				if err := websocket.Message.Send(c, msg); err != nil {
+					return
+				}
+			}
+		},
+	})
+	t.Cleanup(server.Close)
+	return testBackendUrl(server)
+}
+
+func TestWebsocketPipeManager_CreatePipe(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldReleaseBackendWhenClientDisconnects", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		err := pipeManager.AddConnectionToPool(expUrl)
+		assert.Nil(t, err)
+
+		clientConn, clientPeer := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(uuid.New(), clientConn)
+		}()
+		assert.Eventually(t, func() bool {
+			ok := pool.InUseCount(expUrl) > 0
+			return ok
+		}, time.Second*10, time.Millisecond*100)
+
+		clientPeer.Close()
+		select {
+		case err = <-pipeErr:
+			assert.Nil(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("pipe did not return after client disconnected")
+		}
+		ok := pool.InUseCount(expUrl) > 0
+		assert.False(t, ok)
+		assert.Equal(t, 1, pool.idleConnections.Len())
+	})
+
+	t.Run("ShouldReattachReconnectingClientAndFlushDataHeldFromBackend", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, time.Millisecond*500)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		pipeManager.SetClientReconnectGracePeriod(time.Second * 10)
+		err := pipeManager.AddConnectionToPool(expUrl)
+		assert.Nil(t, err)
+		clientId := uuid.New()
+
+		clientConn, clientPeer := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(clientId, clientConn)
+		}()
+		_, err = clientPeer.Write([]byte("hello"))
+		assert.Nil(t, err)
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+		_, ok := pipeManager.clientPipesMap.Load(clientId)
+		assert.True(t, ok)
+
+		// Echo arrives while the client is away
+		time.Sleep(time.Second)
+		clientConn, clientPeer = net.Pipe()
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(clientId, clientConn)
+		}()
+		buf := make([]byte, 16)
+		n, err := clientPeer.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+
+	t.Run("ShouldClosePipeWhenClientDoesNotReconnectWithinGracePeriod", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		pipeManager.SetClientReconnectGracePeriod(time.Millisecond * 500)
+		err := pipeManager.AddConnectionToPool(expUrl)
+		assert.Nil(t, err)
+		clientId := uuid.New()
+
+		clientConn, clientPeer := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(clientId, clientConn)
+		}()
+		assert.Eventually(t, func() bool {
+			ok := pool.InUseCount(expUrl) > 0
+			return ok
+		}, time.Second*10, time.Millisecond*100)
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+
+		assert.Eventually(t, func() bool {
+			_, pipeOk := pipeManager.clientPipesMap.Load(clientId)
+			inUse := pool.InUseCount(expUrl) > 0
+			return !pipeOk && !inUse
+		}, time.Second*2, time.Millisecond*100)
+	})
+}
+
+func TestWebsocketPipeManager_Shutdown(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldClosePipesAndRefuseNewOnes", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		err := pipeManager.AddConnectionToPool(expUrl)
+		assert.Nil(t, err)
+
+		clientConn, _ := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(uuid.New(), clientConn)
+		}()
+		assert.Eventually(t, func() bool {
+			ok := pool.InUseCount(expUrl) > 0
+			return ok
+		}, time.Second*10, time.Millisecond*100)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		err = pipeManager.Shutdown(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrShuttingDown, <-pipeErr)
+		assert.Equal(t, 0, countSyncMap(&pipeManager.clientPipesMap))
+
+		clientConn, _ = net.Pipe()
+		assert.Equal(t, ErrShuttingDown, pipeManager.CreatePipe(uuid.New(), clientConn))
+	})
+
+	t.Run("ShouldClosePipesWaitingForClientToReconnect", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		pipeManager.SetClientReconnectGracePeriod(time.Minute)
+		err := pipeManager.AddConnectionToPool(expUrl)
+		assert.Nil(t, err)
+
+		clientConn, clientPeer := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipe(uuid.New(), clientConn)
+		}()
+		assert.Eventually(t, func() bool {
+			ok := pool.InUseCount(expUrl) > 0
+			return ok
+		}, time.Second*10, time.Millisecond*100)
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		err = pipeManager.Shutdown(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, countSyncMap(&pipeManager.clientPipesMap))
+	})
+}
+
+func TestWebsocketPipeManager_CreatePipeWithHandshake(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldForwardHandshakeOnEveryBackendDial", func(t *testing.T) {
+		forwardedFor := make(chan string, 2)
+		var dials int32
+		server := httptest.NewServer(websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				forwardedFor <- r.Header.Get("X-Forwarded-For")
+				return nil
+			},
+			Handler: func(c *websocket.Conn) {
+				defer c.Close()
+				// First connection goes away right after the handshake to force a failover
+				if atomic.AddInt32(&dials, 1) == 1 {
+					return
+				}
+				io.Copy(c, c)
+			},
+		})
+		defer server.Close()
+		pool := NewBackendConnPool(5, 100, tl)
+		pipeManager := NewWebsocketPipeManager(pool, 1024, tl)
+		err := pipeManager.AddConnectionToPool(testBackendUrl(server))
+		assert.Nil(t, err)
+
+		handshake := &ClientHandshake{Header: http.Header{"X-Forwarded-For": []string{"10.0.0.1"}}}
+		clientConn, clientPeer := net.Pipe()
+		pipeErr := make(chan error)
+		go func() {
+			pipeErr <- pipeManager.CreatePipeWithHandshake(uuid.New(), clientConn, handshake)
+		}()
+		assert.Equal(t, "10.0.0.1", <-forwardedFor)
+		select {
+		case forwarded := <-forwardedFor:
+			assert.Equal(t, "10.0.0.1", forwarded)
+		case <-time.After(time.Second * 10):
+			t.Fatal("backend was not redialed after failover")
+		}
+
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+	})
+}
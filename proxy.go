@@ -1,23 +1,68 @@
 package interruptible_websocket_proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 	"strings"
+	"sync"
+	"time"
 )
 
 // InterruptibleWebsocketProxyHandler Wrapped [Golang websocket server](https://pkg.go.dev/golang.org/x/net/websocket#Server)
 type InterruptibleWebsocketProxyHandler struct {
 	websocket.Server
 	*WebsocketPipeManager
+	pool *BackendWSConnPool
+	// config is the configuration currently in effect, replaced by Reload
+	config    HandlerConfig
+	configMut sync.Mutex
 }
 
+// errWarmConnectionsWithClientHandshake Warm connections are dialed ahead of any client, the handshake the handler
+// forwards for every client would not reach the backend over them
+var errWarmConnectionsWithClientHandshake = errors.New("warm connections are not supported by the handler, " +
+	"it forwards the client handshake on every dial")
+
+// errReleaseReuseWithClientHandshake The handler dials every backend socket with the handshake of its client, such a
+// socket is never handed to another client
+var errReleaseReuseWithClientHandshake = errors.New("backend release policy reuse is not supported by the handler, " +
+	"it forwards the client handshake on every dial")
+
+// errReliableDeliveryWithoutMessageFraming Sequence numbers are given to whole messages, which only message framed
+// buffering keeps apart
+var errReliableDeliveryWithoutMessageFraming = errors.New("reliable delivery requires message framed buffering")
+
 // HandlerConfig Configuration for the proxy and websocket handler
 type HandlerConfig struct {
+	Backends                           map[string]BackendOptions
 	MaxIdleConnCount                   int64
 	MaxAllowedErrorCountPerConn        int64
+	CircuitBreaker                     CircuitBreakerConfig
 	InterruptMemoryLimitPerConnInBytes int
+	ClientBufferLimitInBytes           int
+	ClientBufferOverflowPolicy         OverflowPolicy
+	GlobalMemoryLimitInBytes           int
+	GlobalMemoryExhaustionPolicy       MemoryExhaustionPolicy
+	BackendReleasePolicy               ReleasePolicy
+	ClientReconnectGracePeriod         time.Duration
+	BackendAffinityTTL                 time.Duration
+	MaxBackendWaitTime                 time.Duration
+	BackendDialer                      BackendDialer
+	BalancerStrategy                   BalancerStrategy
+	ForwardedHeaders                   []string
+	ForwardClientPath                  bool
+	HealthCheck                        *HealthCheckConfig
+	Discoverer                         Discoverer
+	WarmConnections                    *WarmConnectionConfig
+	MessageFramedBuffering             bool
+	Bootstrap                          *BootstrapConfig
+	ReliableDelivery                   bool
+	InterruptDiskLimitPerConnInBytes   int
+	InterruptSpillDirectory            string
+	Metrics                            *Metrics
 	ClientIdExtractFunc                func(conn *websocket.Conn) (uuid.UUID, error)
 }
 
@@ -38,16 +83,67 @@ func NewInterruptibleWebsocketProxyHandler(wsConfig websocket.Config,
 	handlerConfig HandlerConfig, logger logger) *InterruptibleWebsocketProxyHandler {
 
 	pool := NewBackendConnPool(handlerConfig.MaxIdleConnCount, handlerConfig.MaxAllowedErrorCountPerConn, logger)
+	if handlerConfig.BackendReleasePolicy == ReleaseReuse {
+		logger.Error("backend connections are redialed", errReleaseReuseWithClientHandshake)
+		handlerConfig.BackendReleasePolicy = ReleaseRedial
+	}
+	pool.SetReleasePolicy(handlerConfig.BackendReleasePolicy)
+	pool.SetCircuitBreakerConfig(handlerConfig.CircuitBreaker)
+	pool.SetMaxGetConnWait(handlerConfig.MaxBackendWaitTime)
+	if handlerConfig.BackendDialer != nil {
+		pool.SetDialer(handlerConfig.BackendDialer)
+	}
+	if handlerConfig.BalancerStrategy != nil {
+		pool.SetBalancerStrategy(handlerConfig.BalancerStrategy)
+	}
+	if handlerConfig.HealthCheck != nil {
+		pool.EnableHealthCheck(*handlerConfig.HealthCheck)
+	}
+	if handlerConfig.WarmConnections != nil {
+		logger.Error("warm connections are not enabled", errWarmConnectionsWithClientHandshake)
+		handlerConfig.WarmConnections = nil
+	}
+	if handlerConfig.ReliableDelivery && !handlerConfig.MessageFramedBuffering {
+		logger.Error("reliable delivery is not enabled", errReliableDeliveryWithoutMessageFraming)
+		handlerConfig.ReliableDelivery = false
+	}
+	if handlerConfig.Discoverer != nil {
+		pool.RunDiscoverer(handlerConfig.Discoverer)
+	}
+	if handlerConfig.Metrics != nil {
+		pool.SetMetrics(handlerConfig.Metrics)
+	}
+	for _, url := range sortedBackendUrls(handlerConfig.Backends) {
+		if err := pool.AddToPoolWithOptions(url, handlerConfig.Backends[url]); err != nil {
+			logger.Error(fmt.Sprintf("error adding configured backend url: %s", url), err)
+		}
+	}
 	pipeManager := NewWebsocketPipeManager(pool, handlerConfig.InterruptMemoryLimitPerConnInBytes, logger)
+	pipeManager.SetClientReconnectGracePeriod(handlerConfig.ClientReconnectGracePeriod)
+	pipeManager.SetBackendAffinityTTL(handlerConfig.BackendAffinityTTL)
+	pipeManager.SetMessageFramedBuffering(handlerConfig.MessageFramedBuffering)
+	pipeManager.SetBootstrap(handlerConfig.Bootstrap)
+	pipeManager.SetReliableDelivery(handlerConfig.ReliableDelivery)
+	pipeManager.SetClientBuffering(handlerConfig.ClientBufferLimitInBytes, handlerConfig.ClientBufferOverflowPolicy)
+	pipeManager.SetGlobalMemoryLimit(handlerConfig.GlobalMemoryLimitInBytes, handlerConfig.GlobalMemoryExhaustionPolicy)
+	if handlerConfig.Metrics != nil {
+		pipeManager.SetMetrics(handlerConfig.Metrics)
+	}
+	if handlerConfig.InterruptDiskLimitPerConnInBytes > 0 {
+		pipeManager.SetPipeBufferFactory(NewFileSpillPipeBufferFactory(handlerConfig.InterruptSpillDirectory,
+			handlerConfig.InterruptMemoryLimitPerConnInBytes, handlerConfig.InterruptDiskLimitPerConnInBytes))
+	}
 
+	handler := &InterruptibleWebsocketProxyHandler{WebsocketPipeManager: pipeManager, pool: pool, config: handlerConfig}
 	var proxyWSHandler = websocket.Handler(func(conn *websocket.Conn) {
 		defer conn.Close()
 
 		var clientId uuid.UUID
 		var err error
 
-		if handlerConfig.ClientIdExtractFunc != nil {
-			clientId, err = handlerConfig.ClientIdExtractFunc(conn)
+		currentConfig := handler.currentConfig()
+		if currentConfig.ClientIdExtractFunc != nil {
+			clientId, err = currentConfig.ClientIdExtractFunc(conn)
 		} else {
 			clientIdString := strings.TrimPrefix(conn.Request().URL.Path, "/")
 			clientId, err = uuid.Parse(clientIdString)
@@ -58,17 +154,42 @@ func NewInterruptibleWebsocketProxyHandler(wsConfig websocket.Config,
 		}
 
 		// Create persistent pipe, this is a blocking call
-		err = pipeManager.CreatePipe(clientId, conn)
+		handshake := NewClientHandshake(clientId, conn.Request(), currentConfig.ForwardedHeaders)
+		if !currentConfig.ForwardClientPath {
+			// Backends are dialed at their registered url as is
+			handshake.Path, handshake.RawQuery = "", ""
+		}
+		err = pipeManager.CreatePipeWithHandshake(clientId, conn, handshake)
 		if err != nil {
 			logger.Error("error creating persistent pipe", err)
+			switch {
+			case errors.Is(err, ErrNoBackendAvailable):
+				writeCloseFrame(conn, closeStatusTryAgainLater, "no backend available")
+			case errors.Is(err, ErrShuttingDown), errors.Is(err, ErrPoolClosed):
+				writeCloseFrame(conn, closeStatusGoingAway, "proxy is shutting down")
+			case errors.Is(err, ErrPipeClosed):
+				writeCloseFrame(conn, closeStatusGoingAway, "pipe closed by proxy")
+			case errors.Is(err, ErrMemoryBudgetExceeded):
+				writeCloseFrame(conn, closeStatusTryAgainLater, "proxy memory limit reached")
+			}
 			return
 		}
 	})
 
-	websocketServer := websocket.Server{
+	handler.Server = websocket.Server{
 		Config:  wsConfig,
 		Handler: proxyWSHandler,
 	}
+	return handler
+}
+
+// Shutdown Gracefully closes the pipes and the backend pool, see WebsocketPipeManager.Shutdown.
+// The http server serving the handler is to be shut down separately, preferably before calling this
+func (h *InterruptibleWebsocketProxyHandler) Shutdown(ctx context.Context) error {
+	return h.WebsocketPipeManager.Shutdown(ctx)
+}
 
-	return &InterruptibleWebsocketProxyHandler{websocketServer, pipeManager}
+// BackendsHealth Health state of every registered backend, backends stay healthy unless HandlerConfig.HealthCheck is set
+func (h *InterruptibleWebsocketProxyHandler) BackendsHealth() []BackendHealth {
+	return h.pool.BackendsHealth()
 }
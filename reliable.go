@@ -0,0 +1,173 @@
+package interruptible_websocket_proxy
+
+import (
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// reliableAckPrefix Text messages from a backend starting with it acknowledge client messages, see SetReliableDelivery
+const reliableAckPrefix = "ack "
+
+// reliableLog Client messages of a pipe in reliable delivery mode which the backend has not acknowledged yet. Messages
+// are numbered from 1 in the order the client sent them
+type reliableLog struct {
+	// mut guards the messages held, it is never held while writing to the backend as the backend read loop takes it
+	// to acknowledge messages, a write blocked on a backend which does not read would otherwise never return
+	mut      sync.Mutex
+	nextSeq  uint64
+	unacked  []wsMessage
+	size     int
+	maxBytes int
+	// sentSeq is the highest sequence number written to the current backend, it belongs to the writer of the pipe
+	// which holds backendMut
+	sentSeq uint64
+}
+
+// add Numbers the message and holds a copy of it till it is acknowledged, returns an error if the unacknowledged data
+// would outgrow the limit
+func (rl *reliableLog) add(msg wsMessage) error {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	if rl.size+len(msg.data) > rl.maxBytes {
+		return fmt.Errorf("unacknowledged data would exceed the limit of %d bytes", rl.maxBytes)
+	}
+	rl.nextSeq++
+	data := make([]byte, len(msg.data))
+	copy(data, msg.data)
+	rl.unacked = append(rl.unacked, wsMessage{payloadType: msg.payloadType, data: data, seq: rl.nextSeq})
+	rl.size += len(data)
+	return nil
+}
+
+// acknowledge Drops the messages up to and including the sequence number, returns the number of bytes dropped
+func (rl *reliableLog) acknowledge(seq uint64) int {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	dropped, i := 0, 0
+	for ; i < len(rl.unacked) && rl.unacked[i].seq <= seq; i++ {
+		dropped += len(rl.unacked[i].data)
+		rl.unacked[i] = wsMessage{}
+	}
+	rl.unacked = rl.unacked[i:]
+	rl.size -= dropped
+	return dropped
+}
+
+// clear Drops every message held, returns the number of bytes dropped
+func (rl *reliableLog) clear() int {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	dropped := rl.size
+	rl.unacked, rl.size = nil, 0
+	return dropped
+}
+
+// unsent Messages not yet written to the current backend, in order
+func (rl *reliableLog) unsent() []wsMessage {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	var messages []wsMessage
+	for _, msg := range rl.unacked {
+		if msg.seq > rl.sentSeq {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// flush Writes the unacknowledged messages not yet written to the current backend, in order. Messages acknowledged
+// while being written are written all the same, a backend is to ignore the ones it has already processed anyway
+func (rl *reliableLog) flush(write func(msg wsMessage) error) error {
+	for _, msg := range rl.unsent() {
+		if err := write(msg); err != nil {
+			return err
+		}
+		rl.sentSeq = msg.seq
+	}
+	return nil
+}
+
+// SetReliableDelivery Makes pipes number every client message and hold it till the backend acknowledges it. Messages
+// are sent to the backend in an envelope, the sequence number in decimal followed by a newline ahead of the payload,
+// with the payload type of the message kept. The backend acknowledges with a text message "ack <seq>", covering every
+// message up to and including seq, which is not forwarded to the client. On a backend substitution or migration every
+// unacknowledged message is replayed to the new backend, so a backend may see a sequence number again and is to ignore
+// the ones it has already processed. Unacknowledged data is bounded by the interrupt memory limit, a client outgrowing
+// it is dropped. Requires message framed buffering, see SetMessageFramedBuffering. Applies to the pipes created afterwards
+func (pm *WebsocketPipeManager) SetReliableDelivery(enabled bool) {
+	pm.settingsMut.Lock()
+	defer pm.settingsMut.Unlock()
+	pm.reliableDelivery = enabled
+}
+
+// envelope Prefixes the payload of a numbered message with its sequence number, other messages are left as they are
+func envelope(msg wsMessage) wsMessage {
+	if msg.seq == 0 {
+		return msg
+	}
+	data := strconv.AppendUint(make([]byte, 0, len(msg.data)+21), msg.seq, 10)
+	data = append(data, '\n')
+	return wsMessage{payloadType: msg.payloadType, data: append(data, msg.data...)}
+}
+
+// parseAck Sequence number acknowledged by the message from the backend, if it is an acknowledgement
+func parseAck(msg wsMessage) (uint64, bool) {
+	if msg.payloadType != websocket.TextFrame || !strings.HasPrefix(string(msg.data), reliableAckPrefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(msg.data[len(reliableAckPrefix):])), 10, 64)
+	return seq, err == nil
+}
+
+// acknowledge Handles the message from the backend if it is an acknowledgement, returns whether it was
+func (pep *PersistentPipe) acknowledge(msg wsMessage) bool {
+	if pep.reliable == nil {
+		return false
+	}
+	seq, ok := parseAck(msg)
+	if !ok {
+		return false
+	}
+	// Taken without backendMut, which is held by writes to the backend that may be blocked on this very backend
+	dropped := pep.reliable.acknowledge(seq)
+	pep.releaseMemory(dropped)
+	atomic.AddInt64(&pep.backendBufferedBytes, -int64(dropped))
+	return true
+}
+
+// writeReliably Numbers the message from the client and writes it along with any other message not yet written to the
+// backend, unless the backend is being substituted or migrated. To be called with backendMut held
+func (pep *PersistentPipe) writeReliably(msg wsMessage, errChan chan error, done chan struct{}) bool {
+	err := ErrMemoryBudgetExceeded
+	if pep.reserveMemory(len(msg.data)) {
+		if err = pep.reliable.add(msg); err != nil {
+			pep.releaseMemory(len(msg.data))
+		}
+	}
+	if err != nil {
+		err := writeErr{error: fmt.Errorf("backend buffer reached max limit, exiting: %w", err), CopyDirection: CopyToBackend}
+		pep.sendClientErr(err, errChan, done)
+		return false
+	}
+	atomic.AddInt64(&pep.backendBufferedBytes, int64(len(msg.data)))
+	if pep.backendErr() == nil && !pep.backendPaused {
+		if err := pep.flushBackendBufferLocked(); err != nil {
+			// Read side of the backend connection reports the failure, messages stay held till acknowledged
+			log.Println(writeErr{error: err, CopyDirection: CopyToBackend})
+		}
+	}
+	return true
+}
+
+// resendAllUnacked Has every unacknowledged message written again, to a backend which replaced the previous one.
+// To be called with backendMut held
+func (pep *PersistentPipe) resendAllUnacked() {
+	if pep.reliable != nil {
+		pep.reliable.sentSeq = 0
+	}
+}
@@ -0,0 +1,162 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAckingBackend Starts a websocket backend for reliable delivery which reports every enveloped message it receives
+// on the returned channel, then acknowledges and echoes the payload unless it starts with "hold"
+func newTestAckingBackend(t *testing.T) (string, chan string) {
+	received := make(chan string, 16)
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(c *websocket.Conn) {
+			defer c.Close()
+			for {
+				var msg wsMessage
+				if err := messageCodec.Receive(c, &msg); err != nil {
+					return
+				}
+				received <- string(msg.data)
+				seq, payload, _ := strings.Cut(string(msg.data), "\n")
+				if strings.HasPrefix(payload, "hold") {
+					continue
+				}
+				if err := websocket.Message.Send(c, reliableAckPrefix+seq); err != nil {
+					return
+				}
+				if err := websocket.Message.Send(c, payload); err != nil {
+					return
+				}
+			}
+		},
+	})
+	t.Cleanup(server.Close)
+	return testBackendUrl(server), received
+}
+
+func TestReliableLog(t *testing.T) {
+	t.Run("ShouldHoldMessagesTillAcknowledged", func(t *testing.T) {
+		rl := &reliableLog{maxBytes: 12}
+		for _, data := range []string{"one", "two", "three"} {
+			assert.Nil(t, rl.add(wsMessage{payloadType: websocket.TextFrame, data: []byte(data)}))
+		}
+		assert.NotNil(t, rl.add(wsMessage{data: []byte("four")}))
+		assert.Equal(t, 11, rl.size)
+
+		var written []uint64
+		write := func(msg wsMessage) error {
+			written = append(written, msg.seq)
+			return nil
+		}
+		assert.Nil(t, rl.flush(write))
+		assert.Nil(t, rl.flush(write))
+		assert.Equal(t, []uint64{1, 2, 3}, written)
+
+		rl.acknowledge(2)
+		assert.Equal(t, len("three"), rl.size)
+		assert.Nil(t, rl.add(wsMessage{data: []byte("four")}))
+		rl.sentSeq = 0
+		written = nil
+		assert.Nil(t, rl.flush(write))
+		assert.Equal(t, []uint64{3, 4}, written)
+	})
+
+	t.Run("ShouldAcknowledgeWhileWriteToBackendIsBlocked", func(t *testing.T) {
+		persistentPipe := NewPersistentPipe(uuid.New(), nil, nil, 100)
+		persistentPipe.reliable = &reliableLog{maxBytes: 100}
+		assert.Nil(t, persistentPipe.reliable.add(wsMessage{data: []byte("one")}))
+
+		// A writer blocked on a backend which does not read holds backendMut
+		persistentPipe.backendMut.Lock()
+		defer persistentPipe.backendMut.Unlock()
+		acknowledged := make(chan bool)
+		go func() {
+			acknowledged <- persistentPipe.acknowledge(wsMessage{payloadType: websocket.TextFrame, data: []byte("ack 1")})
+		}()
+		select {
+		case ok := <-acknowledged:
+			assert.True(t, ok)
+		case <-time.After(time.Second * 10):
+			t.Fatal("acknowledgement blocked on the backend writer")
+		}
+		assert.Equal(t, 0, persistentPipe.reliable.size)
+	})
+}
+
+func TestEnvelope(t *testing.T) {
+	t.Run("ShouldPrefixSequenceNumberAndKeepPayloadType", func(t *testing.T) {
+		msg := envelope(wsMessage{payloadType: websocket.BinaryFrame, data: []byte{0, 1}, seq: 42})
+		assert.Equal(t, byte(websocket.BinaryFrame), msg.payloadType)
+		assert.Equal(t, []byte{'4', '2', '\n', 0, 1}, msg.data)
+		assert.Equal(t, "data", string(envelope(wsMessage{data: []byte("data")}).data))
+	})
+
+	t.Run("ShouldParseOnlyTextAcknowledgements", func(t *testing.T) {
+		seq, ok := parseAck(wsMessage{payloadType: websocket.TextFrame, data: []byte("ack 7")})
+		assert.True(t, ok)
+		assert.Equal(t, uint64(7), seq)
+		_, ok = parseAck(wsMessage{payloadType: websocket.BinaryFrame, data: []byte("ack 7")})
+		assert.False(t, ok)
+		_, ok = parseAck(wsMessage{payloadType: websocket.TextFrame, data: []byte("ack seven")})
+		assert.False(t, ok)
+	})
+}
+
+func TestWebsocketPipeManager_SetReliableDelivery(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldReplayUnacknowledgedMessagesToSubstitutedBackend", func(t *testing.T) {
+		firstUrl, firstReceived := newTestAckingBackend(t)
+		secondUrl, secondReceived := newTestAckingBackend(t)
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, HandlerConfig{
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+			MessageFramedBuffering:             true,
+			ReliableDelivery:                   true,
+		}, tl)
+		defer handler.Shutdown(context.Background())
+		assert.Nil(t, handler.AddConnectionToPool(firstUrl))
+		proxy := httptest.NewServer(handler)
+		defer proxy.Close()
+
+		clientId := uuid.New()
+		client, err := websocket.Dial(testBackendUrl(proxy)+"/"+clientId.String(), "", "http://localhost")
+		assert.Nil(t, err)
+		defer client.Close()
+		_ = client.SetReadDeadline(time.Now().Add(time.Second * 10))
+
+		// Acknowledgements are consumed by the proxy, the client only sees the echo
+		assert.Nil(t, websocket.Message.Send(client, "one"))
+		assert.Equal(t, "1\none", <-firstReceived)
+		var reply string
+		assert.Nil(t, websocket.Message.Receive(client, &reply))
+		assert.Equal(t, "one", reply)
+
+		assert.Nil(t, websocket.Message.Send(client, "hold two"))
+		assert.Equal(t, "2\nhold two", <-firstReceived)
+		assert.Eventually(t, func() bool {
+			info, ok := handler.Pipe(clientId)
+			return ok && info.BufferedToBackendBytes == len("hold two")
+		}, time.Second*10, time.Millisecond*50)
+
+		assert.Nil(t, handler.AddConnectionToPool(secondUrl))
+		assert.Eventually(t, func() bool {
+			return idleLen(handler.pool) == 1
+		}, time.Second*10, time.Millisecond*50)
+		assert.Nil(t, handler.ForceMigratePipe(clientId, secondUrl))
+		assert.Equal(t, "2\nhold two", <-secondReceived)
+
+		assert.Nil(t, websocket.Message.Send(client, "three"))
+		assert.Equal(t, "3\nthree", <-secondReceived)
+		assert.Nil(t, websocket.Message.Receive(client, &reply))
+		assert.Equal(t, "three", reply)
+	})
+}
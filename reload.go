@@ -0,0 +1,232 @@
+package interruptible_websocket_proxy
+
+import (
+	"fmt"
+	"golang.org/x/net/websocket"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ReloadReport Settings of HandlerConfig, by field name, which differed from the configuration in effect when reloading
+type ReloadReport struct {
+	// Immediate settings were applied to the running pool and pipe manager right away
+	Immediate []string
+	// NewPipesOnly settings apply to client connections accepted from now on, existing pipes keep the previous values
+	NewPipesOnly []string
+	// RequiresRestart settings only take effect for a newly created handler, the previous values stay in effect
+	RequiresRestart []string
+}
+
+// Reload Applies a changed configuration to the running handler without dropping existing pipes. Limits and
+// strategies of the pool apply right away, backend urls added to Backends are added to the pool, removed ones are
+// drained and the ones with changed options are updated in place. Backend urls registered by other means are left
+// alone. Settings of the pipes apply to new pipes only. Functions like ClientIdExtractFunc cannot be compared, when set
+// they are applied and reported as changed on every reload. An error is returned for an invalid configuration, in
+// which case nothing is applied, or for backend changes which could not be applied, in which case the rest is still
+// applied
+func (h *InterruptibleWebsocketProxyHandler) Reload(newConfig HandlerConfig) (ReloadReport, error) {
+	for url, options := range newConfig.Backends {
+		if _, err := options.withDefaults(url); err != nil {
+			return ReloadReport{}, err
+		}
+	}
+	h.configMut.Lock()
+	defer h.configMut.Unlock()
+	old := h.config
+	if newConfig.WarmConnections != nil {
+		return ReloadReport{}, errWarmConnectionsWithClientHandshake
+	}
+	if newConfig.BackendReleasePolicy == ReleaseReuse {
+		return ReloadReport{}, errReleaseReuseWithClientHandshake
+	}
+	if newConfig.ReliableDelivery && !newConfig.MessageFramedBuffering {
+		return ReloadReport{}, errReliableDeliveryWithoutMessageFraming
+	}
+	var report ReloadReport
+
+	if settingChanged(old.MaxIdleConnCount, newConfig.MaxIdleConnCount) {
+		h.pool.SetMaxIdleConnections(newConfig.MaxIdleConnCount)
+		report.Immediate = append(report.Immediate, "MaxIdleConnCount")
+	}
+	if settingChanged(old.MaxAllowedErrorCountPerConn, newConfig.MaxAllowedErrorCountPerConn) {
+		h.pool.SetMaxAllowedErrorCount(newConfig.MaxAllowedErrorCountPerConn)
+		report.Immediate = append(report.Immediate, "MaxAllowedErrorCountPerConn")
+	}
+	if settingChanged(old.CircuitBreaker, newConfig.CircuitBreaker) {
+		h.pool.SetCircuitBreakerConfig(newConfig.CircuitBreaker)
+		report.Immediate = append(report.Immediate, "CircuitBreaker")
+	}
+	if settingChanged(old.BackendReleasePolicy, newConfig.BackendReleasePolicy) {
+		h.pool.SetReleasePolicy(newConfig.BackendReleasePolicy)
+		report.Immediate = append(report.Immediate, "BackendReleasePolicy")
+	}
+	if settingChanged(old.MaxBackendWaitTime, newConfig.MaxBackendWaitTime) {
+		h.pool.SetMaxGetConnWait(newConfig.MaxBackendWaitTime)
+		report.Immediate = append(report.Immediate, "MaxBackendWaitTime")
+	}
+	if settingChanged(old.BackendDialer, newConfig.BackendDialer) {
+		var dialer BackendDialer = NewWebsocketDialer(websocket.Config{}, 0)
+		if newConfig.BackendDialer != nil {
+			dialer = newConfig.BackendDialer
+		}
+		h.pool.SetDialer(dialer)
+		report.Immediate = append(report.Immediate, "BackendDialer")
+	}
+	if settingChanged(old.BalancerStrategy, newConfig.BalancerStrategy) {
+		h.pool.SetBalancerStrategy(newConfig.BalancerStrategy)
+		report.Immediate = append(report.Immediate, "BalancerStrategy")
+	}
+	if settingChanged(old.BackendAffinityTTL, newConfig.BackendAffinityTTL) {
+		h.SetBackendAffinityTTL(newConfig.BackendAffinityTTL)
+		report.Immediate = append(report.Immediate, "BackendAffinityTTL")
+	}
+	if settingChanged(old.GlobalMemoryLimitInBytes, newConfig.GlobalMemoryLimitInBytes) {
+		report.Immediate = append(report.Immediate, "GlobalMemoryLimitInBytes")
+	}
+	if settingChanged(old.GlobalMemoryExhaustionPolicy, newConfig.GlobalMemoryExhaustionPolicy) {
+		report.Immediate = append(report.Immediate, "GlobalMemoryExhaustionPolicy")
+	}
+	if settingChanged(old.GlobalMemoryLimitInBytes, newConfig.GlobalMemoryLimitInBytes) ||
+		settingChanged(old.GlobalMemoryExhaustionPolicy, newConfig.GlobalMemoryExhaustionPolicy) {
+		h.SetGlobalMemoryLimit(newConfig.GlobalMemoryLimitInBytes, newConfig.GlobalMemoryExhaustionPolicy)
+	}
+	var backendErrs []string
+	if settingChanged(old.Backends, newConfig.Backends) {
+		backendErrs = h.reloadBackends(old.Backends, newConfig.Backends)
+		report.Immediate = append(report.Immediate, "Backends")
+	}
+
+	if settingChanged(old.InterruptMemoryLimitPerConnInBytes, newConfig.InterruptMemoryLimitPerConnInBytes) {
+		h.SetInterruptMemoryLimitPerConn(newConfig.InterruptMemoryLimitPerConnInBytes)
+		report.NewPipesOnly = append(report.NewPipesOnly, "InterruptMemoryLimitPerConnInBytes")
+	}
+	if settingChanged(old.InterruptDiskLimitPerConnInBytes, newConfig.InterruptDiskLimitPerConnInBytes) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "InterruptDiskLimitPerConnInBytes")
+	}
+	if settingChanged(old.InterruptSpillDirectory, newConfig.InterruptSpillDirectory) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "InterruptSpillDirectory")
+	}
+	if settingChanged(old.InterruptMemoryLimitPerConnInBytes, newConfig.InterruptMemoryLimitPerConnInBytes) ||
+		settingChanged(old.InterruptDiskLimitPerConnInBytes, newConfig.InterruptDiskLimitPerConnInBytes) ||
+		settingChanged(old.InterruptSpillDirectory, newConfig.InterruptSpillDirectory) {
+		var factory PipeBufferFactory
+		if newConfig.InterruptDiskLimitPerConnInBytes > 0 {
+			factory = NewFileSpillPipeBufferFactory(newConfig.InterruptSpillDirectory,
+				newConfig.InterruptMemoryLimitPerConnInBytes, newConfig.InterruptDiskLimitPerConnInBytes)
+		}
+		h.SetPipeBufferFactory(factory)
+	}
+	if settingChanged(old.ClientBufferLimitInBytes, newConfig.ClientBufferLimitInBytes) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "ClientBufferLimitInBytes")
+	}
+	if settingChanged(old.ClientBufferOverflowPolicy, newConfig.ClientBufferOverflowPolicy) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "ClientBufferOverflowPolicy")
+	}
+	if settingChanged(old.ClientBufferLimitInBytes, newConfig.ClientBufferLimitInBytes) ||
+		settingChanged(old.ClientBufferOverflowPolicy, newConfig.ClientBufferOverflowPolicy) {
+		h.SetClientBuffering(newConfig.ClientBufferLimitInBytes, newConfig.ClientBufferOverflowPolicy)
+	}
+	if settingChanged(old.ClientReconnectGracePeriod, newConfig.ClientReconnectGracePeriod) {
+		h.SetClientReconnectGracePeriod(newConfig.ClientReconnectGracePeriod)
+		report.NewPipesOnly = append(report.NewPipesOnly, "ClientReconnectGracePeriod")
+	}
+	if settingChanged(old.MessageFramedBuffering, newConfig.MessageFramedBuffering) {
+		h.SetMessageFramedBuffering(newConfig.MessageFramedBuffering)
+		report.NewPipesOnly = append(report.NewPipesOnly, "MessageFramedBuffering")
+	}
+	if settingChanged(old.Bootstrap, newConfig.Bootstrap) {
+		h.SetBootstrap(newConfig.Bootstrap)
+		report.NewPipesOnly = append(report.NewPipesOnly, "Bootstrap")
+	}
+	if settingChanged(old.ReliableDelivery, newConfig.ReliableDelivery) {
+		h.SetReliableDelivery(newConfig.ReliableDelivery)
+		report.NewPipesOnly = append(report.NewPipesOnly, "ReliableDelivery")
+	}
+	// Read by the websocket handler for every client connection
+	if settingChanged(old.ForwardedHeaders, newConfig.ForwardedHeaders) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "ForwardedHeaders")
+	}
+	if settingChanged(old.ForwardClientPath, newConfig.ForwardClientPath) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "ForwardClientPath")
+	}
+	if settingChanged(old.ClientIdExtractFunc, newConfig.ClientIdExtractFunc) {
+		report.NewPipesOnly = append(report.NewPipesOnly, "ClientIdExtractFunc")
+	}
+
+	if settingChanged(old.HealthCheck, newConfig.HealthCheck) {
+		report.RequiresRestart = append(report.RequiresRestart, "HealthCheck")
+	}
+	if settingChanged(old.Discoverer, newConfig.Discoverer) {
+		report.RequiresRestart = append(report.RequiresRestart, "Discoverer")
+	}
+	if settingChanged(old.Metrics, newConfig.Metrics) {
+		report.RequiresRestart = append(report.RequiresRestart, "Metrics")
+	}
+	newConfig.HealthCheck, newConfig.Discoverer, newConfig.Metrics = old.HealthCheck, old.Discoverer, old.Metrics
+	h.config = newConfig
+
+	if len(backendErrs) > 0 {
+		return report, fmt.Errorf("error applying backend changes: %s", strings.Join(backendErrs, "; "))
+	}
+	return report, nil
+}
+
+// reloadBackends Brings the pool in line with the changed backends, returns the changes which failed
+func (h *InterruptibleWebsocketProxyHandler) reloadBackends(old, current map[string]BackendOptions) []string {
+	var errs []string
+	for _, url := range sortedBackendUrls(current) {
+		options := current[url]
+		oldOptions, existed := old[url]
+		var err error
+		switch {
+		case !existed:
+			err = h.pool.addReplacingDrain(url, options)
+		case backendOptionsChanged(oldOptions, options, url):
+			err = h.pool.UpdateBackendOptions(url, options)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, url := range sortedBackendUrls(old) {
+		if _, ok := current[url]; !ok {
+			if err := h.pool.Drain(url); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	return errs
+}
+
+func (h *InterruptibleWebsocketProxyHandler) currentConfig() HandlerConfig {
+	h.configMut.Lock()
+	defer h.configMut.Unlock()
+	return h.config
+}
+
+// backendOptionsChanged Compares the options with their defaults applied, options are validated beforehand
+func backendOptionsChanged(old, current BackendOptions, url string) bool {
+	old, _ = old.withDefaults(url)
+	current, _ = current.withDefaults(url)
+	return old != current
+}
+
+// settingChanged Compares by value. Functions cannot be compared, closures of the same function literal share their
+// code whatever they capture, so a function set in either is taken as changed
+func settingChanged(old, current any) bool {
+	oldValue, currentValue := reflect.ValueOf(old), reflect.ValueOf(current)
+	if oldValue.Kind() == reflect.Func && currentValue.Kind() == reflect.Func {
+		return !oldValue.IsNil() || !currentValue.IsNil()
+	}
+	return !reflect.DeepEqual(old, current)
+}
+
+func sortedBackendUrls(backends map[string]BackendOptions) []string {
+	urls := make([]string, 0, len(backends))
+	for url := range backends {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
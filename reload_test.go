@@ -0,0 +1,218 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"testing"
+	"time"
+)
+
+func TestInterruptibleWebsocketProxyHandler_Reload(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldApplySettingsAndReportWhenTheyTakeEffect", func(t *testing.T) {
+		config := HandlerConfig{
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+			HealthCheck:                        &HealthCheckConfig{Interval: time.Hour},
+		}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+
+		config.MaxIdleConnCount = 10
+		config.BalancerStrategy = NewLeastConnectionsStrategy()
+		config.ClientReconnectGracePeriod = time.Minute
+		config.ForwardedHeaders = []string{"Authorization"}
+		config.HealthCheck = &HealthCheckConfig{Interval: time.Minute}
+		report, err := handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"MaxIdleConnCount", "BalancerStrategy"}, report.Immediate)
+		assert.Equal(t, []string{"ClientReconnectGracePeriod", "ForwardedHeaders"}, report.NewPipesOnly)
+		assert.Equal(t, []string{"HealthCheck"}, report.RequiresRestart)
+
+		settings := handler.pool.currentSettings()
+		assert.Equal(t, int64(10), settings.maxIdleConnections)
+		assert.Equal(t, NewLeastConnectionsStrategy(), settings.balancer)
+		assert.Equal(t, time.Minute, handler.clientReconnectGracePeriod)
+		assert.Equal(t, []string{"Authorization"}, handler.currentConfig().ForwardedHeaders)
+		assert.Equal(t, time.Hour, handler.currentConfig().HealthCheck.Interval)
+
+		// Nothing changed since
+		report, err = handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Equal(t, ReloadReport{RequiresRestart: []string{"HealthCheck"}}, report)
+	})
+
+	t.Run("ShouldReportFunctionsAsChangedWhateverTheyCapture", func(t *testing.T) {
+		extractorFor := func(clientId uuid.UUID) func(conn *websocket.Conn) (uuid.UUID, error) {
+			return func(conn *websocket.Conn) (uuid.UUID, error) {
+				return clientId, nil
+			}
+		}
+		config := HandlerConfig{
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+			ClientIdExtractFunc:                extractorFor(uuid.New()),
+		}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+
+		clientId := uuid.New()
+		config.ClientIdExtractFunc = extractorFor(clientId)
+		report, err := handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"ClientIdExtractFunc"}, report.NewPipesOnly)
+		extracted, _ := handler.currentConfig().ClientIdExtractFunc(nil)
+		assert.Equal(t, clientId, extracted)
+
+		config.ClientIdExtractFunc = nil
+		report, err = handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"ClientIdExtractFunc"}, report.NewPipesOnly)
+		report, err = handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Empty(t, report.NewPipesOnly)
+	})
+
+	t.Run("ShouldSyncBackendsWithoutDroppingPipes", func(t *testing.T) {
+		keptUrl, removedUrl, addedUrl := newTestBackend(t, time.Minute), newTestBackend(t, time.Minute), newTestBackend(t, time.Minute)
+		config := HandlerConfig{
+			Backends:                           map[string]BackendOptions{removedUrl: {}},
+			MaxIdleConnCount:                   5,
+			MaxAllowedErrorCountPerConn:        100,
+			InterruptMemoryLimitPerConnInBytes: 1024,
+		}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+		assert.Nil(t, handler.AddConnectionToPool(keptUrl))
+
+		clientPeer, pipeErr := startTestPipe(handler.WebsocketPipeManager, uuid.New())
+		assert.Eventually(t, func() bool {
+			return handler.pool.InUseCount(removedUrl) == 1
+		}, time.Second*10, time.Millisecond*50)
+
+		config.Backends = map[string]BackendOptions{addedUrl: {Capacity: 2}}
+		report, err := handler.Reload(config)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"Backends"}, report.Immediate)
+
+		// Removed backend drains while its pipe carries on, a url added otherwise is left alone
+		registration, ok := handler.pool.loadRegistration(removedUrl)
+		assert.True(t, ok)
+		assert.True(t, registration.isDraining())
+		assert.Equal(t, 1, handler.pool.InUseCount(removedUrl))
+		_, ok = handler.pool.loadRegistration(keptUrl)
+		assert.True(t, ok)
+		registration, ok = handler.pool.loadRegistration(addedUrl)
+		assert.True(t, ok)
+		assert.Equal(t, 2, registration.capacity)
+
+		clientPeer.Close()
+		assert.Nil(t, <-pipeErr)
+		_, ok = handler.pool.loadRegistration(removedUrl)
+		assert.False(t, ok)
+	})
+
+	t.Run("ShouldRejectInvalidBackendOptions", func(t *testing.T) {
+		config := HandlerConfig{MaxIdleConnCount: 5, MaxAllowedErrorCountPerConn: 100}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+
+		config.MaxIdleConnCount = 10
+		config.Backends = map[string]BackendOptions{"ws://localhost:8081": {Capacity: -1}}
+		_, err := handler.Reload(config)
+		assert.NotNil(t, err)
+		assert.Equal(t, int64(5), handler.pool.currentSettings().maxIdleConnections)
+	})
+
+	t.Run("ShouldRejectWarmConnections", func(t *testing.T) {
+		config := HandlerConfig{MaxIdleConnCount: 5, MaxAllowedErrorCountPerConn: 100, WarmConnections: &WarmConnectionConfig{}}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+		assert.Nil(t, handler.currentConfig().WarmConnections)
+
+		config.MaxIdleConnCount = 10
+		_, err := handler.Reload(config)
+		assert.ErrorIs(t, err, errWarmConnectionsWithClientHandshake)
+		assert.Equal(t, int64(5), handler.pool.currentSettings().maxIdleConnections)
+	})
+
+	t.Run("ShouldRejectReleaseReuse", func(t *testing.T) {
+		config := HandlerConfig{MaxIdleConnCount: 5, MaxAllowedErrorCountPerConn: 100, BackendReleasePolicy: ReleaseReuse}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+		assert.Equal(t, ReleaseRedial, handler.currentConfig().BackendReleasePolicy)
+
+		_, err := handler.Reload(config)
+		assert.ErrorIs(t, err, errReleaseReuseWithClientHandshake)
+		assert.Equal(t, ReleaseRedial, handler.pool.currentSettings().releasePolicy)
+	})
+
+	t.Run("ShouldRejectReliableDeliveryWithoutMessageFraming", func(t *testing.T) {
+		config := HandlerConfig{MaxIdleConnCount: 5, MaxAllowedErrorCountPerConn: 100, ReliableDelivery: true}
+		handler := NewInterruptibleWebsocketProxyHandler(websocket.Config{}, config, tl)
+		defer handler.Shutdown(context.Background())
+		assert.False(t, handler.currentConfig().ReliableDelivery)
+		assert.False(t, handler.WebsocketPipeManager.reliableDelivery)
+
+		config.MaxIdleConnCount = 10
+		_, err := handler.Reload(config)
+		assert.ErrorIs(t, err, errReliableDeliveryWithoutMessageFraming)
+		assert.Equal(t, int64(5), handler.pool.currentSettings().maxIdleConnections)
+
+		config.MessageFramedBuffering = true
+		_, err = handler.Reload(config)
+		assert.Nil(t, err)
+		assert.True(t, handler.WebsocketPipeManager.reliableDelivery)
+	})
+}
+
+func TestBackendWSConnPool_UpdateBackendOptions(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldRaiseCapacityRightAway", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.Nil(t, pool.AddToPool(expUrl))
+		_, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+
+		assert.Nil(t, pool.UpdateBackendOptions(expUrl, BackendOptions{Capacity: 2}))
+		_, err = pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, pool.InUseCount(expUrl))
+	})
+
+	t.Run("ShouldLowerCapacityOnceConnectionsAreGivenBack", func(t *testing.T) {
+		expUrl := newTestBackend(t, time.Minute)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.Nil(t, pool.AddToPoolWithCapacity(expUrl, 3))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 3
+		}, time.Second*10, time.Millisecond*50)
+		first, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		second, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+
+		// The idle entry goes right away, one of the two in use once it is released
+		assert.Nil(t, pool.UpdateBackendOptions(expUrl, BackendOptions{Capacity: 1}))
+		assert.Equal(t, 0, idleLen(pool))
+		pool.Release(first)
+		assert.Equal(t, 0, idleLen(pool))
+		pool.Release(second)
+		assert.Equal(t, 1, idleLen(pool))
+	})
+
+	t.Run("ShouldRejectUnknownBackendUrl", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.NotNil(t, pool.UpdateBackendOptions("ws://localhost:8081", BackendOptions{}))
+	})
+}
@@ -0,0 +1,130 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// WarmConnectionConfig Configuration for dialing idle connections ahead of GetConn
+type WarmConnectionConfig struct {
+	// PingInterval idle connections are pinged on to keep them alive, a ping which cannot be written gets the connection
+	// redialed. Defaults to 30s
+	PingInterval time.Duration
+	// MaxAge idle connections are redialed after, zero keeps them as long as pings succeed
+	MaxAge time.Duration
+	// DialTimeout bounds a background dial, defaults to 10s
+	DialTimeout time.Duration
+}
+
+func (wc WarmConnectionConfig) withDefaults() WarmConnectionConfig {
+	if wc.PingInterval <= 0 {
+		wc.PingInterval = time.Second * 30
+	}
+	if wc.DialTimeout <= 0 {
+		wc.DialTimeout = time.Second * 10
+	}
+	return wc
+}
+
+// EnableWarmConnections Dials idle connections in the background so GetConn only has to pop one off the idle list,
+// which keeps dialing off the path of a client and of a failover. Idle connections are kept alive with pings and
+// redialed once a ping cannot be written or they outlive MaxAge. Pongs are not waited for, a backend which stops
+// answering without closing the connection is only noticed once a pipe uses it. Entries are warmed one at a time, the
+// others stay on the idle list meanwhile. Warm connections are dialed without a client handshake, GetConn redials one
+// for a context carrying a handshake, so they only help pipes created without one. To be called once, stops when the
+// pool is closed
+func (bp *BackendWSConnPool) EnableWarmConnections(config WarmConnectionConfig) {
+	config = config.withDefaults()
+	tick := time.Second
+	if config.PingInterval < tick {
+		tick = config.PingInterval
+	}
+	bp.loopsWg.Add(1)
+	go func() {
+		defer bp.loopsWg.Done()
+		for sleepUnlessClosed(tick, bp.closed) {
+			for !bp.isClosed() {
+				conn := bp.takeConnectionToWarm(config, time.Now())
+				if conn == nil {
+					break
+				}
+				bp.warmConnection(conn, config)
+			}
+		}
+	}()
+}
+
+// takeConnectionToWarm Takes the oldest idle entry which is yet to be dialed, due for a ping or too old off the idle
+// list, nil if there is none
+func (bp *BackendWSConnPool) takeConnectionToWarm(config WarmConnectionConfig, now time.Time) *BackendConn {
+	bp.idleConnMutex.Lock()
+	defer bp.idleConnMutex.Unlock()
+	for e := bp.idleConnections.Front(); e != nil; e = e.Next() {
+		conn := e.Value.(*BackendConn)
+		if conn.Conn == nil || now.Sub(conn.lastPingAt) >= config.PingInterval ||
+			(config.MaxAge > 0 && now.Sub(conn.dialedAt) >= config.MaxAge) {
+			bp.idleConnections.Remove(e)
+			atomic.AddInt64(bp.idleConnCount, -1)
+			return conn
+		}
+	}
+	return nil
+}
+
+// warmConnection Pings or redials the entry and hands it back to the idle list
+func (bp *BackendWSConnPool) warmConnection(conn *BackendConn, config WarmConnectionConfig) {
+	if !bp.isActive(conn.registration) {
+		bp.discardConn(conn)
+		return
+	}
+	if conn.Conn != nil {
+		if config.MaxAge > 0 && time.Since(conn.dialedAt) >= config.MaxAge {
+			bp.logger.Debug(fmt.Sprintf("redialing idle connection which reached max age: %s", conn.connUrl))
+			closeBackendConn(conn)
+		} else if err := pingConn(conn); err != nil {
+			bp.logger.Debug(fmt.Sprintf("redialing idle connection which could not be pinged: %s, error: %s", conn.connUrl, err))
+			closeBackendConn(conn)
+		} else {
+			conn.lastPingAt = time.Now()
+		}
+	}
+	if conn.Conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), config.DialTimeout)
+		netConn, err := bp.currentSettings().dialer.Dial(ctx, conn.connUrl)
+		cancel()
+		if err != nil {
+			bp.logger.Error("errored out while pre-dialing idle connection", err)
+			bp.MarkError(conn)
+			return
+		}
+		conn.Conn = netConn
+		conn.dialedAt, conn.lastPingAt = time.Now(), time.Now()
+		conn.dialedWithHandshake = false
+		conn.registration.breaker.recordSuccess()
+	}
+
+	bp.idleConnMutex.Lock()
+	defer bp.idleConnMutex.Unlock()
+	if bp.isClosed() {
+		closeBackendConn(conn)
+		return
+	}
+	if bp.pushIdle(conn) {
+		atomic.AddInt64(bp.idleConnCount, 1)
+	}
+}
+
+// pingConn Sends a websocket ping, which fails only for a connection known to be broken. The pong cannot be told apart,
+// golang.org/x/net/websocket discards it in the reader of whichever pipe gets the connection
+func pingConn(conn *BackendConn) error {
+	ws, ok := asWebsocketConn(conn)
+	if !ok {
+		return nil
+	}
+	ws.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	defer ws.SetWriteDeadline(time.Time{})
+	return messageCodec.Send(ws, wsMessage{payloadType: websocket.PingFrame})
+}
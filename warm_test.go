@@ -0,0 +1,100 @@
+package interruptible_websocket_proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// idleConn Connection of the single idle entry of the pool once it is dialed
+func idleConn(pool *BackendWSConnPool) net.Conn {
+	pool.idleConnMutex.Lock()
+	defer pool.idleConnMutex.Unlock()
+	if front := pool.idleConnections.Front(); front != nil {
+		return front.Value.(*BackendConn).Conn
+	}
+	return nil
+}
+
+func TestBackendWSConnPool_EnableWarmConnections(t *testing.T) {
+	tl := &testLogger{}
+
+	t.Run("ShouldPreDialIdleEntriesAndHandThemOutAsIs", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.EnableWarmConnections(WarmConnectionConfig{PingInterval: time.Millisecond * 100})
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+
+		assert.Eventually(t, func() bool {
+			return idleConn(pool) != nil
+		}, time.Second*5, time.Millisecond*50)
+		warmConn := idleConn(pool)
+		// Pings keep the same connection around
+		time.Sleep(time.Millisecond * 300)
+		assert.Equal(t, warmConn, idleConn(pool))
+
+		conn, err := pool.GetConn(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, warmConn, conn.Conn)
+		_, err = conn.Write([]byte("hello"))
+		assert.Nil(t, err)
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(buf[:n]))
+	})
+
+	t.Run("ShouldRedialWarmConnectionForClientHandshake", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.EnableWarmConnections(WarmConnectionConfig{PingInterval: time.Millisecond * 100})
+		assert.Nil(t, pool.AddToPool(expUrl))
+		assert.Eventually(t, func() bool {
+			return idleConn(pool) != nil
+		}, time.Second*5, time.Millisecond*50)
+		warmConn := idleConn(pool)
+
+		ctx := WithClientHandshake(context.Background(), &ClientHandshake{Header: http.Header{"X-Forwarded-For": []string{"10.0.0.1"}}})
+		conn, err := pool.GetConn(ctx)
+		assert.Nil(t, err)
+		assert.NotEqual(t, warmConn, conn.Conn)
+		assert.True(t, conn.dialedWithHandshake)
+	})
+
+	t.Run("ShouldTakeOneEntryAtATimeLeavingTheOthersIdle", func(t *testing.T) {
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		assert.Nil(t, pool.AddToPoolWithCapacity("ws://localhost:8081", 3))
+		assert.Eventually(t, func() bool {
+			return idleLen(pool) == 3
+		}, time.Second*10, time.Millisecond*50)
+
+		conn := pool.takeConnectionToWarm(WarmConnectionConfig{}.withDefaults(), time.Now())
+		assert.NotNil(t, conn)
+		assert.Equal(t, 2, idleLen(pool))
+	})
+
+	t.Run("ShouldRedialIdleConnectionsReachingMaxAge", func(t *testing.T) {
+		expUrl := newTestEchoBackend(t, 0)
+		pool := NewBackendConnPool(5, 100, tl)
+		defer pool.Close(context.Background())
+		pool.EnableWarmConnections(WarmConnectionConfig{PingInterval: time.Millisecond * 100, MaxAge: time.Millisecond * 300})
+		err := pool.AddToPool(expUrl)
+		assert.Nil(t, err)
+
+		assert.Eventually(t, func() bool {
+			return idleConn(pool) != nil
+		}, time.Second*5, time.Millisecond*50)
+		firstConn := idleConn(pool)
+		assert.Eventually(t, func() bool {
+			conn := idleConn(pool)
+			return conn != nil && conn != firstConn
+		}, time.Second*5, time.Millisecond*50)
+	})
+}